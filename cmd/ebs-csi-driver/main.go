@@ -18,23 +18,180 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/bertinatto/ebs-csi-driver/pkg/cloud"
 	"github.com/bertinatto/ebs-csi-driver/pkg/driver"
-	"github.com/golang/glog"
+	"github.com/bertinatto/ebs-csi-driver/pkg/metrics"
+	"github.com/bertinatto/ebs-csi-driver/pkg/util"
+	"k8s.io/klog"
 )
 
 func main() {
-	var endpoint = flag.String("endpoint", "unix://tmp/csi.sock", "CSI Endpoint")
+	var (
+		endpoint        = flag.String("endpoint", "unix://tmp/csi.sock", "CSI Endpoint")
+		showVersion     = flag.Bool("version", false, "Print the version and exit")
+		driverName      = flag.String("driver-name", driver.DefaultDriverName, "Name the driver is registered with, e.g. to run two instances side by side")
+		mode            = flag.String("mode", string(driver.AllMode), "CSI services to run: all, controller or node; the controller may run outside of EC2 when --region is set")
+		region          = flag.String("region", os.Getenv("AWS_REGION"), "AWS region, overrides the one from the instance metadata (defaults to $AWS_REGION)")
+		ec2Endpoint     = flag.String("ec2-endpoint", "", "EC2 API endpoint, overrides the default one (e.g. for testing against localstack)")
+		caBundle        = flag.String("ca-bundle", "", "PEM file of the certificate authorities trusted by the AWS API requests instead of the system ones")
+		useFIPS         = flag.Bool("use-fips-endpoint", false, "Send the EC2 requests to the FIPS endpoint of the region")
+		awsQPS          = flag.Float64("aws-qps", 0, "Maximum number of requests per second sent to the AWS API, 0 disables rate limiting")
+		awsBurst        = flag.Int("aws-burst", 10, "Maximum burst of requests sent to the AWS API when rate limiting is enabled")
+		awsMaxRetries   = flag.Int("aws-max-retries", cloud.DefaultMaxRetries, "Maximum number of retries of a retryable AWS API request, e.g. a throttled one")
+		volumesPageSize = flag.Int64("volumes-page-size", cloud.DefaultVolumesPageSize, "Number of volumes requested per DescribeVolumes call, between 5 and 1000")
+		devicePrefix    = flag.String("device-prefix", "/dev/xvd", "Prefix of the device names used to attach volumes, either /dev/xvd or /dev/sd")
+		reservedDevices = flag.String("reserved-device-suffixes", "", "Comma-separated device suffixes never used to attach volumes, e.g. ba,bb for /dev/xvdba and /dev/xvdbb")
+		attachTimeout   = flag.Duration("attachment-timeout", cloud.DefaultAttachmentTimeout, "Time to wait for a volume to be attached or detached")
+		modifyTimeout   = flag.Duration("modification-timeout", cloud.DefaultModificationTimeout, "Time to wait for a volume modification to take effect")
+		pollInterval    = flag.Duration("poll-interval", cloud.DefaultPollInterval, "Interval between the checks of the state of attachments, volume modifications and snapshots, shorter than the timeouts")
+		waitForDelete   = flag.Bool("wait-for-deletion", false, "Wait for deleted volumes to be gone before DeleteVolume returns, rather than returning while they're being deleted")
+		deleteTimeout   = flag.Duration("deletion-timeout", cloud.DefaultDeletionTimeout, "Time to wait for a deleted volume to be gone when --wait-for-deletion is set")
+		instanceTTL     = flag.Duration("instance-cache-ttl", cloud.DefaultInstanceCacheTTL, "Time the instances described to attach or detach volumes are cached for, 0 disables caching")
+		attachmentsFile = flag.String("attachments-file", "", "File to persist the attachments in progress to, so that device reservations survive restarts")
+		awsProfile      = flag.String("aws-profile", "", "Profile of the AWS shared credentials and config files, used outside of EC2 only, after the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY variables (defaults to $AWS_PROFILE)")
+		assumeRoleARN   = flag.String("assume-role-arn", "", "ARN of an IAM role to assume to manage the volumes, e.g. of another account")
+		externalID      = flag.String("assume-role-external-id", "", "External ID required to assume the role given by --assume-role-arn, if any")
+		sessionName     = flag.String("assume-role-session-name", "", "Session name of the role given by --assume-role-arn, generated if empty")
+		skipCredsCheck  = flag.Bool("skip-credentials-check", false, "Don't check the AWS credentials on startup, e.g. when EC2 isn't reachable")
+		userAgentSuffix = flag.String("user-agent-suffix", "", "Suffix appended to the user agent of the AWS API requests, after the driver name and version")
+		extraTags       = flag.String("extra-tags", "", "Extra tags added to every created volume, as comma-separated key=value pairs")
+		clusterID       = flag.String("cluster-id", "", "ID of the cluster the created volumes are tagged with, volumes of other clusters aren't looked up by name")
+		multiNodeReader = flag.Bool("multi-node-reader-only", false, "Accept the MULTI_NODE_READER_ONLY access mode, i.e. ReadOnlyMany volumes, which only Multi-Attach volumes can honor")
+		volumeType      = flag.String("default-volume-type", cloud.DefaultVolumeType, "Type of the volumes created without a type parameter in their StorageClass")
+		attachLimit     = flag.Int64("volume-attach-limit", 0, "Maximum number of volumes attached to the node, derived from the instance type if 0")
+		metricsAddress  = flag.String("metrics-address", "", "Address to serve the Prometheus metrics on, e.g. :8080, metrics are disabled if empty")
+		healthPort      = flag.Int("health-port", 0, "Port to serve the /healthz and /readyz HTTP checks on, the checks are disabled if 0")
+		rpcTimeout      = flag.Duration("rpc-timeout", 0, "Time an RPC may run before it's cancelled with DeadlineExceeded, 0 disables the timeout")
+		rpcTimeouts     = flag.String("rpc-timeouts", "", "Timeouts of specific RPCs overriding --rpc-timeout, as comma-separated method=duration pairs, e.g. ControllerPublishVolume=5m,Probe=10s")
+		shutdownTimeout = flag.Duration("shutdown-timeout", driver.DefaultShutdownTimeout, "Time to wait for the RPCs in progress to finish on shutdown")
+		skipFsck        = flag.Bool("skip-fsck", false, "Mount the formatted volumes without checking their filesystem with fsck first")
+		snapshotTimeout = flag.Duration("snapshot-ready-timeout", driver.DefaultSnapshotReadyTimeout, "Time CreateSnapshot waits for a new snapshot to be ready before reporting it as uploading")
+	)
+
+	// The vendored k8s.io/kubernetes mount utilities still log through glog,
+	// which registers most of the klog flags on the command line already. The
+	// flags only klog has, e.g. -skip_headers and -log_file, are registered on
+	// the command line as they are, the others are synced with the glog ones
+	klogFlags := flag.NewFlagSet("klog", flag.ExitOnError)
+	klog.InitFlags(klogFlags)
+	var glogFlags []string
+	klogFlags.VisitAll(func(f *flag.Flag) {
+		if flag.CommandLine.Lookup(f.Name) != nil {
+			glogFlags = append(glogFlags, f.Name)
+			return
+		}
+		flag.CommandLine.Var(f.Value, f.Name, f.Usage)
+	})
 	flag.Parse()
+	for _, name := range glogFlags {
+		klogFlags.Lookup(name).Value.Set(flag.CommandLine.Lookup(name).Value.String())
+	}
+
+	if *showVersion {
+		fmt.Println(driver.VersionString())
+		os.Exit(0)
+	}
+
+	tags, err := util.ParseTags(*extraTags)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+	if err := cloud.ValidateTags(tags); err != nil {
+		klog.Fatalf("Invalid extra tags: %v", err)
+	}
+
+	var reservedSuffixes []string
+	if len(*reservedDevices) != 0 {
+		reservedSuffixes = strings.Split(*reservedDevices, ",")
+	}
 
-	cloud, err := cloud.NewCloud()
+	methodTimeouts, err := util.ParseDurations(*rpcTimeouts)
 	if err != nil {
-		glog.Fatalln(err)
+		klog.Fatalf("Invalid RPC timeouts: %v", err)
 	}
 
-	drv := driver.NewDriver(cloud, nil, *endpoint)
+	cloud, err := cloud.NewCloud(&cloud.CloudOptions{
+		Region:                 *region,
+		MetadataOptional:       driver.Mode(*mode) == driver.ControllerMode,
+		EC2Endpoint:            *ec2Endpoint,
+		UseFIPSEndpoint:        *useFIPS,
+		CABundle:               *caBundle,
+		QPS:                    float32(*awsQPS),
+		Burst:                  *awsBurst,
+		MaxRetries:             *awsMaxRetries,
+		VolumesPageSize:        *volumesPageSize,
+		DevicePrefix:           *devicePrefix,
+		ReservedDeviceSuffixes: reservedSuffixes,
+		AttachmentTimeout:      *attachTimeout,
+		ModificationTimeout:    *modifyTimeout,
+		PollInterval:           *pollInterval,
+		WaitForDeletion:        *waitForDelete,
+		DeletionTimeout:        *deleteTimeout,
+		InstanceCacheTTL:       *instanceTTL,
+		AttachmentsFile:        *attachmentsFile,
+		Profile:                *awsProfile,
+		AssumeRoleARN:          *assumeRoleARN,
+		AssumeRoleExternalID:   *externalID,
+		AssumeRoleSessionName:  *sessionName,
+		SkipCredentialsCheck:   *skipCredsCheck,
+		ClusterID:              *clusterID,
+		UserAgent:              driver.UserAgent(*driverName, *userAgentSuffix),
+	})
+	if err != nil {
+		klog.Fatalln(err)
+	}
+
+	drv := driver.NewDriver(cloud, nil, &driver.DriverOptions{
+		Name:                 *driverName,
+		Endpoint:             *endpoint,
+		Mode:                 driver.Mode(*mode),
+		ExtraTags:            tags,
+		ClusterID:            *clusterID,
+		DefaultVolumeType:    *volumeType,
+		MultiNodeReaderOnly:  *multiNodeReader,
+		VolumeAttachLimit:    *attachLimit,
+		ShutdownTimeout:      *shutdownTimeout,
+		SnapshotReadyTimeout: *snapshotTimeout,
+		SkipFsck:             *skipFsck,
+		RPCTimeout:           *rpcTimeout,
+		RPCTimeouts:          methodTimeouts,
+	})
+
+	if len(*metricsAddress) != 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		go func() {
+			klog.Fatalln(http.ListenAndServe(*metricsAddress, mux))
+		}()
+	}
+
+	if *healthPort != 0 {
+		go func() {
+			klog.Fatalln(http.ListenAndServe(fmt.Sprintf(":%d", *healthPort), drv.HealthHandler()))
+		}()
+	}
+
+	// Drain the RPCs in progress on termination, so that no operation is
+	// interrupted halfway during a rollout
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-signals
+		klog.Infof("Received signal %v, shutting down", sig)
+		drv.Stop()
+		close(stopped)
+	}()
+
 	if err := drv.Run(); err != nil {
-		glog.Fatalln(err)
+		klog.Fatalln(err)
 	}
+	<-stopped
 }
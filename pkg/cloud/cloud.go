@@ -17,19 +17,27 @@ limitations under the License.
 package cloud
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	dm "github.com/bertinatto/ebs-csi-driver/pkg/cloud/devicemanager"
 	"github.com/bertinatto/ebs-csi-driver/pkg/util"
-	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
 )
 
 const (
@@ -40,6 +48,20 @@ const (
 	// VolumeNameTagKey is the key value that refers to the volume's name.
 	VolumeNameTagKey = "com.amazon.aws.csi.volume"
 
+	// SnapshotNameTagKey is the key value that refers to the snapshot's name.
+	SnapshotNameTagKey = "com.amazon.aws.csi.snapshot"
+
+	// SourceSnapshotTagKey is the key value that refers to the snapshot a
+	// volume was restored from.
+	SourceSnapshotTagKey = "com.amazon.aws.csi.source-snapshot"
+
+	// clusterTagKeyPrefix is followed by the cluster ID in the key of the tag
+	// marking the volumes owned by a cluster.
+	clusterTagKeyPrefix = "kubernetes.io/cluster/"
+
+	// ClusterTagOwned is the value of the cluster tag of the volumes created by the driver.
+	ClusterTagOwned = "owned"
+
 	// VolumeTypeIO1 represents a provisioned IOPS SSD type of volume.
 	VolumeTypeIO1 = "io1"
 
@@ -60,24 +82,180 @@ const (
 
 	// DefaultVolumeType specifies which storage to use for newly created Volumes.
 	DefaultVolumeType = VolumeTypeGP2
+
+	// MinVolumeSizeGiBIO1 is the minimum size of an io1 volume.
+	MinVolumeSizeGiBIO1 int64 = 4
+
+	// MinVolumeSizeGiBHDD is the minimum size of a st1 or sc1 volume.
+	MinVolumeSizeGiBHDD int64 = 125
+
+	// MaxVolumeSizeGiB is the maximum size of a volume of any of the supported types.
+	MaxVolumeSizeGiB int64 = 16 * 1024
+
+	// MaxTagsPerResource is the maximum number of tags of an EC2 resource.
+	MaxTagsPerResource = 50
+
+	// MaxTagKeyLength is the maximum length of a tag key.
+	MaxTagKeyLength = 128
+
+	// MaxTagValueLength is the maximum length of a tag value.
+	MaxTagValueLength = 256
+
+	// reservedTagKeyPrefix is the prefix of the tag keys reserved by AWS.
+	reservedTagKeyPrefix = "aws:"
+
+	// DefaultMaxRetries is the default number of times a retryable EC2 request,
+	// e.g. a throttled one, is retried by the AWS SDK.
+	DefaultMaxRetries = 5
+
+	// DefaultVolumesPageSize is the number of volumes requested per DescribeVolumes call.
+	DefaultVolumesPageSize int64 = 500
+
+	// minVolumesPageSize and maxVolumesPageSize are the bounds EC2 imposes on
+	// the number of volumes requested per DescribeVolumes call.
+	minVolumesPageSize int64 = 5
+	maxVolumesPageSize int64 = 1000
+
+	// volumeIDsPerRequest is the number of volume IDs filtered on per DescribeVolumes call.
+	volumeIDsPerRequest = 200
+
+	// snapshotsPageSize is the number of snapshots requested per DescribeSnapshots call.
+	snapshotsPageSize int64 = 1000
+
+	// DefaultInstanceCacheTTL is how long the described instances are cached for.
+	DefaultInstanceCacheTTL = 5 * time.Second
+
+	// DefaultAttachmentTimeout is how long to wait for a volume to be attached or detached.
+	DefaultAttachmentTimeout = 5 * time.Minute
+
+	// DefaultModificationTimeout is how long to wait for a volume modification to take effect.
+	DefaultModificationTimeout = 10 * time.Minute
+
+	// DefaultDeletionTimeout is how long to wait for a deleted volume to be gone,
+	// when waiting for deletions is enabled.
+	DefaultDeletionTimeout = 2 * time.Minute
+
+	// DefaultPollInterval is how often the state of an attachment, a volume
+	// modification or a snapshot is checked while waiting for it.
+	DefaultPollInterval = 2 * time.Second
+
+	// volumeModificationCooldown is how long EC2 requires to wait after a volume
+	// modification starts before the volume can be modified again.
+	volumeModificationCooldown = 6 * time.Hour
+
+	// startupTimeout bounds the calls made to AWS while initializing the cloud,
+	// i.e. fetching the instance metadata and checking the credentials.
+	startupTimeout = 2 * time.Minute
+
+	// stsRequestTimeout bounds each request sent to STS to assume a role. The
+	// credentials are retrieved while signing the EC2 requests, regardless of
+	// their context, so a hung STS endpoint would block them otherwise.
+	stsRequestTimeout = 30 * time.Second
 )
 
+// metadataBackoff is used to retry fetching the instance metadata.
+var metadataBackoff = wait.Backoff{
+	Duration: 1 * time.Second,
+	Factor:   2,
+	Steps:    4,
+}
+
+// deleteBackoff is used to retry deleting a volume that is still in use, e.g.
+// right after it was detached. It gives up after about half a minute.
+var deleteBackoff = wait.Backoff{
+	Duration: 2 * time.Second,
+	Factor:   2,
+	Steps:    5,
+}
+
+// fipsRegions are the regions where EC2 has a FIPS endpoint.
+var fipsRegions = map[string]bool{
+	"us-east-1": true, "us-east-2": true,
+	"us-west-1": true, "us-west-2": true,
+	"us-gov-east-1": true, "us-gov-west-1": true,
+	"ca-central-1": true,
+}
+
 var (
 	// ErrMultiDisks is an error that is returned when multiple
 	// disks are found with the same volume name.
 	ErrMultiDisks = errors.New("Multiple disks with same name")
 
 	// ErrDiskExistsDiffSize is an error that is returned if a disk with a given
-	// name, but different size, is found.
+	// name, but smaller size, is found.
 	ErrDiskExistsDiffSize = errors.New("There is already a disk with same name and different size")
 
 	// ErrVolumeNotFound is returned when a volume with a given ID is not found.
 	ErrVolumeNotFound = errors.New("Volume was not found")
+
+	// ErrSnapshotNotFound is returned when a snapshot with a given name or ID is not found.
+	ErrSnapshotNotFound = errors.New("Snapshot was not found")
+
+	// ErrMultiSnapshots is returned when multiple snapshots are found
+	// with the same snapshot name.
+	ErrMultiSnapshots = errors.New("Multiple snapshots with same name")
+
+	// ErrAttachmentLimitExceeded is returned when a volume can't be attached
+	// because the instance has reached its limit of attached volumes.
+	ErrAttachmentLimitExceeded = errors.New("Attachment limit of the instance exceeded")
+
+	// ErrInsufficientVolumeCapacity is returned when a volume can't be created in
+	// the requested zone, because EBS lacks the capacity or doesn't support the
+	// volume type there. It may be created in another zone.
+	ErrInsufficientVolumeCapacity = errors.New("Insufficient capacity to create the volume in the zone")
+
+	// ErrInvalidStartingToken is returned when a listing is requested
+	// with a starting token that doesn't point to a valid position.
+	ErrInvalidStartingToken = errors.New("Invalid starting token")
+
+	// ErrVolumeModificationInProgress is returned when a volume can't be resized
+	// because a modification to a smaller size is still in progress.
+	ErrVolumeModificationInProgress = errors.New("A modification of the volume is already in progress")
+
+	// ErrVolumeModificationRateExceeded is returned when a volume can't be resized
+	// because it was modified less than 6 hours ago.
+	ErrVolumeModificationRateExceeded = errors.New("Volumes can only be modified once every 6 hours")
+
+	// errAttachmentStateTimeout is returned by waitForAttachmentState when the
+	// attachment didn't reach the expected state within the attachment timeout.
+	errAttachmentStateTimeout = errors.New("timed out")
 )
 
+// VolumeInUseError is returned when a volume can't be attached
+// because it's attached to another instance.
+type VolumeInUseError struct {
+	VolumeID string
+	// InstanceID is the instance the volume is attached to.
+	InstanceID string
+}
+
+func (e *VolumeInUseError) Error() string {
+	return fmt.Sprintf("volume %q is already attached to instance %q", e.VolumeID, e.InstanceID)
+}
+
+// AttachmentTimeoutError is returned when a volume is still not attached once the
+// attachment timeout expires. The device stays reserved for the volume, since the
+// attachment may still complete, so a retry waits for the same attachment. A volume
+// stuck attaching may need the instance to be rebooted.
+type AttachmentTimeoutError struct {
+	VolumeID   string
+	InstanceID string
+	Device     string
+}
+
+func (e *AttachmentTimeoutError) Error() string {
+	return fmt.Sprintf("volume %q is still attaching to instance %q as %s, the instance may need to be rebooted", e.VolumeID, e.InstanceID, e.Device)
+}
+
 type Disk struct {
-	VolumeID    string
-	CapacityGiB int64
+	VolumeID         string
+	CapacityGiB      int64
+	AvailabilityZone string
+	VolumeType       string
+	// AttachedNodeIDs are the instances the volume is attached to.
+	AttachedNodeIDs []string
+	// SnapshotID is the snapshot the volume was restored from, if any.
+	SnapshotID string
 }
 
 type DiskOptions struct {
@@ -85,82 +263,435 @@ type DiskOptions struct {
 	Tags          map[string]string
 	VolumeType    string
 	IOPSPerGB     int64
+	// IOPS is the total number of I/O operations per second of io1 volumes.
+	// It can't be combined with IOPSPerGB, which scales with the size.
+	IOPS      int64
+	Encrypted bool
+	// AvailabilityZone is where the volume is created, the
+	// zone of the instance is used if empty.
+	AvailabilityZone string
+	// KmsKeyID is the KMS key used to encrypt the volume, the default
+	// EBS key is used if empty.
+	KmsKeyID string
+	// SnapshotID is the snapshot the volume is restored from, the
+	// volume is created empty if it's empty.
+	SnapshotID string
+}
+
+type Snapshot struct {
+	SnapshotID     string
+	SourceVolumeID string
+	Size           int64
+	CreationTime   time.Time
+	ReadyToUse     bool
+}
+
+type SnapshotOptions struct {
+	Tags map[string]string
+	// ReadyTimeout is how long to wait for the snapshot to be completed. If it's
+	// zero, the snapshot is returned right after it's created.
+	ReadyTimeout time.Duration
 }
 
 // EC2 abstracts aws.EC2 to facilitate its mocking.
 type EC2 interface {
-	DescribeVolumes(input *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error)
-	CreateVolume(input *ec2.CreateVolumeInput) (*ec2.Volume, error)
-	DeleteVolume(input *ec2.DeleteVolumeInput) (*ec2.DeleteVolumeOutput, error)
-	DetachVolume(input *ec2.DetachVolumeInput) (*ec2.VolumeAttachment, error)
-	AttachVolume(input *ec2.AttachVolumeInput) (*ec2.VolumeAttachment, error)
-	DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+	DescribeVolumesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput, opts ...request.Option) (*ec2.DescribeVolumesOutput, error)
+	CreateVolumeWithContext(ctx aws.Context, input *ec2.CreateVolumeInput, opts ...request.Option) (*ec2.Volume, error)
+	DeleteVolumeWithContext(ctx aws.Context, input *ec2.DeleteVolumeInput, opts ...request.Option) (*ec2.DeleteVolumeOutput, error)
+	DetachVolumeWithContext(ctx aws.Context, input *ec2.DetachVolumeInput, opts ...request.Option) (*ec2.VolumeAttachment, error)
+	AttachVolumeWithContext(ctx aws.Context, input *ec2.AttachVolumeInput, opts ...request.Option) (*ec2.VolumeAttachment, error)
+	DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error)
+	CreateSnapshotWithContext(ctx aws.Context, input *ec2.CreateSnapshotInput, opts ...request.Option) (*ec2.Snapshot, error)
+	DeleteSnapshotWithContext(ctx aws.Context, input *ec2.DeleteSnapshotInput, opts ...request.Option) (*ec2.DeleteSnapshotOutput, error)
+	DescribeSnapshotsWithContext(ctx aws.Context, input *ec2.DescribeSnapshotsInput, opts ...request.Option) (*ec2.DescribeSnapshotsOutput, error)
+	ModifyVolumeWithContext(ctx aws.Context, input *ec2.ModifyVolumeInput, opts ...request.Option) (*ec2.ModifyVolumeOutput, error)
+	DescribeVolumesModificationsWithContext(ctx aws.Context, input *ec2.DescribeVolumesModificationsInput, opts ...request.Option) (*ec2.DescribeVolumesModificationsOutput, error)
 }
 
 type Cloud interface {
 	GetMetadata() MetadataService
-	CreateDisk(string, *DiskOptions) (*Disk, error)
-	DeleteDisk(string) (bool, error)
-	AttachDisk(string, string) (string, error)
-	DetachDisk(string, string) error
-	GetDisk(string, int64) (*Disk, error)
+	CreateDisk(context.Context, string, *DiskOptions) (*Disk, error)
+	DeleteDisk(context.Context, string) (bool, error)
+	AttachDisk(context.Context, string, string) (string, error)
+	DetachDisk(context.Context, string, string) error
+	GetDiskByNameAndSize(context.Context, string, int64) (*Disk, error)
+	GetDiskByID(context.Context, string) (*Disk, error)
+	GetDisksByIDs(context.Context, []string) (map[string]*Disk, error)
+	ListDisks(context.Context, int64, string) ([]*Disk, string, error)
+	ResizeDisk(context.Context, string, int64) (int64, error)
+	CreateSnapshot(context.Context, string, *SnapshotOptions) (*Snapshot, error)
+	DeleteSnapshot(context.Context, string) (bool, error)
+	GetSnapshotByName(context.Context, string) (*Snapshot, error)
+	GetSnapshotByID(context.Context, string) (*Snapshot, error)
+	ListSnapshots(context.Context, int64, string, string) ([]*Snapshot, string, error)
 }
 
 type cloud struct {
 	metadata MetadataService
 	ec2      EC2
 	dm       dm.BlockDeviceManager
+
+	// attachmentTimeout bounds the wait for a volume to be attached or detached,
+	// and modificationTimeout the wait for a volume modification to take effect.
+	attachmentTimeout   time.Duration
+	modificationTimeout time.Duration
+
+	// pollInterval is how often the state is checked by the waits.
+	pollInterval time.Duration
+
+	// waitForDeletion makes DeleteDisk wait for the volume to be gone, for
+	// up to deletionTimeout.
+	waitForDeletion bool
+	deletionTimeout time.Duration
+
+	// volumesPageSize is the number of volumes requested per DescribeVolumes
+	// call, when the volumes are filtered rather than given by ID.
+	volumesPageSize int64
+
+	// clusterID scopes the lookup of volumes by name to the cluster, if set.
+	clusterID string
+
+	// instances caches the instances volumes are attached to or detached from.
+	instances *instanceCache
 }
 
 var _ Cloud = &cloud{}
 
-func NewCloud() (Cloud, error) {
-	sess, err := session.NewSession(&aws.Config{})
+// CloudOptions holds the options used to create a Cloud.
+type CloudOptions struct {
+	// Region overrides the region reported by the instance metadata. When the
+	// metadata service isn't available, it defaults to the region of the
+	// AWS_REGION or AWS_DEFAULT_REGION variables or of the shared config file.
+	Region string
+
+	// MetadataOptional allows creating the cloud when the instance metadata
+	// can't be fetched, e.g. to run the controller service outside of EC2.
+	// Only Region is known then, the instance ID and zone are left empty.
+	MetadataOptional bool
+
+	// EC2Endpoint overrides the default EC2 API endpoint, e.g. to run
+	// against localstack or a VPC endpoint.
+	EC2Endpoint string
+
+	// CABundle is the PEM file of the certificate authorities trusted by the
+	// AWS API requests instead of the system ones, e.g. to reach a VPC endpoint
+	// with a private CA. The system ones are used if empty.
+	CABundle string
+
+	// UseFIPSEndpoint sends the EC2 requests to the FIPS endpoint of the region.
+	// It can't be combined with EC2Endpoint.
+	UseFIPSEndpoint bool
+
+	// QPS is the maximum rate of requests per second sent to EC2.
+	// Zero disables client-side rate limiting.
+	QPS float32
+
+	// Burst is the maximum number of requests sent to EC2 at once
+	// when rate limiting is enabled.
+	Burst int
+
+	// MaxRetries is the maximum number of times the AWS SDK retries a
+	// retryable EC2 request, e.g. a throttled one. Zero disables retries.
+	MaxRetries int
+
+	// DevicePrefix is the prefix of the device names requested when
+	// attaching volumes, either "/dev/xvd" or "/dev/sd". Defaults to "/dev/xvd".
+	DevicePrefix string
+
+	// ReservedDeviceSuffixes are the device suffixes never used to attach
+	// volumes, e.g. "ba" for "/dev/xvdba", because they're used outside of
+	// the driver, e.g. by volumes attached at launch.
+	ReservedDeviceSuffixes []string
+
+	// AttachmentTimeout is how long to wait for a volume to be attached or
+	// detached. Defaults to DefaultAttachmentTimeout.
+	AttachmentTimeout time.Duration
+
+	// ModificationTimeout is how long to wait for a volume modification to
+	// take effect. Defaults to DefaultModificationTimeout.
+	ModificationTimeout time.Duration
+
+	// PollInterval is how often the state of an attachment, a volume
+	// modification or a snapshot is checked while waiting for it. It must be
+	// shorter than the timeouts. Defaults to DefaultPollInterval.
+	PollInterval time.Duration
+
+	// VolumesPageSize is the number of volumes requested per DescribeVolumes
+	// call, between 5 and 1000. Defaults to DefaultVolumesPageSize.
+	VolumesPageSize int64
+
+	// ClusterID restricts the lookup of volumes by name to the volumes owned
+	// by the cluster, i.e. tagged with ClusterTagKey, so that clusters sharing
+	// an account don't see each other's volumes. Volumes aren't scoped if empty.
+	ClusterID string
+
+	// InstanceCacheTTL is how long the instances described to attach or detach
+	// volumes are cached for. Caching is disabled if it's zero.
+	InstanceCacheTTL time.Duration
+
+	// AttachmentsFile is the file the attachments in progress are persisted to,
+	// so that device reservations survive restarts. Persistence is disabled if empty.
+	AttachmentsFile string
+
+	// Profile is the profile of the shared credentials and config files to use,
+	// e.g. to test locally. The credentials are looked up in this order: the
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY variables, the instance role,
+	// then the profile, so the profile is only used outside of EC2. Defaults to
+	// the AWS_PROFILE variable, or the default profile.
+	Profile string
+
+	// AssumeRoleARN is the ARN of an IAM role to assume, e.g. to manage volumes
+	// of another account. The default credentials are used if empty.
+	AssumeRoleARN string
+
+	// AssumeRoleExternalID is the external ID required to assume the role, if any.
+	AssumeRoleExternalID string
+
+	// AssumeRoleSessionName names the session of the assumed role.
+	// A name is generated if empty.
+	AssumeRoleSessionName string
+
+	// SkipCredentialsCheck disables the EC2 request sent on creation to
+	// check the credentials, e.g. when EC2 isn't reachable in tests.
+	SkipCredentialsCheck bool
+
+	// WaitForDeletion makes DeleteDisk wait until the deleted volume can't be
+	// described anymore, rather than returning while it's still being deleted.
+	WaitForDeletion bool
+
+	// DeletionTimeout is how long DeleteDisk waits for the deleted volume to
+	// be gone when WaitForDeletion is set. Defaults to DefaultDeletionTimeout.
+	DeletionTimeout time.Duration
+
+	// UserAgent is appended to the User-Agent header of the EC2 requests,
+	// e.g. the driver name and version. The SDK's default is kept if empty.
+	UserAgent string
+}
+
+func NewCloud(opts *CloudOptions) (Cloud, error) {
+	switch opts.DevicePrefix {
+	case "", dm.DevicePrefixXVD, dm.DevicePrefixSD:
+	default:
+		return nil, fmt.Errorf("invalid device prefix %q, must be %q or %q", opts.DevicePrefix, dm.DevicePrefixXVD, dm.DevicePrefixSD)
+	}
+	for _, suffix := range opts.ReservedDeviceSuffixes {
+		if !dm.IsDeviceSuffix(suffix) {
+			return nil, fmt.Errorf("invalid reserved device suffix %q, must be between ba and dx", suffix)
+		}
+	}
+
+	if err := validateWaitOptions(opts); err != nil {
+		return nil, err
+	}
+
+	if opts.VolumesPageSize != 0 && (opts.VolumesPageSize < minVolumesPageSize || opts.VolumesPageSize > maxVolumesPageSize) {
+		return nil, fmt.Errorf("invalid volumes page size %d, must be between %d and %d", opts.VolumesPageSize, minVolumesPageSize, maxVolumesPageSize)
+	}
+
+	// The shared config is loaded for its region, which is used when the
+	// instance metadata isn't available and no region was given
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Profile:           opts.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("unable to initialize AWS session: %v", err)
 	}
 
-	svc := ec2metadata.New(sess)
+	ctx, cancel := context.WithTimeout(context.Background(), startupTimeout)
+	defer cancel()
+
+	svc := newEC2MetadataClient(sess)
 
-	metadata, err := NewMetadataService(svc)
+	metadata, err := getMetadataService(ctx, svc, opts, aws.StringValue(sess.Config.Region))
 	if err != nil {
-		return nil, fmt.Errorf("could not get metadata from AWS: %v", err)
+		return nil, err
 	}
 
 	provider := []credentials.Provider{
 		&credentials.EnvProvider{},
 		&ec2rolecreds.EC2RoleProvider{Client: svc},
-		&credentials.SharedCredentialsProvider{},
+		&credentials.SharedCredentialsProvider{Profile: opts.Profile},
 	}
 
+	httpClient, err := newHTTPClient(opts.CABundle)
+	if err != nil {
+		return nil, err
+	}
 	awsConfig := &aws.Config{
 		Region:      aws.String(metadata.GetRegion()),
 		Credentials: credentials.NewChainCredentials(provider),
+		HTTPClient:  httpClient,
 	}
 	awsConfig = awsConfig.WithCredentialsChainVerboseErrors(true)
 
+	// Throttled requests are retried by the SDK with exponential backoff, which
+	// stops as soon as the context of the request is done
+	maxRetries := opts.MaxRetries
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	awsConfig = awsConfig.WithMaxRetries(maxRetries)
+
+	// The role is assumed with the credentials found by the chain above
+	if len(opts.AssumeRoleARN) != 0 {
+		klog.Infof("Assuming role %q", opts.AssumeRoleARN)
+		stsSess, err := session.NewSession(awsConfig.Copy().WithHTTPClient(&http.Client{
+			Timeout:   stsRequestTimeout,
+			Transport: httpClient.Transport,
+		}))
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize AWS session to assume role %q: %v", opts.AssumeRoleARN, err)
+		}
+		awsConfig = awsConfig.Copy().WithCredentials(stscreds.NewCredentials(stsSess, opts.AssumeRoleARN, assumeRoleOptions(opts)))
+	}
+	endpoint, err := ec2Endpoint(opts, metadata.GetRegion())
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoint) != 0 {
+		klog.Infof("Using custom EC2 endpoint %q", endpoint)
+		awsConfig = awsConfig.WithEndpoint(endpoint)
+	}
+
+	ec2Session := session.New(awsConfig)
+	ec2Session.Handlers.AfterRetry.PushFrontNamed(retryHandler)
+	if len(opts.UserAgent) != 0 {
+		ec2Session.Handlers.Build.PushBackNamed(userAgentHandler(opts.UserAgent))
+	}
+	ec2Client := newInstrumentedEC2(ec2.New(ec2Session))
+	if opts.QPS > 0 {
+		ec2Client = newRateLimitedEC2(ec2Client, opts.QPS, opts.Burst)
+	}
+
+	if !opts.SkipCredentialsCheck {
+		if err := checkCredentials(ctx, ec2Client); err != nil {
+			return nil, err
+		}
+	}
+
+	c := newEC2Cloud(metadata, ec2Client, opts)
+	if len(opts.AttachmentsFile) != 0 {
+		store := dm.NewFileAttachmentStore(opts.AttachmentsFile)
+		c.dm, err = dm.NewBlockDeviceManagerWithStore(opts.DevicePrefix, opts.ReservedDeviceSuffixes, store)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// validateWaitOptions checks the poll interval is shorter than the timeouts of
+// the waits, otherwise they would check the state only once.
+func validateWaitOptions(opts *CloudOptions) error {
+	pollInterval := durationOrDefault(opts.PollInterval, DefaultPollInterval)
+	if timeout := durationOrDefault(opts.AttachmentTimeout, DefaultAttachmentTimeout); pollInterval >= timeout {
+		return fmt.Errorf("poll interval %v must be shorter than the attachment timeout %v", pollInterval, timeout)
+	}
+	if timeout := durationOrDefault(opts.ModificationTimeout, DefaultModificationTimeout); pollInterval >= timeout {
+		return fmt.Errorf("poll interval %v must be shorter than the modification timeout %v", pollInterval, timeout)
+	}
+	if timeout := durationOrDefault(opts.DeletionTimeout, DefaultDeletionTimeout); opts.WaitForDeletion && pollInterval >= timeout {
+		return fmt.Errorf("poll interval %v must be shorter than the deletion timeout %v", pollInterval, timeout)
+	}
+	return nil
+}
+
+// durationOrDefault returns d, or def if d isn't positive.
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// ec2Endpoint returns the EC2 endpoint to use in the region, or an empty string
+// to use the default one. The vendored SDK doesn't know about the FIPS endpoints
+// of EC2, so they're resolved here.
+func ec2Endpoint(opts *CloudOptions, region string) (string, error) {
+	if !opts.UseFIPSEndpoint {
+		return opts.EC2Endpoint, nil
+	}
+	if len(opts.EC2Endpoint) != 0 {
+		return "", fmt.Errorf("a custom EC2 endpoint can't be used along with the FIPS endpoint")
+	}
+	if !fipsRegions[region] {
+		return "", fmt.Errorf("region %q has no EC2 FIPS endpoint", region)
+	}
+	return fmt.Sprintf("https://ec2-fips.%s.amazonaws.com", region), nil
+}
+
+// assumeRoleOptions returns a function setting the optional parameters of the role to assume.
+func assumeRoleOptions(opts *CloudOptions) func(*stscreds.AssumeRoleProvider) {
+	return func(p *stscreds.AssumeRoleProvider) {
+		if len(opts.AssumeRoleExternalID) != 0 {
+			p.ExternalID = aws.String(opts.AssumeRoleExternalID)
+		}
+		if len(opts.AssumeRoleSessionName) != 0 {
+			p.RoleSessionName = opts.AssumeRoleSessionName
+		}
+	}
+}
+
+// checkCredentials sends a cheap request to EC2 so that missing credentials or
+// permissions are reported on startup rather than on the first volume operation.
+func checkCredentials(ctx context.Context, ec2Client EC2) error {
+	request := &ec2.DescribeVolumesInput{MaxResults: aws.Int64(5)}
+	if _, err := ec2Client.DescribeVolumesWithContext(ctx, request); err != nil {
+		return fmt.Errorf("could not describe volumes, check the AWS credentials and permissions of the driver: %v", err)
+	}
+	return nil
+}
+
+// NewCloudWithEC2 returns a Cloud that talks to EC2 through the given client,
+// which allows injecting a fake or mock EC2 implementation in tests.
+func NewCloudWithEC2(metadata MetadataService, ec2Client EC2) Cloud {
+	return newEC2Cloud(metadata, ec2Client, &CloudOptions{})
+}
+
+func newEC2Cloud(metadata MetadataService, ec2Client EC2, opts *CloudOptions) *cloud {
+	volumesPageSize := opts.VolumesPageSize
+	if volumesPageSize <= 0 {
+		volumesPageSize = DefaultVolumesPageSize
+	}
 	return &cloud{
-		metadata: metadata,
-		dm:       dm.NewBlockDeviceManager(),
-		ec2:      ec2.New(session.New(awsConfig)),
-	}, nil
+		metadata:            metadata,
+		dm:                  dm.NewBlockDeviceManager(opts.DevicePrefix, opts.ReservedDeviceSuffixes),
+		ec2:                 ec2Client,
+		attachmentTimeout:   durationOrDefault(opts.AttachmentTimeout, DefaultAttachmentTimeout),
+		modificationTimeout: durationOrDefault(opts.ModificationTimeout, DefaultModificationTimeout),
+		pollInterval:        durationOrDefault(opts.PollInterval, DefaultPollInterval),
+		waitForDeletion:     opts.WaitForDeletion,
+		deletionTimeout:     durationOrDefault(opts.DeletionTimeout, DefaultDeletionTimeout),
+		volumesPageSize:     volumesPageSize,
+		clusterID:           opts.ClusterID,
+		instances:           newInstanceCache(opts.InstanceCacheTTL),
+	}
 }
 
 func (c *cloud) GetMetadata() MetadataService {
 	return c.metadata
 }
 
-func (c *cloud) CreateDisk(volumeName string, diskOptions *DiskOptions) (*Disk, error) {
+func (c *cloud) CreateDisk(ctx context.Context, volumeName string, diskOptions *DiskOptions) (*Disk, error) {
 	var createType string
 	var iops int64
-	capacityGiB := util.BytesToGiB(diskOptions.CapacityBytes)
+	capacityGiB := util.RoundUpGiB(diskOptions.CapacityBytes)
+
+	if diskOptions.IOPS > 0 && diskOptions.IOPSPerGB > 0 {
+		return nil, fmt.Errorf("IOPS and IOPS per GiB are mutually exclusive")
+	}
 
 	switch diskOptions.VolumeType {
 	case VolumeTypeGP2, VolumeTypeSC1, VolumeTypeST1:
 		createType = diskOptions.VolumeType
 	case VolumeTypeIO1:
 		createType = diskOptions.VolumeType
-		iops = capacityGiB * diskOptions.IOPSPerGB
+		iops = diskOptions.IOPS
+		if iops == 0 {
+			iops = capacityGiB * diskOptions.IOPSPerGB
+		}
 		if iops < MinTotalIOPS {
 			iops = MinTotalIOPS
 		}
@@ -173,18 +704,33 @@ func (c *cloud) CreateDisk(volumeName string, diskOptions *DiskOptions) (*Disk,
 		return nil, fmt.Errorf("invalid AWS VolumeType %q", diskOptions.VolumeType)
 	}
 
+	if minGiB := MinVolumeSizeGiB(createType); capacityGiB < minGiB {
+		return nil, fmt.Errorf("volume size %d GiB is below the minimum of %d GiB of %s volumes", capacityGiB, minGiB, createType)
+	}
+
+	if err := ValidateTags(diskOptions.Tags); err != nil {
+		return nil, err
+	}
+
 	var tags []*ec2.Tag
 	for key, value := range diskOptions.Tags {
-		tags = append(tags, &ec2.Tag{Key: &key, Value: &value})
+		tags = append(tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
 	}
 	tagSpec := ec2.TagSpecification{
 		ResourceType: aws.String("volume"),
 		Tags:         tags,
 	}
 
-	m := c.GetMetadata()
+	zone := diskOptions.AvailabilityZone
+	if len(zone) == 0 {
+		zone = c.GetMetadata().GetAvailabilityZone()
+	}
+	if len(zone) == 0 {
+		return nil, fmt.Errorf("could not determine the availability zone of the volume")
+	}
+
 	request := &ec2.CreateVolumeInput{
-		AvailabilityZone:  aws.String(m.GetAvailabilityZone()),
+		AvailabilityZone:  aws.String(zone),
 		Size:              aws.Int64(capacityGiB),
 		VolumeType:        aws.String(createType),
 		TagSpecifications: []*ec2.TagSpecification{&tagSpec},
@@ -192,9 +738,22 @@ func (c *cloud) CreateDisk(volumeName string, diskOptions *DiskOptions) (*Disk,
 	if iops > 0 {
 		request.Iops = aws.Int64(iops)
 	}
+	if diskOptions.Encrypted {
+		request.Encrypted = aws.Bool(true)
+		if len(diskOptions.KmsKeyID) != 0 {
+			request.KmsKeyId = aws.String(diskOptions.KmsKeyID)
+		}
+	}
+	if len(diskOptions.SnapshotID) != 0 {
+		request.SnapshotId = aws.String(diskOptions.SnapshotID)
+	}
 
-	response, err := c.ec2.CreateVolume(request)
+	response, err := c.ec2.CreateVolumeWithContext(ctx, request)
 	if err != nil {
+		if isAWSErrorInsufficientVolumeCapacity(err) {
+			klog.Warningf("[%s] Could not create volume %q in zone %q: %v", util.RequestID(ctx), volumeName, zone, err)
+			return nil, ErrInsufficientVolumeCapacity
+		}
 		return nil, fmt.Errorf("could not create volume in EC2: %v", err)
 	}
 
@@ -208,24 +767,76 @@ func (c *cloud) CreateDisk(volumeName string, diskOptions *DiskOptions) (*Disk,
 		return nil, fmt.Errorf("disk size was not returned by CreateVolume")
 	}
 
-	return &Disk{CapacityGiB: size, VolumeID: volumeID}, nil
+	return &Disk{CapacityGiB: size, VolumeID: volumeID, AvailabilityZone: zone, SnapshotID: diskOptions.SnapshotID}, nil
 }
 
-func (c *cloud) DeleteDisk(volumeID string) (bool, error) {
+// DeleteDisk deletes the volume. A volume that is still detaching can't be
+// deleted yet, so the deletion is retried with backoff while it's in use.
+func (c *cloud) DeleteDisk(ctx context.Context, volumeID string) (bool, error) {
 	request := &ec2.DeleteVolumeInput{VolumeId: &volumeID}
-	if _, err := c.ec2.DeleteVolume(request); err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == "InvalidVolume.NotFound" {
-				return false, ErrVolumeNotFound
-			}
+	backoff := deleteBackoff
+	var err error
+	for {
+		_, err = c.ec2.DeleteVolumeWithContext(ctx, request)
+		backoff.Steps--
+		if !isAWSErrorVolumeInUse(err) || backoff.Steps <= 0 {
+			break
+		}
+		klog.V(4).Infof("Volume %q is still in use, retrying deletion in %v", volumeID, backoff.Duration)
+		timer := time.NewTimer(backoff.Duration)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false, ctx.Err()
+		case <-timer.C:
+		}
+		backoff.Duration = time.Duration(float64(backoff.Duration) * backoff.Factor)
+	}
+	if err != nil {
+		if isAWSErrorVolumeNotFound(err) {
+			return false, ErrVolumeNotFound
 		}
 		return false, fmt.Errorf("DeleteDisk could not delete volume: %v", err)
 	}
+	// Until the volume is gone, a lookup by name could still find it, so a
+	// failed wait is returned for the CO to retry the deletion
+	if c.waitForDeletion {
+		if err := c.waitForVolumeDeletion(ctx, volumeID); err != nil {
+			return false, fmt.Errorf("DeleteDisk could not wait for volume %q to be gone: %v", volumeID, err)
+		}
+	}
 	return true, nil
 }
 
-func (c *cloud) AttachDisk(volumeID, nodeID string) (string, error) {
-	instance, err := c.getInstance(nodeID)
+// waitForVolumeDeletion waits until the volume can't be described anymore, or
+// is described as deleted, ctx is done or the deletion timeout expires.
+func (c *cloud) waitForVolumeDeletion(ctx context.Context, volumeID string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.deletionTimeout)
+	defer cancel()
+
+	verifyDeletionFunc := func() (bool, error) {
+		request := &ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(volumeID)},
+		}
+		volume, err := c.getVolume(ctx, request)
+		if err == ErrVolumeNotFound {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return aws.StringValue(volume.State) == ec2.VolumeStateDeleted, nil
+	}
+
+	err := wait.PollImmediateUntil(c.pollInterval, verifyDeletionFunc, ctx.Done())
+	if err == wait.ErrWaitTimeout && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+func (c *cloud) AttachDisk(ctx context.Context, volumeID, nodeID string) (string, error) {
+	instance, err := c.getInstance(ctx, nodeID)
 	if err != nil {
 		return "", fmt.Errorf("could not get instance %q", nodeID)
 	}
@@ -243,112 +854,559 @@ func (c *cloud) AttachDisk(volumeID, nodeID string) (string, error) {
 			VolumeId:   aws.String(volumeID),
 		}
 
-		resp, err := c.ec2.AttachVolume(request)
+		resp, err := c.ec2.AttachVolumeWithContext(ctx, request)
 		if err != nil {
+			if isAWSErrorAttachmentLimitExceeded(err) {
+				klog.Warningf("[%s] Could not attach volume %q to node %q: %v", util.RequestID(ctx), volumeID, nodeID, err)
+				return "", ErrAttachmentLimitExceeded
+			}
+			if isAWSErrorVolumeInUse(err) {
+				attachment, instanceID, descErr := c.getAttachments(ctx, volumeID, nodeID)
+				if descErr != nil {
+					return "", fmt.Errorf("could not attach volume %q to node %q: %v", volumeID, nodeID, err)
+				}
+				if len(instanceID) != 0 {
+					return "", &VolumeInUseError{VolumeID: volumeID, InstanceID: instanceID}
+				}
+				// The volume was attached to the node out of band, e.g. a statically
+				// provisioned volume, after the instance was described. The device
+				// reserved for it is released on return, as the attachment failed
+				if attachment != nil && aws.StringValue(attachment.State) == "attached" {
+					klog.V(2).Infof("[%s] Volume %q is already attached to node %q as %s", util.RequestID(ctx), volumeID, nodeID, aws.StringValue(attachment.Device))
+					c.instances.invalidate(nodeID)
+					return aws.StringValue(attachment.Device), nil
+				}
+			}
 			return "", fmt.Errorf("could not attach volume %q to node %q: %v", volumeID, nodeID, err)
 		}
-		glog.V(2).Infof("AttachVolume volume=%q instance=%q request returned %v", volumeID, nodeID, resp)
+		klog.V(2).Infof("[%s] AttachVolume volume=%q instance=%q request returned %v", util.RequestID(ctx), volumeID, nodeID, resp)
+		c.instances.invalidate(nodeID)
 	}
 
-	// TODO: wait attaching
-	// TODO: this is the only situation where this method returns and the device is not released
-	//attachment, err := disk.waitForAttachmentStatus("attached")
-	//if err != nil {
-	// device.Taint()
-	//if err == wait.ErrWaitTimeout {
-	//c.applyUnSchedulableTaint(nodeName, "Volume stuck in attaching state - node needs reboot to fix impaired state.")
-	//}
-	//return "", err
-	//}
-
-	// Manually release the device so it can be picked again.
+	// This is the only situation where we taint the device
+	attachment, err := c.waitForAttachmentState(ctx, volumeID, "attached")
+	if err != nil {
+		device.Taint()
+		if err == errAttachmentStateTimeout {
+			klog.Warningf("[%s] Volume %q still attaching to node %q as %s after %v", util.RequestID(ctx), volumeID, nodeID, device.Path, c.attachmentTimeout)
+			return "", &AttachmentTimeoutError{VolumeID: volumeID, InstanceID: nodeID, Device: device.Path}
+		}
+		return "", fmt.Errorf("could not wait for volume %q to be attached: %v", volumeID, err)
+	}
 
 	// Double check the attachment to be 100% sure we attached the correct volume at the correct mountpoint
 	// It could happen otherwise that we see the volume attached from a previous/separate AttachVolume call,
 	// which could theoretically be against a different device (or even instance).
-	//if attachment == nil {
-	//// Impossible?
-	//return "", fmt.Errorf("unexpected state: attachment nil after attached %q to %q", diskName, nodeName)
-	//}
-	//if ec2Device != aws.StringValue(attachment.Device) {
-	//return "", fmt.Errorf("disk attachment of %q to %q failed: requested device %q but found %q", diskName, nodeName, ec2Device, aws.StringValue(attachment.Device))
-	//}
-	//if awsInstance.awsID != aws.StringValue(attachment.InstanceId) {
-	//return "", fmt.Errorf("disk attachment of %q to %q failed: requested instance %q but found %q", diskName, nodeName, awsInstance.awsID, aws.StringValue(attachment.InstanceId))
-	//}
-	//return hostDevice, nil
+	if attachment == nil {
+		// Impossible?
+		return "", fmt.Errorf("unexpected state: attachment nil after attached %q to %q", volumeID, nodeID)
+	}
+	if device.Path != aws.StringValue(attachment.Device) {
+		return "", fmt.Errorf("disk attachment of %q to %q failed: requested device %q but found %q", volumeID, nodeID, device.Path, aws.StringValue(attachment.Device))
+	}
+	if nodeID != aws.StringValue(attachment.InstanceId) {
+		return "", fmt.Errorf("disk attachment of %q to %q failed: requested instance %q but found %q", volumeID, nodeID, nodeID, aws.StringValue(attachment.InstanceId))
+	}
 
 	return device.Path, nil
 }
 
-func (c *cloud) DetachDisk(volumeID, nodeID string) error {
-	instance, err := c.getInstance(nodeID)
+func (c *cloud) DetachDisk(ctx context.Context, volumeID, nodeID string) error {
+	instance, err := c.getInstance(ctx, nodeID)
 	if err != nil {
 		return fmt.Errorf("could not get instance %q", nodeID)
 	}
 
-	// TODO: check if attached
 	device, err := c.dm.GetBlockDevice(instance, volumeID)
 	if err != nil {
 		return err
 	}
 	defer device.Release(true)
 
-	if !device.IsAlreadyAssigned {
-		// There is no device attached for this volume in this node
-		glog.Warningf("DetachDisk called on non-attached volume: %s", volumeID)
+	state, err := c.getAttachmentState(ctx, volumeID, nodeID)
+	if err != nil {
+		if err == ErrVolumeNotFound {
+			// A volume that doesn't exist can't be attached anywhere
+			klog.Warningf("DetachDisk called on non-existent volume: %s", volumeID)
+			return nil
+		}
+		return err
 	}
 
-	request := &ec2.DetachVolumeInput{
-		InstanceId: aws.String(nodeID),
-		VolumeId:   aws.String(volumeID),
+	switch state {
+	case "", "detached":
+		// There is nothing to detach, so there is no point in calling DetachVolume
+		klog.Warningf("DetachDisk called on non-attached volume: %s", volumeID)
+		return nil
+	case "detaching":
+		// Calling DetachVolume again would fail with IncorrectState
+		klog.V(4).Infof("[%s] Volume %s is already being detached from node %s", util.RequestID(ctx), volumeID, nodeID)
+	default:
+		request := &ec2.DetachVolumeInput{
+			InstanceId: aws.String(nodeID),
+			VolumeId:   aws.String(volumeID),
+		}
+
+		if _, err := c.ec2.DetachVolumeWithContext(ctx, request); err != nil {
+			return fmt.Errorf("could not detach volume %q from node %q: %v", volumeID, nodeID, err)
+		}
 	}
 
-	_, err = c.ec2.DetachVolume(request)
-	if err != nil {
-		return fmt.Errorf("could not detach volume %q from node %q: %v", volumeID, nodeID, err)
+	// Wait for the detachment to complete, otherwise a subsequent attach
+	// of this volume to another node might fail
+	if _, err := c.waitForAttachmentState(ctx, volumeID, "detached"); err != nil {
+		return fmt.Errorf("could not wait for volume %q to be detached: %v", volumeID, err)
 	}
+	c.instances.invalidate(nodeID)
 
 	return nil
 }
 
-func (c *cloud) GetDisk(name string, capacityBytes int64) (*Disk, error) {
-	volume, err := c.getVolume(name)
+func (c *cloud) GetDiskByNameAndSize(ctx context.Context, name string, capacityBytes int64) (*Disk, error) {
+	request := &ec2.DescribeVolumesInput{
+		MaxResults: aws.Int64(c.volumesPageSize),
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag:" + VolumeNameTagKey),
+				Values: []*string{aws.String(name)},
+			},
+		},
+	}
+	if len(c.clusterID) != 0 {
+		request.Filters = append(request.Filters, &ec2.Filter{
+			Name:   aws.String("tag:" + ClusterTagKey(c.clusterID)),
+			Values: []*string{aws.String(ClusterTagOwned)},
+		})
+	}
+
+	volumes, err := c.listVolumes(ctx, request)
 	if err != nil {
 		return nil, err
 	}
 
-	volSizeBytes := aws.Int64Value(volume.Size)
-	if volSizeBytes != util.BytesToGiB(capacityBytes) {
+	// Volumes being deleted or that failed to be created keep their tags for a
+	// while, but they can't be used and must not be mistaken for the requested one
+	var activeVolumes []*ec2.Volume
+	for _, v := range volumes {
+		switch aws.StringValue(v.State) {
+		case ec2.VolumeStateCreating, ec2.VolumeStateAvailable, ec2.VolumeStateInUse:
+			activeVolumes = append(activeVolumes, v)
+		default:
+			klog.V(4).Infof("[%s] Ignoring volume %q named %q in state %q", util.RequestID(ctx), aws.StringValue(v.VolumeId), name, aws.StringValue(v.State))
+		}
+	}
+	if l := len(activeVolumes); l > 1 {
+		return nil, ErrMultiDisks
+	} else if l < 1 {
+		return nil, ErrVolumeNotFound
+	}
+	volume := activeVolumes[0]
+
+	// An existing volume that is larger than requested still satisfies the request
+	volSizeGiB := aws.Int64Value(volume.Size)
+	if volSizeGiB < util.RoundUpGiB(capacityBytes) {
 		return nil, ErrDiskExistsDiffSize
 	}
 
 	return &Disk{
-		VolumeID:    aws.StringValue(volume.VolumeId),
-		CapacityGiB: volSizeBytes,
+		VolumeID:         aws.StringValue(volume.VolumeId),
+		CapacityGiB:      volSizeGiB,
+		AvailabilityZone: aws.StringValue(volume.AvailabilityZone),
+		VolumeType:       aws.StringValue(volume.VolumeType),
+		SnapshotID:       aws.StringValue(volume.SnapshotId),
 	}, nil
 }
 
-func (c *cloud) getVolume(name string) (*ec2.Volume, error) {
+func (c *cloud) GetDiskByID(ctx context.Context, volumeID string) (*Disk, error) {
+	request := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}
+
+	volume, err := c.getVolume(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ec2VolumeResponseToStruct(volume), nil
+}
+
+// ResizeDisk grows the volume to at least newSizeBytes, rounded up to whole GiB,
+// and returns its new size in GiB once the new size can be used. Volumes can't
+// shrink, so nothing is done if the volume is already large enough.
+func (c *cloud) ResizeDisk(ctx context.Context, volumeID string, newSizeBytes int64) (int64, error) {
+	request := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}
+	volume, err := c.getVolume(ctx, request)
+	if err != nil {
+		return 0, err
+	}
+
+	newSizeGiB := util.RoundUpGiB(newSizeBytes)
+	oldSizeGiB := aws.Int64Value(volume.Size)
+	if oldSizeGiB >= newSizeGiB {
+		klog.V(4).Infof("[%s] Volume %q is already %d GiB, no need to resize it to %d GiB", util.RequestID(ctx), volumeID, oldSizeGiB, newSizeGiB)
+		return oldSizeGiB, nil
+	}
+
+	// EC2 rejects a modification while another one is in progress, or during the 6
+	// hours after the last one started, so check for them to fail with a clear error
+	modification, err := c.getLatestVolumeModification(ctx, volumeID)
+	if err != nil {
+		return 0, err
+	}
+	if modification != nil {
+		state := aws.StringValue(modification.ModificationState)
+		targetSizeGiB := aws.Int64Value(modification.TargetSize)
+		switch {
+		case state == ec2.VolumeModificationStateModifying && targetSizeGiB >= newSizeGiB:
+			klog.V(4).Infof("[%s] Volume %q is already being resized to %d GiB, waiting for it", util.RequestID(ctx), volumeID, targetSizeGiB)
+			if err := c.waitForVolumeModification(ctx, volumeID); err != nil {
+				return 0, err
+			}
+			return targetSizeGiB, nil
+		case state == ec2.VolumeModificationStateModifying:
+			return 0, ErrVolumeModificationInProgress
+		case state != ec2.VolumeModificationStateFailed && time.Since(aws.TimeValue(modification.StartTime)) < volumeModificationCooldown:
+			klog.V(4).Infof("[%s] Volume %q was last modified at %v and can't be resized before %v", util.RequestID(ctx), volumeID, aws.TimeValue(modification.StartTime), aws.TimeValue(modification.StartTime).Add(volumeModificationCooldown))
+			return 0, ErrVolumeModificationRateExceeded
+		}
+	}
+
+	modifyRequest := &ec2.ModifyVolumeInput{
+		VolumeId: aws.String(volumeID),
+		Size:     aws.Int64(newSizeGiB),
+	}
+	if _, err := c.ec2.ModifyVolumeWithContext(ctx, modifyRequest); err != nil {
+		return 0, fmt.Errorf("could not modify volume %q: %v", volumeID, err)
+	}
+
+	if err := c.waitForVolumeModification(ctx, volumeID); err != nil {
+		return 0, err
+	}
+	return newSizeGiB, nil
+}
+
+// getLatestVolumeModification returns the modification of the volume that started
+// last, or nil if the volume was never modified.
+func (c *cloud) getLatestVolumeModification(ctx context.Context, volumeID string) (*ec2.VolumeModification, error) {
+	request := &ec2.DescribeVolumesModificationsInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}
+	response, err := c.ec2.DescribeVolumesModificationsWithContext(ctx, request)
+	if err != nil {
+		if isAWSErrorVolumeModificationNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not describe modifications of volume %q: %v", volumeID, err)
+	}
+
+	var latest *ec2.VolumeModification
+	for _, modification := range response.VolumesModifications {
+		if latest == nil || aws.TimeValue(modification.StartTime).After(aws.TimeValue(latest.StartTime)) {
+			latest = modification
+		}
+	}
+	return latest, nil
+}
+
+// waitForVolumeModification polls until the modification of the volume is
+// optimizing or completed, i.e. its new size can be used, ctx is done or the
+// modification timeout expires. A failed modification is returned as an error.
+func (c *cloud) waitForVolumeModification(ctx context.Context, volumeID string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.modificationTimeout)
+	defer cancel()
+
+	verifyModificationFunc := func() (bool, error) {
+		// The modifications of the volume are described in no particular order,
+		// the one just requested is the latest
+		modification, err := c.getLatestVolumeModification(ctx, volumeID)
+		if err != nil {
+			return false, err
+		}
+		if modification == nil {
+			return false, fmt.Errorf("no modification of volume %q found", volumeID)
+		}
+
+		switch aws.StringValue(modification.ModificationState) {
+		case ec2.VolumeModificationStateOptimizing, ec2.VolumeModificationStateCompleted:
+			return true, nil
+		case ec2.VolumeModificationStateFailed:
+			return false, fmt.Errorf("modification of volume %q failed: %s", volumeID, aws.StringValue(modification.StatusMessage))
+		default:
+			return false, nil
+		}
+	}
+
+	err := wait.PollImmediateUntil(c.pollInterval, verifyModificationFunc, ctx.Done())
+	if err == wait.ErrWaitTimeout && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("could not wait for volume %q to be modified: %v", volumeID, err)
+	}
+	return nil
+}
+
+// GetDisksByIDs describes the volumes in as few requests as possible. The
+// volumes that don't exist are left out of the returned map, keyed by ID.
+func (c *cloud) GetDisksByIDs(ctx context.Context, volumeIDs []string) (map[string]*Disk, error) {
+	disks := make(map[string]*Disk, len(volumeIDs))
+	for start := 0; start < len(volumeIDs); start += volumeIDsPerRequest {
+		end := start + volumeIDsPerRequest
+		if end > len(volumeIDs) {
+			end = len(volumeIDs)
+		}
+
+		// Unlike VolumeIds, the filter doesn't fail the whole request when
+		// one of the volumes doesn't exist
+		request := &ec2.DescribeVolumesInput{
+			MaxResults: aws.Int64(c.volumesPageSize),
+			Filters: []*ec2.Filter{
+				&ec2.Filter{
+					Name:   aws.String("volume-id"),
+					Values: aws.StringSlice(volumeIDs[start:end]),
+				},
+			},
+		}
+
+		volumes, err := c.listVolumes(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		for _, volume := range volumes {
+			disks[aws.StringValue(volume.VolumeId)] = c.ec2VolumeResponseToStruct(volume)
+		}
+	}
+	return disks, nil
+}
+
+// ListDisks returns a page of at most maxEntries volumes created by the driver,
+// sorted by ID, starting at the startingToken, and the token of the next page.
+func (c *cloud) ListDisks(ctx context.Context, maxEntries int64, startingToken string) ([]*Disk, string, error) {
+	request := &ec2.DescribeVolumesInput{
+		MaxResults: aws.Int64(c.volumesPageSize),
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(VolumeNameTagKey)},
+			},
+		},
+	}
+
+	volumes, err := c.listVolumes(ctx, request)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var disks []*Disk
+	for _, volume := range volumes {
+		disks = append(disks, c.ec2VolumeResponseToStruct(volume))
+	}
+	sort.Slice(disks, func(i, j int) bool {
+		return disks[i].VolumeID < disks[j].VolumeID
+	})
+
+	start, end, nextToken, err := paginate(int64(len(disks)), maxEntries, startingToken)
+	if err != nil {
+		return nil, "", err
+	}
+	return disks[start:end], nextToken, nil
+}
+
+func (c *cloud) ec2VolumeResponseToStruct(volume *ec2.Volume) *Disk {
+	disk := &Disk{
+		VolumeID:         aws.StringValue(volume.VolumeId),
+		CapacityGiB:      aws.Int64Value(volume.Size),
+		AvailabilityZone: aws.StringValue(volume.AvailabilityZone),
+		VolumeType:       aws.StringValue(volume.VolumeType),
+		SnapshotID:       aws.StringValue(volume.SnapshotId),
+	}
+	for _, a := range volume.Attachments {
+		if aws.StringValue(a.State) != "detached" {
+			disk.AttachedNodeIDs = append(disk.AttachedNodeIDs, aws.StringValue(a.InstanceId))
+		}
+	}
+	return disk
+}
+
+func (c *cloud) getVolume(ctx context.Context, request *ec2.DescribeVolumesInput) (*ec2.Volume, error) {
+	volumes, err := c.listVolumes(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if l := len(volumes); l > 1 {
+		return nil, ErrMultiDisks
+	} else if l < 1 {
+		return nil, ErrVolumeNotFound
+	}
+
+	return volumes[0], nil
+}
+
+func (c *cloud) listVolumes(ctx context.Context, request *ec2.DescribeVolumesInput) ([]*ec2.Volume, error) {
 	var volumes []*ec2.Volume
 	var nextToken *string
 
-	request := &ec2.DescribeVolumesInput{
+	for {
+		response, err := c.ec2.DescribeVolumesWithContext(ctx, request)
+		if err != nil {
+			if isAWSErrorVolumeNotFound(err) {
+				return nil, ErrVolumeNotFound
+			}
+			return nil, err
+		}
+		volumes = append(volumes, response.Volumes...)
+		nextToken = response.NextToken
+		if aws.StringValue(nextToken) == "" {
+			break
+		}
+		request.NextToken = nextToken
+	}
+
+	return volumes, nil
+}
+
+func (c *cloud) CreateSnapshot(ctx context.Context, volumeID string, snapshotOptions *SnapshotOptions) (*Snapshot, error) {
+	var tags []*ec2.Tag
+	for key, value := range snapshotOptions.Tags {
+		tags = append(tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	tagSpec := ec2.TagSpecification{
+		ResourceType: aws.String("snapshot"),
+		Tags:         tags,
+	}
+
+	request := &ec2.CreateSnapshotInput{
+		VolumeId:          aws.String(volumeID),
+		Description:       aws.String("Created by AWS EBS CSI driver for volume " + volumeID),
+		TagSpecifications: []*ec2.TagSpecification{&tagSpec},
+	}
+
+	response, err := c.ec2.CreateSnapshotWithContext(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("could not create snapshot of volume %q in EC2: %v", volumeID, err)
+	}
+	if response == nil {
+		return nil, fmt.Errorf("nil response from CreateSnapshot")
+	}
+
+	snapshot := c.ec2SnapshotResponseToStruct(response)
+	if snapshotOptions.ReadyTimeout > 0 && !snapshot.ReadyToUse {
+		ready, err := c.waitForSnapshotReady(ctx, snapshot.SnapshotID, snapshotOptions.ReadyTimeout)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.ReadyToUse = ready
+	}
+
+	return snapshot, nil
+}
+
+func (c *cloud) DeleteSnapshot(ctx context.Context, snapshotID string) (bool, error) {
+	request := &ec2.DeleteSnapshotInput{SnapshotId: aws.String(snapshotID)}
+	if _, err := c.ec2.DeleteSnapshotWithContext(ctx, request); err != nil {
+		if isAWSErrorSnapshotNotFound(err) {
+			return false, ErrSnapshotNotFound
+		}
+		return false, fmt.Errorf("DeleteSnapshot could not delete snapshot: %v", err)
+	}
+	return true, nil
+}
+
+func (c *cloud) GetSnapshotByName(ctx context.Context, name string) (*Snapshot, error) {
+	request := &ec2.DescribeSnapshotsInput{
 		Filters: []*ec2.Filter{
 			&ec2.Filter{
-				Name:   aws.String("tag:" + VolumeNameTagKey),
+				Name:   aws.String("tag:" + SnapshotNameTagKey),
 				Values: []*string{aws.String(name)},
 			},
 		},
 	}
+
+	snapshot, err := c.getSnapshot(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ec2SnapshotResponseToStruct(snapshot), nil
+}
+
+func (c *cloud) GetSnapshotByID(ctx context.Context, snapshotID string) (*Snapshot, error) {
+	request := &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{aws.String(snapshotID)},
+	}
+
+	snapshot, err := c.getSnapshot(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ec2SnapshotResponseToStruct(snapshot), nil
+}
+
+// ListSnapshots returns up to maxEntries snapshots created by this driver, optionally
+// filtered by sourceVolumeID, starting at startingToken. The returned token can be
+// used to continue the listing, and it's empty when there are no entries left.
+func (c *cloud) ListSnapshots(ctx context.Context, maxEntries int64, startingToken string, sourceVolumeID string) ([]*Snapshot, string, error) {
+	request := &ec2.DescribeSnapshotsInput{
+		MaxResults: aws.Int64(snapshotsPageSize),
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(SnapshotNameTagKey)},
+			},
+		},
+	}
+	if len(sourceVolumeID) != 0 {
+		request.Filters = append(request.Filters, &ec2.Filter{
+			Name:   aws.String("volume-id"),
+			Values: []*string{aws.String(sourceVolumeID)},
+		})
+	}
+
+	ec2Snapshots, err := c.listSnapshots(ctx, request)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var snapshots []*Snapshot
+	for _, ec2Snapshot := range ec2Snapshots {
+		snapshots = append(snapshots, c.ec2SnapshotResponseToStruct(ec2Snapshot))
+	}
+
+	return paginateSnapshots(snapshots, maxEntries, startingToken)
+}
+
+func (c *cloud) getSnapshot(ctx context.Context, request *ec2.DescribeSnapshotsInput) (*ec2.Snapshot, error) {
+	snapshots, err := c.listSnapshots(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if l := len(snapshots); l > 1 {
+		return nil, ErrMultiSnapshots
+	} else if l < 1 {
+		return nil, ErrSnapshotNotFound
+	}
+
+	return snapshots[0], nil
+}
+
+func (c *cloud) listSnapshots(ctx context.Context, request *ec2.DescribeSnapshotsInput) ([]*ec2.Snapshot, error) {
+	var snapshots []*ec2.Snapshot
+	var nextToken *string
+
 	for {
-		response, err := c.ec2.DescribeVolumes(request)
+		response, err := c.ec2.DescribeSnapshotsWithContext(ctx, request)
 		if err != nil {
+			if isAWSErrorSnapshotNotFound(err) {
+				return nil, ErrSnapshotNotFound
+			}
 			return nil, err
 		}
-		for _, volume := range response.Volumes {
-			volumes = append(volumes, volume)
-		}
+		snapshots = append(snapshots, response.Snapshots...)
 		nextToken = response.NextToken
 		if aws.StringValue(nextToken) == "" {
 			break
@@ -356,16 +1414,213 @@ func (c *cloud) getVolume(name string) (*ec2.Volume, error) {
 		request.NextToken = nextToken
 	}
 
-	if l := len(volumes); l > 1 {
-		return nil, ErrMultiDisks
-	} else if l < 1 {
-		return nil, ErrVolumeNotFound
+	return snapshots, nil
+}
+
+// paginateSnapshots sorts snapshots by ID and returns up to maxEntries of them,
+// starting at the offset encoded in startingToken, along with the token for the next page.
+func paginateSnapshots(snapshots []*Snapshot, maxEntries int64, startingToken string) ([]*Snapshot, string, error) {
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].SnapshotID < snapshots[j].SnapshotID
+	})
+
+	start, end, nextToken, err := paginate(int64(len(snapshots)), maxEntries, startingToken)
+	if err != nil {
+		return nil, "", err
+	}
+	return snapshots[start:end], nextToken, nil
+}
+
+// paginate returns the bounds of the page of at most maxEntries entries, out
+// of total, that starts at the startingToken, and the token of the next page.
+// All the entries are returned if maxEntries is zero.
+func paginate(total, maxEntries int64, startingToken string) (int64, int64, string, error) {
+	var start int64
+	if len(startingToken) != 0 {
+		var err error
+		start, err = strconv.ParseInt(startingToken, 10, 64)
+		if err != nil || start < 0 || start > total {
+			return 0, 0, "", ErrInvalidStartingToken
+		}
 	}
 
-	return volumes[0], nil
+	end := total
+	if maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+	}
+
+	var nextToken string
+	if end < total {
+		nextToken = strconv.FormatInt(end, 10)
+	}
+
+	return start, end, nextToken, nil
+}
+
+func (c *cloud) ec2SnapshotResponseToStruct(ec2Snapshot *ec2.Snapshot) *Snapshot {
+	snapshot := &Snapshot{
+		SnapshotID:     aws.StringValue(ec2Snapshot.SnapshotId),
+		SourceVolumeID: aws.StringValue(ec2Snapshot.VolumeId),
+		Size:           aws.Int64Value(ec2Snapshot.VolumeSize),
+		CreationTime:   aws.TimeValue(ec2Snapshot.StartTime),
+	}
+	if aws.StringValue(ec2Snapshot.State) == ec2.SnapshotStateCompleted {
+		snapshot.ReadyToUse = true
+	}
+	return snapshot
+}
+
+// waitForSnapshotReady polls until the snapshot is completed or the timeout expires.
+// It returns false, without an error, if the snapshot is still pending after the timeout.
+func (c *cloud) waitForSnapshotReady(ctx context.Context, snapshotID string, timeout time.Duration) (bool, error) {
+	var ready bool
+	verifySnapshotFunc := func() (bool, error) {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		default:
+		}
+
+		request := &ec2.DescribeSnapshotsInput{
+			SnapshotIds: []*string{aws.String(snapshotID)},
+		}
+
+		snapshot, err := c.getSnapshot(ctx, request)
+		if err != nil {
+			return false, err
+		}
+
+		switch state := aws.StringValue(snapshot.State); state {
+		case ec2.SnapshotStateCompleted:
+			ready = true
+			return true, nil
+		case ec2.SnapshotStateError:
+			return false, fmt.Errorf("snapshot %q failed: %s", snapshotID, aws.StringValue(snapshot.StateMessage))
+		default:
+			return false, nil
+		}
+	}
+
+	err := wait.PollImmediate(c.pollInterval, timeout, verifySnapshotFunc)
+	if err != nil && err != wait.ErrWaitTimeout {
+		return false, fmt.Errorf("could not wait for snapshot %q to be ready: %v", snapshotID, err)
+	}
+	if !ready {
+		klog.V(4).Infof("Snapshot %q is not ready after %v", snapshotID, timeout)
+	}
+
+	return ready, nil
+}
+
+// getAttachmentState returns the state of the attachment of the volume to the
+// given node, e.g. "attached" or "detaching", or "" if it isn't attached to it.
+func (c *cloud) getAttachmentState(ctx context.Context, volumeID, nodeID string) (string, error) {
+	request := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}
+
+	volume, err := c.getVolume(ctx, request)
+	if err != nil {
+		return "", err
+	}
+
+	for _, a := range volume.Attachments {
+		if aws.StringValue(a.InstanceId) == nodeID {
+			return aws.StringValue(a.State), nil
+		}
+	}
+	return "", nil
+}
+
+// getAttachments returns the attachment of the volume to nodeID, if any, and the
+// instance other than nodeID the volume is attached to, or an empty string if
+// there is none.
+func (c *cloud) getAttachments(ctx context.Context, volumeID, nodeID string) (*ec2.VolumeAttachment, string, error) {
+	request := &ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeID)},
+	}
+
+	volume, err := c.getVolume(ctx, request)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var attachment *ec2.VolumeAttachment
+	for _, a := range volume.Attachments {
+		instanceID := aws.StringValue(a.InstanceId)
+		if instanceID == nodeID {
+			attachment = a
+		} else if aws.StringValue(a.State) != "detached" {
+			return attachment, instanceID, nil
+		}
+	}
+	return attachment, "", nil
+}
+
+// waitForAttachmentState polls until the attachment status is the expected value,
+// ctx is done or the attachment timeout expires, in which case errAttachmentStateTimeout
+// is returned. On success, it returns the last attachment state.
+func (c *cloud) waitForAttachmentState(ctx context.Context, volumeID, state string) (*ec2.VolumeAttachment, error) {
+	// Most attach/detach operations on AWS finish within 1-4 seconds, so poll
+	// at a fixed interval rather than backing off, and stop polling as soon as
+	// the caller gives up
+	ctx, cancel := context.WithTimeout(ctx, c.attachmentTimeout)
+	defer cancel()
+
+	var attachment *ec2.VolumeAttachment
+	verifyVolumeFunc := func() (bool, error) {
+		request := &ec2.DescribeVolumesInput{
+			VolumeIds: []*string{aws.String(volumeID)},
+		}
+
+		volume, err := c.getVolume(ctx, request)
+		if err != nil {
+			if err == ErrVolumeNotFound && state == "detached" {
+				return true, nil
+			}
+			return false, err
+		}
+
+		if len(volume.Attachments) == 0 {
+			if state == "detached" {
+				return true, nil
+			}
+		}
+
+		for _, a := range volume.Attachments {
+			if a.State == nil {
+				klog.Warningf("Ignoring nil attachment state for volume %q: %v", volumeID, a)
+				continue
+			}
+			if aws.StringValue(a.State) == state {
+				attachment = a
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	err := wait.PollImmediateUntil(c.pollInterval, verifyVolumeFunc, ctx.Done())
+	if err == wait.ErrWaitTimeout && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err == context.DeadlineExceeded {
+		return nil, errAttachmentStateTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return attachment, nil
 }
 
-func (c *cloud) getInstance(nodeID string) (*ec2.Instance, error) {
+// getInstance describes the instance, unless it was described recently.
+func (c *cloud) getInstance(ctx context.Context, nodeID string) (*ec2.Instance, error) {
+	if instance, ok := c.instances.get(nodeID); ok {
+		return instance, nil
+	}
+
+	// MaxResults can't be set along with InstanceIds, which return a single page anyway
 	results := []*ec2.Instance{}
 	request := &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{&nodeID},
@@ -373,7 +1628,7 @@ func (c *cloud) getInstance(nodeID string) (*ec2.Instance, error) {
 
 	var nextToken *string
 	for {
-		response, err := c.ec2.DescribeInstances(request)
+		response, err := c.ec2.DescribeInstancesWithContext(ctx, request)
 		if err != nil {
 			return nil, fmt.Errorf("error listing AWS instances: %q", err)
 		}
@@ -394,5 +1649,125 @@ func (c *cloud) getInstance(nodeID string) (*ec2.Instance, error) {
 		return nil, fmt.Errorf("expected 1 instance with ID %q, got %d", nodeID, len(results))
 	}
 
+	c.instances.set(nodeID, results[0])
 	return results[0], nil
 }
+
+// isAWSErrorVolumeNotFound returns a boolean indicating whether the
+// given error is an AWS InvalidVolume.NotFound error.
+func isAWSErrorVolumeNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		if awsErr.Code() == "InvalidVolume.NotFound" {
+			return true
+		}
+	}
+	return false
+}
+
+// isAWSErrorVolumeModificationNotFound returns a boolean indicating whether the
+// given error is an AWS InvalidVolumeModification.NotFound error, returned for
+// volumes that were never modified.
+func isAWSErrorVolumeModificationNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		if awsErr.Code() == "InvalidVolumeModification.NotFound" {
+			return true
+		}
+	}
+	return false
+}
+
+// isAWSErrorAttachmentLimitExceeded returns a boolean indicating whether the given
+// error is an AWS error reporting that the instance can't attach more volumes.
+func isAWSErrorAttachmentLimitExceeded(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "AttachmentLimitExceeded", "VolumeLimitExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+// isAWSErrorInsufficientVolumeCapacity returns a boolean indicating whether the
+// given error is an AWS error meaning the volume can't be created in the zone.
+func isAWSErrorInsufficientVolumeCapacity(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "InsufficientVolumeCapacity", "Unsupported":
+			return true
+		}
+	}
+	return false
+}
+
+// isAWSErrorVolumeInUse returns a boolean indicating whether the
+// given error is an AWS VolumeInUse error.
+func isAWSErrorVolumeInUse(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		if awsErr.Code() == "VolumeInUse" {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateTags checks that the tags are within the limits imposed by AWS.
+func ValidateTags(tags map[string]string) error {
+	if len(tags) > MaxTagsPerResource {
+		return fmt.Errorf("too many tags, got %d but at most %d are allowed", len(tags), MaxTagsPerResource)
+	}
+	for key, value := range tags {
+		if len(key) == 0 {
+			return fmt.Errorf("tag key can't be empty")
+		}
+		if len(key) > MaxTagKeyLength {
+			return fmt.Errorf("tag key %q is longer than %d characters", key, MaxTagKeyLength)
+		}
+		if len(value) > MaxTagValueLength {
+			return fmt.Errorf("value of tag %q is longer than %d characters", key, MaxTagValueLength)
+		}
+		if strings.HasPrefix(strings.ToLower(key), reservedTagKeyPrefix) {
+			return fmt.Errorf("tag key %q uses the reserved prefix %q", key, reservedTagKeyPrefix)
+		}
+	}
+	return nil
+}
+
+// ClusterTagKey returns the key of the tag marking the volumes owned by the cluster.
+func ClusterTagKey(clusterID string) string {
+	return clusterTagKeyPrefix + clusterID
+}
+
+// IsValidVolumeType returns whether volumes of the given type can be created.
+func IsValidVolumeType(volumeType string) bool {
+	switch volumeType {
+	case VolumeTypeGP2, VolumeTypeIO1, VolumeTypeSC1, VolumeTypeST1:
+		return true
+	default:
+		return false
+	}
+}
+
+// MinVolumeSizeGiB returns the smallest size, in GiB, of a volume of the given
+// type. An empty type refers to DefaultVolumeType.
+func MinVolumeSizeGiB(volumeType string) int64 {
+	switch volumeType {
+	case VolumeTypeIO1:
+		return MinVolumeSizeGiBIO1
+	case VolumeTypeSC1, VolumeTypeST1:
+		return MinVolumeSizeGiBHDD
+	default:
+		return 1
+	}
+}
+
+// isAWSErrorSnapshotNotFound returns a boolean indicating whether the
+// given error is an AWS InvalidSnapshot.NotFound error.
+func isAWSErrorSnapshotNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		if awsErr.Code() == "InvalidSnapshot.NotFound" {
+			return true
+		}
+	}
+	return false
+}
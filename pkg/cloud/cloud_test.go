@@ -17,17 +17,22 @@ limitations under the License.
 package cloud
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	dm "github.com/bertinatto/ebs-csi-driver/pkg/cloud/devicemanager"
 	"github.com/bertinatto/ebs-csi-driver/pkg/cloud/mocks"
 	"github.com/bertinatto/ebs-csi-driver/pkg/util"
 	"github.com/golang/mock/gomock"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 func TestCreateDisk(t *testing.T) {
@@ -37,6 +42,10 @@ func TestCreateDisk(t *testing.T) {
 		diskOptions *DiskOptions
 		expDisk     *Disk
 		expErr      error
+		// expIOPS is checked against the IOPS requested, if set
+		expIOPS int64
+		// expInvalid is set if the request is rejected without calling CreateVolume
+		expInvalid bool
 	}{
 		{
 			name:       "success: normal",
@@ -46,8 +55,40 @@ func TestCreateDisk(t *testing.T) {
 				Tags:          map[string]string{VolumeNameTagKey: "vol-test"},
 			},
 			expDisk: &Disk{
-				VolumeID:    "vol-test",
-				CapacityGiB: 1,
+				VolumeID:         "vol-test",
+				CapacityGiB:      1,
+				AvailabilityZone: "test-az",
+			},
+			expErr: nil,
+		},
+		{
+			name:       "success: requested availability zone",
+			volumeName: "vol-test-name",
+			diskOptions: &DiskOptions{
+				CapacityBytes:    util.GiBToBytes(1),
+				Tags:             map[string]string{VolumeNameTagKey: "vol-test"},
+				AvailabilityZone: "other-az",
+			},
+			expDisk: &Disk{
+				VolumeID:         "vol-test",
+				CapacityGiB:      1,
+				AvailabilityZone: "other-az",
+			},
+			expErr: nil,
+		},
+		{
+			name:       "success: encrypted with KMS key",
+			volumeName: "vol-test-name",
+			diskOptions: &DiskOptions{
+				CapacityBytes: util.GiBToBytes(1),
+				Tags:          map[string]string{VolumeNameTagKey: "vol-test"},
+				Encrypted:     true,
+				KmsKeyID:      "arn:aws:kms:us-east-1:000000000000:key/test",
+			},
+			expDisk: &Disk{
+				VolumeID:         "vol-test",
+				CapacityGiB:      1,
+				AvailabilityZone: "test-az",
 			},
 			expErr: nil,
 		},
@@ -60,6 +101,104 @@ func TestCreateDisk(t *testing.T) {
 			},
 			expErr: fmt.Errorf("CreateVolume generic error"),
 		},
+		{
+			name:       "success: st1 at the minimum size",
+			volumeName: "vol-test-name",
+			diskOptions: &DiskOptions{
+				CapacityBytes: util.GiBToBytes(MinVolumeSizeGiBHDD),
+				Tags:          map[string]string{VolumeNameTagKey: "vol-test"},
+				VolumeType:    VolumeTypeST1,
+			},
+			expDisk: &Disk{
+				VolumeID:         "vol-test",
+				CapacityGiB:      MinVolumeSizeGiBHDD,
+				AvailabilityZone: "test-az",
+			},
+		},
+		{
+			name:       "fail: sc1 below the minimum size",
+			volumeName: "vol-test-name",
+			diskOptions: &DiskOptions{
+				CapacityBytes: util.GiBToBytes(MinVolumeSizeGiBHDD - 1),
+				Tags:          map[string]string{VolumeNameTagKey: "vol-test"},
+				VolumeType:    VolumeTypeSC1,
+			},
+			expErr:     fmt.Errorf("volume size below the minimum"),
+			expInvalid: true,
+		},
+		{
+			name:       "fail: io1 below the minimum size",
+			volumeName: "vol-test-name",
+			diskOptions: &DiskOptions{
+				CapacityBytes: util.GiBToBytes(1),
+				Tags:          map[string]string{VolumeNameTagKey: "vol-test"},
+				VolumeType:    VolumeTypeIO1,
+				IOPSPerGB:     10,
+			},
+			expErr:     fmt.Errorf("volume size below the minimum"),
+			expInvalid: true,
+		},
+		{
+			name:       "success: io1 with IOPS",
+			volumeName: "vol-test-name",
+			diskOptions: &DiskOptions{
+				CapacityBytes: util.GiBToBytes(10),
+				Tags:          map[string]string{VolumeNameTagKey: "vol-test"},
+				VolumeType:    VolumeTypeIO1,
+				IOPS:          300,
+			},
+			expDisk: &Disk{
+				VolumeID:         "vol-test",
+				CapacityGiB:      10,
+				AvailabilityZone: "test-az",
+			},
+			expIOPS: 300,
+		},
+		{
+			name:       "success: io1 with IOPS above the maximum",
+			volumeName: "vol-test-name",
+			diskOptions: &DiskOptions{
+				CapacityBytes: util.GiBToBytes(500),
+				Tags:          map[string]string{VolumeNameTagKey: "vol-test"},
+				VolumeType:    VolumeTypeIO1,
+				IOPS:          MaxTotalIOPS + 1,
+			},
+			expDisk: &Disk{
+				VolumeID:         "vol-test",
+				CapacityGiB:      500,
+				AvailabilityZone: "test-az",
+			},
+			expIOPS: MaxTotalIOPS,
+		},
+		{
+			name:       "success: io1 with IOPS per GiB",
+			volumeName: "vol-test-name",
+			diskOptions: &DiskOptions{
+				CapacityBytes: util.GiBToBytes(10),
+				Tags:          map[string]string{VolumeNameTagKey: "vol-test"},
+				VolumeType:    VolumeTypeIO1,
+				IOPSPerGB:     20,
+			},
+			expDisk: &Disk{
+				VolumeID:         "vol-test",
+				CapacityGiB:      10,
+				AvailabilityZone: "test-az",
+			},
+			expIOPS: 200,
+		},
+		{
+			name:       "fail: both IOPS and IOPS per GiB",
+			volumeName: "vol-test-name",
+			diskOptions: &DiskOptions{
+				CapacityBytes: util.GiBToBytes(10),
+				Tags:          map[string]string{VolumeNameTagKey: "vol-test"},
+				VolumeType:    VolumeTypeIO1,
+				IOPS:          300,
+				IOPSPerGB:     20,
+			},
+			expErr:     fmt.Errorf("IOPS and IOPS per GiB are mutually exclusive"),
+			expInvalid: true,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -76,9 +215,21 @@ func TestCreateDisk(t *testing.T) {
 			}
 		}
 
-		mockEC2.EXPECT().CreateVolume(gomock.Any()).Return(vol, tc.expErr)
+		if !tc.expInvalid {
+			mockEC2.EXPECT().CreateVolumeWithContext(gomock.Any(), gomock.Any()).Do(func(ctx aws.Context, input *ec2.CreateVolumeInput) {
+				if aws.BoolValue(input.Encrypted) != tc.diskOptions.Encrypted {
+					t.Fatalf("CreateVolume() failed: expected encrypted %v, got %v", tc.diskOptions.Encrypted, aws.BoolValue(input.Encrypted))
+				}
+				if aws.StringValue(input.KmsKeyId) != tc.diskOptions.KmsKeyID {
+					t.Fatalf("CreateVolume() failed: expected KMS key %q, got %q", tc.diskOptions.KmsKeyID, aws.StringValue(input.KmsKeyId))
+				}
+				if tc.expIOPS != 0 && aws.Int64Value(input.Iops) != tc.expIOPS {
+					t.Fatalf("CreateVolume() failed: expected IOPS %d, got %d", tc.expIOPS, aws.Int64Value(input.Iops))
+				}
+			}).Return(vol, tc.expErr)
+		}
 
-		disk, err := c.CreateDisk(tc.volumeName, tc.diskOptions)
+		disk, err := c.CreateDisk(context.Background(), tc.volumeName, tc.diskOptions)
 		if err != nil {
 			if tc.expErr == nil {
 				t.Fatalf("CreateDisk() failed: expected no error, got: %v", err)
@@ -94,6 +245,10 @@ func TestCreateDisk(t *testing.T) {
 				if tc.expDisk.VolumeID != disk.VolumeID {
 					t.Fatalf("CreateDisk() failed: expected capacity %d, got %v", tc.expDisk.CapacityGiB, disk.CapacityGiB)
 				}
+
+				if tc.expDisk.AvailabilityZone != disk.AvailabilityZone {
+					t.Fatalf("CreateDisk() failed: expected availability zone %q, got %q", tc.expDisk.AvailabilityZone, disk.AvailabilityZone)
+				}
 			}
 		}
 
@@ -102,11 +257,16 @@ func TestCreateDisk(t *testing.T) {
 }
 
 func TestDeleteDisk(t *testing.T) {
+	defer func(backoff wait.Backoff) { deleteBackoff = backoff }(deleteBackoff)
+	deleteBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+
 	testCases := []struct {
 		name     string
 		volumeID string
-		expResp  bool
-		expErr   error
+		// inUseTimes is how many times DeleteVolume fails because the volume is in use
+		inUseTimes int
+		expResp    bool
+		expErr     error
 	}{
 		{
 			name:     "success: normal",
@@ -114,6 +274,20 @@ func TestDeleteDisk(t *testing.T) {
 			expResp:  true,
 			expErr:   nil,
 		},
+		{
+			name:       "success: volume in use until detached",
+			volumeID:   "vol-test-1234",
+			inUseTimes: 2,
+			expResp:    true,
+			expErr:     nil,
+		},
+		{
+			name:       "fail: volume still in use",
+			volumeID:   "vol-test-1234",
+			inUseTimes: 3,
+			expResp:    false,
+			expErr:     awserr.New("VolumeInUse", "", nil),
+		},
 		{
 			name:     "fail: DeleteVolume returned generic error",
 			volumeID: "vol-test-1234",
@@ -134,9 +308,17 @@ func TestDeleteDisk(t *testing.T) {
 		mockEC2 := mocks.NewMockEC2(mockCtrl)
 		c := newCloud(mockEC2)
 
-		mockEC2.EXPECT().DeleteVolume(gomock.Any()).Return(&ec2.DeleteVolumeOutput{}, tc.expErr)
+		var calls []*gomock.Call
+		if tc.inUseTimes > 0 {
+			calls = append(calls, mockEC2.EXPECT().DeleteVolumeWithContext(gomock.Any(), gomock.Any()).Return(nil, awserr.New("VolumeInUse", "", nil)).Times(tc.inUseTimes))
+		}
+		// The deletion is given up once the backoff runs out
+		if tc.inUseTimes < deleteBackoff.Steps {
+			calls = append(calls, mockEC2.EXPECT().DeleteVolumeWithContext(gomock.Any(), gomock.Any()).Return(&ec2.DeleteVolumeOutput{}, tc.expErr))
+		}
+		gomock.InOrder(calls...)
 
-		ok, err := c.DeleteDisk(tc.volumeID)
+		ok, err := c.DeleteDisk(context.Background(), tc.volumeID)
 		if err != nil && tc.expErr == nil {
 			t.Fatalf("DeleteDisk() failed: expected no error, got: %v", err)
 		}
@@ -153,24 +335,177 @@ func TestDeleteDisk(t *testing.T) {
 	}
 }
 
+func TestDeleteDiskCancelled(t *testing.T) {
+	defer func(backoff wait.Backoff) { deleteBackoff = backoff }(deleteBackoff)
+	deleteBackoff = wait.Backoff{Duration: time.Hour, Factor: 1, Steps: 3}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockEC2 := mocks.NewMockEC2(mockCtrl)
+	c := newCloud(mockEC2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mockEC2.EXPECT().DeleteVolumeWithContext(gomock.Any(), gomock.Any()).Do(func(ctx aws.Context, input *ec2.DeleteVolumeInput, opts ...request.Option) {
+		cancel()
+	}).Return(nil, awserr.New("VolumeInUse", "", nil))
+
+	// The backoff is an hour long, so the test times out unless the cancellation
+	// stops the wait
+	ok, err := c.DeleteDisk(ctx, "vol-test-1234")
+	if err != context.Canceled {
+		t.Fatalf("DeleteDisk() failed: expected error %v, got: %v", context.Canceled, err)
+	}
+	if ok {
+		t.Fatal("DeleteDisk() failed: expected the volume not to be deleted")
+	}
+}
+
+func TestDeleteDiskWaitForDeletion(t *testing.T) {
+	testCases := []struct {
+		name string
+		// states are the states the volume is described in after its deletion,
+		// it's not found once they run out
+		states []string
+		// stuck is set if the volume is described as deleting until the wait times out
+		stuck  bool
+		expErr bool
+	}{
+		{
+			name: "success: volume gone right away",
+		},
+		{
+			name:   "success: volume gone after being deleted",
+			states: []string{ec2.VolumeStateDeleting, ec2.VolumeStateDeleting},
+		},
+		{
+			name:   "success: volume described as deleted",
+			states: []string{ec2.VolumeStateDeleting, ec2.VolumeStateDeleted},
+		},
+		{
+			name:   "fail: volume still being deleted",
+			stuck:  true,
+			expErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+		m := &metadata{instanceID: "test-instance", region: "test-region", availabilityZone: "test-az"}
+		c := newEC2Cloud(m, mockEC2, &CloudOptions{WaitForDeletion: true, PollInterval: time.Millisecond, DeletionTimeout: 50 * time.Millisecond})
+
+		calls := []*gomock.Call{
+			mockEC2.EXPECT().DeleteVolumeWithContext(gomock.Any(), gomock.Any()).Return(&ec2.DeleteVolumeOutput{}, nil),
+		}
+		for _, state := range tc.states {
+			output := &ec2.DescribeVolumesOutput{
+				Volumes: []*ec2.Volume{{VolumeId: aws.String("vol-test-1234"), State: aws.String(state)}},
+			}
+			calls = append(calls, mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(output, nil))
+		}
+		if tc.stuck {
+			output := &ec2.DescribeVolumesOutput{
+				Volumes: []*ec2.Volume{{VolumeId: aws.String("vol-test-1234"), State: aws.String(ec2.VolumeStateDeleting)}},
+			}
+			calls = append(calls, mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(output, nil).MinTimes(1))
+		} else if n := len(tc.states); n == 0 || tc.states[n-1] != ec2.VolumeStateDeleted {
+			calls = append(calls, mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(nil, awserr.New("InvalidVolume.NotFound", "", nil)))
+		}
+		gomock.InOrder(calls...)
+
+		ok, err := c.DeleteDisk(context.Background(), "vol-test-1234")
+		if err != nil {
+			if !tc.expErr {
+				t.Fatalf("DeleteDisk() failed: expected no error, got: %v", err)
+			}
+			mockCtrl.Finish()
+			continue
+		}
+		if tc.expErr {
+			t.Fatal("DeleteDisk() failed: expected error, got nothing")
+		}
+		if !ok {
+			t.Fatal("DeleteDisk() failed: expected the volume to be deleted")
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
 func TestAttachDisk(t *testing.T) {
 	testCases := []struct {
-		name     string
-		volumeID string
-		nodeID   string
-		expErr   error
+		name           string
+		volumeID       string
+		nodeID         string
+		existingDevice string
+		attachedDevice string
+		attachedNodeID string
+		attachErr      error
+		inUseNodeID    string
+		// outOfBandDevice is the device the volume was attached as to the node
+		// after the instance was described
+		outOfBandDevice string
+		expErr          bool
+		expSentinel     error
 	}{
 		{
 			name:     "success: normal",
 			volumeID: "vol-test-1234",
 			nodeID:   "node-1234",
-			expErr:   nil,
+			expErr:   false,
 		},
 		{
-			name:     "fail: AttachVolume returned generic error",
-			volumeID: "vol-test-1234",
-			nodeID:   "node-1234",
-			expErr:   fmt.Errorf(""),
+			name:           "success: volume already assigned a device",
+			volumeID:       "vol-test-1234",
+			nodeID:         "node-1234",
+			existingDevice: "/dev/xvdbc",
+			expErr:         false,
+		},
+		{
+			name:            "success: volume attached out of band",
+			volumeID:        "vol-test-1234",
+			nodeID:          "node-1234",
+			attachErr:       awserr.New("VolumeInUse", "", nil),
+			outOfBandDevice: "/dev/xvdba",
+			expErr:          false,
+		},
+		{
+			name:      "fail: AttachVolume returned generic error",
+			volumeID:  "vol-test-1234",
+			nodeID:    "node-1234",
+			attachErr: fmt.Errorf(""),
+			expErr:    true,
+		},
+		{
+			name:        "fail: attachment limit exceeded",
+			volumeID:    "vol-test-1234",
+			nodeID:      "node-1234",
+			attachErr:   awserr.New("AttachmentLimitExceeded", "", nil),
+			expErr:      true,
+			expSentinel: ErrAttachmentLimitExceeded,
+		},
+		{
+			name:        "fail: volume in use by another instance",
+			volumeID:    "vol-test-1234",
+			nodeID:      "node-1234",
+			attachErr:   awserr.New("VolumeInUse", "", nil),
+			inUseNodeID: "node-5678",
+			expErr:      true,
+		},
+		{
+			name:           "fail: volume attached to a different device",
+			volumeID:       "vol-test-1234",
+			nodeID:         "node-1234",
+			attachedDevice: "/dev/xvdzz",
+			expErr:         true,
+		},
+		{
+			name:           "fail: volume attached to a different instance",
+			volumeID:       "vol-test-1234",
+			nodeID:         "node-1234",
+			attachedNodeID: "node-5678",
+			expErr:         true,
 		},
 	}
 
@@ -180,21 +515,70 @@ func TestAttachDisk(t *testing.T) {
 		mockEC2 := mocks.NewMockEC2(mockCtrl)
 		c := newCloud(mockEC2)
 
-		mockEC2.EXPECT().DescribeInstances(gomock.Any()).Return(newDescribeInstancesOutput(tc.nodeID), nil)
-		mockEC2.EXPECT().AttachVolume(gomock.Any()).Return(&ec2.VolumeAttachment{}, tc.expErr)
+		// By default, report the attachment exactly as it was requested
+		requestedDevice := tc.existingDevice
+		instances := newDescribeInstancesOutput(tc.nodeID)
+		if len(tc.existingDevice) != 0 {
+			instance := instances.Reservations[0].Instances[0]
+			instance.BlockDeviceMappings = []*ec2.InstanceBlockDeviceMapping{
+				&ec2.InstanceBlockDeviceMapping{
+					DeviceName: aws.String(tc.existingDevice),
+					Ebs:        &ec2.EbsInstanceBlockDevice{VolumeId: aws.String(tc.volumeID)},
+				},
+			}
+		}
+		mockEC2.EXPECT().DescribeInstancesWithContext(gomock.Any(), gomock.Any()).Return(instances, nil)
+		if len(tc.existingDevice) == 0 {
+			mockEC2.EXPECT().AttachVolumeWithContext(gomock.Any(), gomock.Any()).Do(func(ctx aws.Context, input *ec2.AttachVolumeInput) {
+				requestedDevice = aws.StringValue(input.Device)
+			}).Return(&ec2.VolumeAttachment{}, tc.attachErr)
+		}
+		if len(tc.inUseNodeID) != 0 {
+			mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(newDescribeVolumesOutput(tc.volumeID, "/dev/xvdba", tc.inUseNodeID, "attached"), nil)
+		}
+		if len(tc.outOfBandDevice) != 0 {
+			mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(newDescribeVolumesOutput(tc.volumeID, tc.outOfBandDevice, tc.nodeID, "attached"), nil)
+		}
+		if tc.attachErr == nil {
+			mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx aws.Context, input *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+				device, instanceID := tc.attachedDevice, tc.attachedNodeID
+				if device == "" {
+					device = requestedDevice
+				}
+				if instanceID == "" {
+					instanceID = tc.nodeID
+				}
+				return newDescribeVolumesOutput(tc.volumeID, device, instanceID, "attached"), nil
+			})
+		}
 
-		devicePath, err := c.AttachDisk(tc.volumeID, tc.nodeID)
+		devicePath, err := c.AttachDisk(context.Background(), tc.volumeID, tc.nodeID)
 		if err != nil {
-			if tc.expErr == nil {
+			if !tc.expErr {
 				t.Fatalf("AttachDisk() failed: expected no error, got: %v", err)
 			}
+			if tc.expSentinel != nil && err != tc.expSentinel {
+				t.Fatalf("AttachDisk() failed: expected error %v, got: %v", tc.expSentinel, err)
+			}
+			if len(tc.inUseNodeID) != 0 {
+				inUse, ok := err.(*VolumeInUseError)
+				if !ok || inUse.InstanceID != tc.inUseNodeID {
+					t.Fatalf("AttachDisk() failed: expected volume in use by %q, got: %v", tc.inUseNodeID, err)
+				}
+			}
 		} else {
-			if tc.expErr != nil {
+			if tc.expErr {
 				t.Fatal("AttachDisk() failed: expected error, got nothing")
 			}
 			if !strings.HasPrefix(devicePath, "/dev/") {
 				t.Fatal("AttachDisk() failed: expected valid device path, got emtpy string")
 			}
+			if len(tc.existingDevice) != 0 && devicePath != tc.existingDevice {
+				t.Fatalf("AttachDisk() failed: expected device path %q, got %q", tc.existingDevice, devicePath)
+			}
+			if len(tc.outOfBandDevice) != 0 && devicePath != tc.outOfBandDevice {
+				t.Fatalf("AttachDisk() failed: expected device path %q, got %q", tc.outOfBandDevice, devicePath)
+			}
 		}
 
 		mockCtrl.Finish()
@@ -203,22 +587,65 @@ func TestAttachDisk(t *testing.T) {
 
 func TestDetachDisk(t *testing.T) {
 	testCases := []struct {
-		name     string
-		volumeID string
-		nodeID   string
-		expErr   error
+		name            string
+		volumeID        string
+		nodeID          string
+		attachmentState string
+		// otherNodeID is the node the volume is attached to instead, if any
+		otherNodeID string
+		describeErr error
+		expDetach   bool
+		expErr      error
 	}{
 		{
-			name:     "success: normal",
+			name:            "success: normal",
+			volumeID:        "vol-test-1234",
+			nodeID:          "node-1234",
+			attachmentState: "attached",
+			expDetach:       true,
+			expErr:          nil,
+		},
+		{
+			name:     "success: volume not attached",
 			volumeID: "vol-test-1234",
 			nodeID:   "node-1234",
 			expErr:   nil,
 		},
 		{
-			name:     "fail: DetachVolume returned generic error",
-			volumeID: "vol-test-1234",
-			nodeID:   "node-1234",
-			expErr:   fmt.Errorf("DetachVolume generic error"),
+			name:        "success: volume attached to another node",
+			volumeID:    "vol-test-1234",
+			nodeID:      "node-1234",
+			otherNodeID: "node-5678",
+			expErr:      nil,
+		},
+		{
+			name:            "success: volume already detaching",
+			volumeID:        "vol-test-1234",
+			nodeID:          "node-1234",
+			attachmentState: "detaching",
+			expErr:          nil,
+		},
+		{
+			name:        "success: volume not found",
+			volumeID:    "vol-test-1234",
+			nodeID:      "node-1234",
+			describeErr: awserr.New("InvalidVolume.NotFound", "", nil),
+			expErr:      nil,
+		},
+		{
+			name:            "fail: DetachVolume returned generic error",
+			volumeID:        "vol-test-1234",
+			nodeID:          "node-1234",
+			attachmentState: "attached",
+			expDetach:       true,
+			expErr:          fmt.Errorf("DetachVolume generic error"),
+		},
+		{
+			name:        "fail: DescribeVolumes returned generic error",
+			volumeID:    "vol-test-1234",
+			nodeID:      "node-1234",
+			describeErr: fmt.Errorf("DescribeVolumes generic error"),
+			expErr:      fmt.Errorf("DescribeVolumes generic error"),
 		},
 	}
 
@@ -228,10 +655,28 @@ func TestDetachDisk(t *testing.T) {
 		mockEC2 := mocks.NewMockEC2(mockCtrl)
 		c := newCloud(mockEC2)
 
-		mockEC2.EXPECT().DescribeInstances(gomock.Any()).Return(newDescribeInstancesOutput(tc.nodeID), nil)
-		mockEC2.EXPECT().DetachVolume(gomock.Any()).Return(&ec2.VolumeAttachment{}, tc.expErr)
+		vol := &ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{&ec2.Volume{VolumeId: aws.String(tc.volumeID)}}}
+		if len(tc.attachmentState) != 0 {
+			vol = newDescribeVolumesOutput(tc.volumeID, "/dev/xvdbc", tc.nodeID, tc.attachmentState)
+		} else if len(tc.otherNodeID) != 0 {
+			vol = newDescribeVolumesOutput(tc.volumeID, "/dev/xvdbc", tc.otherNodeID, "attached")
+		}
+		detached := &ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{&ec2.Volume{VolumeId: aws.String(tc.volumeID)}}}
+
+		mockEC2.EXPECT().DescribeInstancesWithContext(gomock.Any(), gomock.Any()).Return(newDescribeInstancesOutput(tc.nodeID), nil)
+		if tc.describeErr != nil {
+			mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(nil, tc.describeErr)
+		} else {
+			mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(vol, nil)
+		}
+		if tc.expDetach {
+			mockEC2.EXPECT().DetachVolumeWithContext(gomock.Any(), gomock.Any()).Return(&ec2.VolumeAttachment{}, tc.expErr)
+		}
+		if tc.attachmentState == "detaching" || (tc.expDetach && tc.expErr == nil) {
+			mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(detached, nil)
+		}
 
-		err := c.DetachDisk(tc.volumeID, tc.nodeID)
+		err := c.DetachDisk(context.Background(), tc.volumeID, tc.nodeID)
 		if err != nil {
 			if tc.expErr == nil {
 				t.Fatalf("DetachDisk() failed: expected no error, got: %v", err)
@@ -246,24 +691,137 @@ func TestDetachDisk(t *testing.T) {
 	}
 }
 
-func TestGetDisk(t *testing.T) {
+func TestWaitForAttachmentState(t *testing.T) {
 	testCases := []struct {
-		name           string
-		volumeName     string
-		volumeCapacity int64
-		expErr         error
+		name      string
+		states    []string
+		cancelled bool
+		expErr    bool
+	}{
+		{
+			name:   "success: attached after polling",
+			states: []string{"attaching", "attaching", "attached"},
+		},
+		{
+			name:   "fail: timed out",
+			states: []string{"attaching"},
+			expErr: true,
+		},
+		{
+			name:      "fail: context cancelled",
+			states:    []string{"attaching"},
+			cancelled: true,
+			expErr:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+		c := newEC2Cloud(nil, mockEC2, &CloudOptions{AttachmentTimeout: 50 * time.Millisecond})
+		c.pollInterval = time.Millisecond
+
+		calls := 0
+		mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx aws.Context, input *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+			state := tc.states[len(tc.states)-1]
+			if calls < len(tc.states) {
+				state = tc.states[calls]
+			}
+			calls++
+			return newDescribeVolumesOutput("vol-test-1234", "/dev/xvdbc", "node-1234", state), nil
+		}).AnyTimes()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if tc.cancelled {
+			cancel()
+		}
+
+		start := time.Now()
+		attachment, err := c.waitForAttachmentState(ctx, "vol-test-1234", "attached")
+		cancel()
+		if err != nil {
+			if !tc.expErr {
+				t.Fatalf("waitForAttachmentState() failed: expected no error, got: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("waitForAttachmentState() failed: expected to give up within the timeout, took %v", elapsed)
+			}
+		} else {
+			if tc.expErr {
+				t.Fatal("waitForAttachmentState() failed: expected error, got nothing")
+			}
+			if aws.StringValue(attachment.State) != "attached" {
+				t.Fatalf("waitForAttachmentState() failed: expected attached state, got %q", aws.StringValue(attachment.State))
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestGetDiskByNameAndSize(t *testing.T) {
+	testCases := []struct {
+		name              string
+		volumeName        string
+		volumeCapacity    int64
+		requestedCapacity int64
+		// otherStates are the states of other volumes with the same name
+		otherStates []string
+		describeErr error
+		expErr      error
 	}{
 		{
-			name:           "success: normal",
-			volumeName:     "vol-test-1234",
-			volumeCapacity: util.GiBToBytes(1),
-			expErr:         nil,
+			name:              "success: normal",
+			volumeName:        "vol-test-1234",
+			volumeCapacity:    util.GiBToBytes(1),
+			requestedCapacity: util.GiBToBytes(1),
+			expErr:            nil,
+		},
+		{
+			name:              "success: existing volume is larger than requested",
+			volumeName:        "vol-test-1234",
+			volumeCapacity:    util.GiBToBytes(2),
+			requestedCapacity: util.GiBToBytes(1),
+			expErr:            nil,
+		},
+		{
+			name:              "success: volumes being deleted or failed are ignored",
+			volumeName:        "vol-test-1234",
+			volumeCapacity:    util.GiBToBytes(1),
+			requestedCapacity: util.GiBToBytes(1),
+			otherStates:       []string{ec2.VolumeStateDeleting, ec2.VolumeStateError},
+			expErr:            nil,
 		},
 		{
-			name:           "fail: DescribeVolumes returned generic error",
-			volumeName:     "vol-test-1234",
-			volumeCapacity: util.GiBToBytes(1),
-			expErr:         fmt.Errorf("DescribeVolumes generic error"),
+			name:              "fail: multiple active volumes",
+			volumeName:        "vol-test-1234",
+			volumeCapacity:    util.GiBToBytes(1),
+			requestedCapacity: util.GiBToBytes(1),
+			otherStates:       []string{ec2.VolumeStateCreating},
+			expErr:            ErrMultiDisks,
+		},
+		{
+			name:              "fail: requested capacity rounds up above existing volume",
+			volumeName:        "vol-test-1234",
+			volumeCapacity:    util.GiBToBytes(1),
+			requestedCapacity: util.GiBToBytes(1) + 1,
+			expErr:            ErrDiskExistsDiffSize,
+		},
+		{
+			name:              "fail: existing volume is smaller than requested",
+			volumeName:        "vol-test-1234",
+			volumeCapacity:    util.GiBToBytes(1),
+			requestedCapacity: util.GiBToBytes(2),
+			expErr:            ErrDiskExistsDiffSize,
+		},
+		{
+			name:              "fail: DescribeVolumes returned generic error",
+			volumeName:        "vol-test-1234",
+			volumeCapacity:    util.GiBToBytes(1),
+			requestedCapacity: util.GiBToBytes(1),
+			describeErr:       fmt.Errorf("DescribeVolumes generic error"),
+			expErr:            fmt.Errorf("DescribeVolumes generic error"),
 		},
 	}
 
@@ -276,20 +834,39 @@ func TestGetDisk(t *testing.T) {
 		vol := &ec2.Volume{
 			VolumeId: aws.String(tc.volumeName),
 			Size:     aws.Int64(util.BytesToGiB(tc.volumeCapacity)),
+			State:    aws.String(ec2.VolumeStateAvailable),
 		}
-		mockEC2.EXPECT().DescribeVolumes(gomock.Any()).Return(&ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{vol}}, tc.expErr)
+		volumes := []*ec2.Volume{vol}
+		for i, state := range tc.otherStates {
+			volumes = append(volumes, &ec2.Volume{
+				VolumeId: aws.String(fmt.Sprintf("%s-%d", tc.volumeName, i)),
+				Size:     vol.Size,
+				State:    aws.String(state),
+			})
+		}
+		mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Do(func(ctx aws.Context, input *ec2.DescribeVolumesInput, opts ...request.Option) {
+			if aws.Int64Value(input.MaxResults) != DefaultVolumesPageSize {
+				t.Fatalf("Expected DescribeVolumes to request pages of %d volumes, got %d", DefaultVolumesPageSize, aws.Int64Value(input.MaxResults))
+			}
+		}).Return(&ec2.DescribeVolumesOutput{Volumes: volumes}, tc.describeErr)
 
-		disk, err := c.GetDisk(tc.volumeName, tc.volumeCapacity)
+		disk, err := c.GetDiskByNameAndSize(context.Background(), tc.volumeName, tc.requestedCapacity)
 		if err != nil {
 			if tc.expErr == nil {
-				t.Fatalf("GetDisk() failed: expected no error, got: %v", err)
+				t.Fatalf("GetDiskByNameAndSize() failed: expected no error, got: %v", err)
+			}
+			if (tc.expErr == ErrDiskExistsDiffSize || tc.expErr == ErrMultiDisks) && err != tc.expErr {
+				t.Fatalf("GetDiskByNameAndSize() failed: expected error %v, got: %v", tc.expErr, err)
 			}
 		} else {
 			if tc.expErr != nil {
-				t.Fatal("GetDisk() failed: expected error, got nothing")
+				t.Fatal("GetDiskByNameAndSize() failed: expected error, got nothing")
 			}
 			if disk.CapacityGiB != util.BytesToGiB(tc.volumeCapacity) {
-				t.Fatalf("GetDisk() failed: expected capacity %d, got %d", util.BytesToGiB(tc.volumeCapacity), disk.CapacityGiB)
+				t.Fatalf("GetDiskByNameAndSize() failed: expected capacity %d, got %d", util.BytesToGiB(tc.volumeCapacity), disk.CapacityGiB)
+			}
+			if disk.VolumeID != tc.volumeName {
+				t.Fatalf("GetDiskByNameAndSize() failed: expected volume %q, got %q", tc.volumeName, disk.VolumeID)
 			}
 		}
 
@@ -297,24 +874,1206 @@ func TestGetDisk(t *testing.T) {
 	}
 }
 
-func newCloud(mockEC2 EC2) Cloud {
-	return &cloud{
-		metadata: &metadata{
-			instanceID:       "test-instance",
-			region:           "test-region",
-			availabilityZone: "test-az",
+func TestGetDiskByNameAndSizeClusterScope(t *testing.T) {
+	testCases := []struct {
+		name        string
+		clusterID   string
+		expVolumeID string
+		expErr      error
+	}{
+		{
+			name:        "success: volume of another cluster isn't returned",
+			clusterID:   "cluster-a",
+			expVolumeID: "vol-cluster-a",
+		},
+		{
+			name:      "fail: volumes of all clusters are returned without cluster ID",
+			clusterID: "",
+			expErr:    ErrMultiDisks,
 		},
-		dm:  dm.NewBlockDeviceManager(),
-		ec2: mockEC2,
 	}
-}
 
-func newDescribeInstancesOutput(nodeID string) *ec2.DescribeInstancesOutput {
-	return &ec2.DescribeInstancesOutput{
-		Reservations: []*ec2.Reservation{&ec2.Reservation{
-			Instances: []*ec2.Instance{
-				&ec2.Instance{InstanceId: aws.String(nodeID)},
+	newVolume := func(volumeID, clusterID string) *ec2.Volume {
+		return &ec2.Volume{
+			VolumeId: aws.String(volumeID),
+			Size:     aws.Int64(1),
+			State:    aws.String(ec2.VolumeStateAvailable),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(VolumeNameTagKey), Value: aws.String("test-vol")},
+				{Key: aws.String(ClusterTagKey(clusterID)), Value: aws.String(ClusterTagOwned)},
 			},
-		}},
+		}
+	}
+	volumes := []*ec2.Volume{newVolume("vol-cluster-a", "cluster-a"), newVolume("vol-cluster-b", "cluster-b")}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+		c := newEC2Cloud(nil, mockEC2, &CloudOptions{ClusterID: tc.clusterID})
+
+		// Return the volumes matching the tag filters, like EC2 does
+		mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx aws.Context, input *ec2.DescribeVolumesInput, opts ...request.Option) (*ec2.DescribeVolumesOutput, error) {
+			var matching []*ec2.Volume
+			for _, v := range volumes {
+				if hasTags(v, input.Filters) {
+					matching = append(matching, v)
+				}
+			}
+			return &ec2.DescribeVolumesOutput{Volumes: matching}, nil
+		})
+
+		disk, err := c.GetDiskByNameAndSize(context.Background(), "test-vol", util.GiBToBytes(1))
+		if err != nil {
+			if err != tc.expErr {
+				t.Fatalf("GetDiskByNameAndSize() failed: expected error %v, got: %v", tc.expErr, err)
+			}
+		} else {
+			if tc.expErr != nil {
+				t.Fatal("GetDiskByNameAndSize() failed: expected error, got nothing")
+			}
+			if disk.VolumeID != tc.expVolumeID {
+				t.Fatalf("GetDiskByNameAndSize() failed: expected volume %q, got %q", tc.expVolumeID, disk.VolumeID)
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+// hasTags returns whether the volume matches all the tag filters.
+func hasTags(volume *ec2.Volume, filters []*ec2.Filter) bool {
+	for _, f := range filters {
+		key := strings.TrimPrefix(aws.StringValue(f.Name), "tag:")
+		found := false
+		for _, tag := range volume.Tags {
+			if aws.StringValue(tag.Key) != key {
+				continue
+			}
+			for _, value := range f.Values {
+				if aws.StringValue(value) == aws.StringValue(tag.Value) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestGetDiskByID(t *testing.T) {
+	testCases := []struct {
+		name             string
+		volumeID         string
+		availabilityZone string
+		volumeType       string
+		describeErr      error
+		expErr           error
+	}{
+		{
+			name:             "success: normal",
+			volumeID:         "vol-test-1234",
+			availabilityZone: "us-east-1a",
+			volumeType:       VolumeTypeGP2,
+		},
+		{
+			name:        "fail: DescribeVolumes returned not found error",
+			volumeID:    "vol-test-1234",
+			describeErr: awserr.New("InvalidVolume.NotFound", "", nil),
+			expErr:      ErrVolumeNotFound,
+		},
+		{
+			name:        "fail: DescribeVolumes returned generic error",
+			volumeID:    "vol-test-1234",
+			describeErr: fmt.Errorf("DescribeVolumes generic error"),
+			expErr:      fmt.Errorf("DescribeVolumes generic error"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+		c := newCloud(mockEC2)
+
+		vol := &ec2.Volume{
+			VolumeId:         aws.String(tc.volumeID),
+			Size:             aws.Int64(1),
+			AvailabilityZone: aws.String(tc.availabilityZone),
+			VolumeType:       aws.String(tc.volumeType),
+		}
+		mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(&ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{vol}}, tc.describeErr)
+
+		disk, err := c.GetDiskByID(context.Background(), tc.volumeID)
+		if err != nil {
+			if tc.expErr == nil {
+				t.Fatalf("GetDiskByID() failed: expected no error, got: %v", err)
+			}
+			if tc.expErr == ErrVolumeNotFound && err != ErrVolumeNotFound {
+				t.Fatalf("GetDiskByID() failed: expected error %v, got: %v", tc.expErr, err)
+			}
+		} else {
+			if tc.expErr != nil {
+				t.Fatal("GetDiskByID() failed: expected error, got nothing")
+			}
+			if disk.VolumeID != tc.volumeID {
+				t.Fatalf("GetDiskByID() failed: expected ID %q, got %q", tc.volumeID, disk.VolumeID)
+			}
+			if disk.CapacityGiB != 1 {
+				t.Fatalf("GetDiskByID() failed: expected capacity 1, got %d", disk.CapacityGiB)
+			}
+			if disk.AvailabilityZone != tc.availabilityZone {
+				t.Fatalf("GetDiskByID() failed: expected availability zone %q, got %q", tc.availabilityZone, disk.AvailabilityZone)
+			}
+			if disk.VolumeType != tc.volumeType {
+				t.Fatalf("GetDiskByID() failed: expected volume type %q, got %q", tc.volumeType, disk.VolumeType)
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestResizeDisk(t *testing.T) {
+	testCases := []struct {
+		name       string
+		volumeID   string
+		oldSizeGiB int64
+		newSizeGiB int64
+		modifyErr  error
+		// previous is the latest modification of the volume, if any
+		previous *ec2.VolumeModification
+		// history holds the older modifications described along with the
+		// one being waited for
+		history     []*ec2.VolumeModification
+		states      []string
+		expSizeGiB  int64
+		expModified bool
+		expErr      bool
+		// expSentinel is the error expected to be returned as is, if any
+		expSentinel error
+	}{
+		{
+			name:        "success: normal",
+			volumeID:    "vol-test-1234",
+			oldSizeGiB:  1,
+			newSizeGiB:  2,
+			states:      []string{ec2.VolumeModificationStateModifying, ec2.VolumeModificationStateOptimizing},
+			expSizeGiB:  2,
+			expModified: true,
+		},
+		{
+			name:       "success: previous modification completed long ago",
+			volumeID:   "vol-test-1234",
+			oldSizeGiB: 1,
+			newSizeGiB: 2,
+			previous: &ec2.VolumeModification{
+				ModificationState: aws.String(ec2.VolumeModificationStateCompleted),
+				StartTime:         aws.Time(time.Now().Add(-7 * time.Hour)),
+			},
+			states:      []string{ec2.VolumeModificationStateCompleted},
+			expSizeGiB:  2,
+			expModified: true,
+		},
+		{
+			name:       "success: waits for the new modification among older ones",
+			volumeID:   "vol-test-1234",
+			oldSizeGiB: 1,
+			newSizeGiB: 2,
+			previous: &ec2.VolumeModification{
+				ModificationState: aws.String(ec2.VolumeModificationStateCompleted),
+				StartTime:         aws.Time(time.Now().Add(-7 * time.Hour)),
+			},
+			history: []*ec2.VolumeModification{
+				&ec2.VolumeModification{
+					ModificationState: aws.String(ec2.VolumeModificationStateCompleted),
+					StartTime:         aws.Time(time.Now().Add(-7 * time.Hour)),
+				},
+			},
+			states:      []string{ec2.VolumeModificationStateModifying, ec2.VolumeModificationStateOptimizing},
+			expSizeGiB:  2,
+			expModified: true,
+		},
+		{
+			name:       "success: waits for the modification in progress",
+			volumeID:   "vol-test-1234",
+			oldSizeGiB: 1,
+			newSizeGiB: 2,
+			previous: &ec2.VolumeModification{
+				ModificationState: aws.String(ec2.VolumeModificationStateModifying),
+				TargetSize:        aws.Int64(3),
+				StartTime:         aws.Time(time.Now()),
+			},
+			states:     []string{ec2.VolumeModificationStateModifying, ec2.VolumeModificationStateOptimizing},
+			expSizeGiB: 3,
+		},
+		{
+			name:       "fail: smaller modification in progress",
+			volumeID:   "vol-test-1234",
+			oldSizeGiB: 1,
+			newSizeGiB: 4,
+			previous: &ec2.VolumeModification{
+				ModificationState: aws.String(ec2.VolumeModificationStateModifying),
+				TargetSize:        aws.Int64(3),
+				StartTime:         aws.Time(time.Now()),
+			},
+			expErr:      true,
+			expSentinel: ErrVolumeModificationInProgress,
+		},
+		{
+			name:       "fail: modified less than 6 hours ago",
+			volumeID:   "vol-test-1234",
+			oldSizeGiB: 3,
+			newSizeGiB: 4,
+			previous: &ec2.VolumeModification{
+				ModificationState: aws.String(ec2.VolumeModificationStateOptimizing),
+				TargetSize:        aws.Int64(3),
+				StartTime:         aws.Time(time.Now().Add(-time.Hour)),
+			},
+			expErr:      true,
+			expSentinel: ErrVolumeModificationRateExceeded,
+		},
+		{
+			name:       "success: volume already large enough",
+			volumeID:   "vol-test-1234",
+			oldSizeGiB: 2,
+			newSizeGiB: 1,
+			expSizeGiB: 2,
+		},
+		{
+			name:        "fail: ModifyVolume returned error",
+			volumeID:    "vol-test-1234",
+			oldSizeGiB:  1,
+			newSizeGiB:  2,
+			modifyErr:   fmt.Errorf("ModifyVolume generic error"),
+			expModified: true,
+			expErr:      true,
+		},
+		{
+			name:        "fail: modification failed",
+			volumeID:    "vol-test-1234",
+			oldSizeGiB:  1,
+			newSizeGiB:  2,
+			states:      []string{ec2.VolumeModificationStateModifying, ec2.VolumeModificationStateFailed},
+			expModified: true,
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+		c := newEC2Cloud(nil, mockEC2, &CloudOptions{})
+		c.pollInterval = time.Millisecond
+
+		vol := &ec2.Volume{VolumeId: aws.String(tc.volumeID), Size: aws.Int64(tc.oldSizeGiB)}
+		mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(&ec2.DescribeVolumesOutput{Volumes: []*ec2.Volume{vol}}, nil)
+		if tc.oldSizeGiB < tc.newSizeGiB {
+			if tc.previous != nil {
+				output := &ec2.DescribeVolumesModificationsOutput{VolumesModifications: []*ec2.VolumeModification{tc.previous}}
+				mockEC2.EXPECT().DescribeVolumesModificationsWithContext(gomock.Any(), gomock.Any()).Return(output, nil)
+			} else {
+				notFound := awserr.New("InvalidVolumeModification.NotFound", "", nil)
+				mockEC2.EXPECT().DescribeVolumesModificationsWithContext(gomock.Any(), gomock.Any()).Return(nil, notFound)
+			}
+		}
+		if tc.expModified {
+			mockEC2.EXPECT().ModifyVolumeWithContext(gomock.Any(), gomock.Any()).Return(&ec2.ModifyVolumeOutput{}, tc.modifyErr)
+		}
+		for _, state := range tc.states {
+			output := &ec2.DescribeVolumesModificationsOutput{
+				VolumesModifications: append(append([]*ec2.VolumeModification{}, tc.history...), &ec2.VolumeModification{
+					VolumeId:          aws.String(tc.volumeID),
+					ModificationState: aws.String(state),
+					StartTime:         aws.Time(time.Now()),
+				}),
+			}
+			mockEC2.EXPECT().DescribeVolumesModificationsWithContext(gomock.Any(), gomock.Any()).Return(output, nil)
+		}
+
+		newSize, err := c.ResizeDisk(context.Background(), tc.volumeID, util.GiBToBytes(tc.newSizeGiB))
+		if err != nil {
+			if !tc.expErr {
+				t.Fatalf("ResizeDisk() failed: expected no error, got: %v", err)
+			}
+			if tc.expSentinel != nil && err != tc.expSentinel {
+				t.Fatalf("ResizeDisk() failed: expected error %v, got: %v", tc.expSentinel, err)
+			}
+		} else {
+			if tc.expErr {
+				t.Fatal("ResizeDisk() failed: expected error, got nothing")
+			}
+			if newSize != tc.expSizeGiB {
+				t.Fatalf("ResizeDisk() failed: expected size %d, got %d", tc.expSizeGiB, newSize)
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestGetDisksByIDs(t *testing.T) {
+	manyVolumeIDs := make([]string, volumeIDsPerRequest+50)
+	for i := range manyVolumeIDs {
+		manyVolumeIDs[i] = fmt.Sprintf("vol-test-%d", i)
+	}
+
+	testCases := []struct {
+		name        string
+		volumeIDs   []string
+		describeErr error
+		expIDs      []string
+		expRequests int
+		expErr      bool
+	}{
+		{
+			name:        "success: normal",
+			volumeIDs:   []string{"vol-test-1", "vol-test-2"},
+			expIDs:      []string{"vol-test-1", "vol-test-2"},
+			expRequests: 2,
+		},
+		{
+			name:        "success: volume not found left out",
+			volumeIDs:   []string{"vol-test-1", "vol-missing"},
+			expIDs:      []string{"vol-test-1"},
+			expRequests: 2,
+		},
+		{
+			name:        "success: volume IDs split in batches",
+			volumeIDs:   manyVolumeIDs,
+			expIDs:      manyVolumeIDs,
+			expRequests: 4,
+		},
+		{
+			name:        "fail: DescribeVolumes returned generic error",
+			volumeIDs:   []string{"vol-test-1"},
+			describeErr: fmt.Errorf("DescribeVolumes generic error"),
+			expRequests: 1,
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+		c := newCloud(mockEC2)
+
+		// The first volume of every batch is returned in a page of its own
+		mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx aws.Context, input *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+			if tc.describeErr != nil {
+				return nil, tc.describeErr
+			}
+			ids := aws.StringValueSlice(input.Filters[0].Values)
+			output := &ec2.DescribeVolumesOutput{}
+			if input.NextToken == nil {
+				ids = ids[:1]
+				output.NextToken = aws.String("token")
+			} else {
+				ids = ids[1:]
+			}
+			for _, id := range ids {
+				if id != "vol-missing" {
+					output.Volumes = append(output.Volumes, &ec2.Volume{VolumeId: aws.String(id), Size: aws.Int64(1)})
+				}
+			}
+			return output, nil
+		}).Times(tc.expRequests)
+
+		disks, err := c.GetDisksByIDs(context.Background(), tc.volumeIDs)
+		if err != nil {
+			if !tc.expErr {
+				t.Fatalf("GetDisksByIDs() failed: expected no error, got: %v", err)
+			}
+		} else {
+			if tc.expErr {
+				t.Fatal("GetDisksByIDs() failed: expected error, got nothing")
+			}
+			if len(disks) != len(tc.expIDs) {
+				t.Fatalf("GetDisksByIDs() failed: expected %d disks, got %d", len(tc.expIDs), len(disks))
+			}
+			for _, id := range tc.expIDs {
+				if disk, ok := disks[id]; !ok || disk.VolumeID != id {
+					t.Fatalf("GetDisksByIDs() failed: expected disk %q, got %v", id, disk)
+				}
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestListDisks(t *testing.T) {
+	testCases := []struct {
+		name          string
+		maxEntries    int64
+		startingToken string
+		describeErr   error
+		expIDs        []string
+		expToken      string
+		expErr        error
+	}{
+		{
+			name:   "success: normal",
+			expIDs: []string{"vol-test-1", "vol-test-2", "vol-test-3"},
+		},
+		{
+			name:       "success: max entries",
+			maxEntries: 2,
+			expIDs:     []string{"vol-test-1", "vol-test-2"},
+			expToken:   "2",
+		},
+		{
+			name:          "success: starting token",
+			startingToken: "2",
+			expIDs:        []string{"vol-test-3"},
+		},
+		{
+			name:          "fail: invalid starting token",
+			startingToken: "invalid-token",
+			expErr:        ErrInvalidStartingToken,
+		},
+		{
+			name:        "fail: DescribeVolumes returned generic error",
+			describeErr: fmt.Errorf("DescribeVolumes generic error"),
+			expErr:      fmt.Errorf("DescribeVolumes generic error"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+		c := newCloud(mockEC2)
+
+		output := &ec2.DescribeVolumesOutput{
+			Volumes: []*ec2.Volume{
+				&ec2.Volume{VolumeId: aws.String("vol-test-3"), Size: aws.Int64(1)},
+				newDescribeVolumesOutput("vol-test-1", "/dev/xvdba", "node-1234", "attached").Volumes[0],
+				&ec2.Volume{VolumeId: aws.String("vol-test-2"), Size: aws.Int64(1)},
+			},
+		}
+		mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(output, tc.describeErr)
+
+		disks, nextToken, err := c.ListDisks(context.Background(), tc.maxEntries, tc.startingToken)
+		if err != nil {
+			if tc.expErr == nil {
+				t.Fatalf("ListDisks() failed: expected no error, got: %v", err)
+			}
+			if tc.expErr == ErrInvalidStartingToken && err != ErrInvalidStartingToken {
+				t.Fatalf("ListDisks() failed: expected error %v, got: %v", tc.expErr, err)
+			}
+		} else {
+			if tc.expErr != nil {
+				t.Fatal("ListDisks() failed: expected error, got nothing")
+			}
+			if len(disks) != len(tc.expIDs) {
+				t.Fatalf("ListDisks() failed: expected %d disks, got %d", len(tc.expIDs), len(disks))
+			}
+			for i, disk := range disks {
+				if disk.VolumeID != tc.expIDs[i] {
+					t.Fatalf("ListDisks() failed: expected disk %q, got %q", tc.expIDs[i], disk.VolumeID)
+				}
+				if disk.VolumeID == "vol-test-1" && (len(disk.AttachedNodeIDs) != 1 || disk.AttachedNodeIDs[0] != "node-1234") {
+					t.Fatalf("ListDisks() failed: expected disk attached to %q, got %v", "node-1234", disk.AttachedNodeIDs)
+				}
+			}
+			if nextToken != tc.expToken {
+				t.Fatalf("ListDisks() failed: expected next token %q, got %q", tc.expToken, nextToken)
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	testCases := []struct {
+		name            string
+		volumeID        string
+		snapshotOptions *SnapshotOptions
+		pending         bool
+		describeState   string
+		expSnapshot     *Snapshot
+		expErr          error
+	}{
+		{
+			name:     "success: normal",
+			volumeID: "vol-test-1234",
+			snapshotOptions: &SnapshotOptions{
+				Tags: map[string]string{SnapshotNameTagKey: "snap-test-name"},
+			},
+			expSnapshot: &Snapshot{
+				SnapshotID:     "snap-test-1234",
+				SourceVolumeID: "vol-test-1234",
+				Size:           1,
+				ReadyToUse:     true,
+			},
+			expErr: nil,
+		},
+		{
+			name:     "success: pending snapshot becomes ready",
+			volumeID: "vol-test-1234",
+			snapshotOptions: &SnapshotOptions{
+				Tags:         map[string]string{SnapshotNameTagKey: "snap-test-name"},
+				ReadyTimeout: time.Second,
+			},
+			pending:       true,
+			describeState: ec2.SnapshotStateCompleted,
+			expSnapshot: &Snapshot{
+				SnapshotID:     "snap-test-1234",
+				SourceVolumeID: "vol-test-1234",
+				Size:           1,
+				ReadyToUse:     true,
+			},
+			expErr: nil,
+		},
+		{
+			name:     "success: pending snapshot is not ready before the timeout",
+			volumeID: "vol-test-1234",
+			snapshotOptions: &SnapshotOptions{
+				Tags:         map[string]string{SnapshotNameTagKey: "snap-test-name"},
+				ReadyTimeout: 100 * time.Millisecond,
+			},
+			pending:       true,
+			describeState: ec2.SnapshotStatePending,
+			expSnapshot: &Snapshot{
+				SnapshotID:     "snap-test-1234",
+				SourceVolumeID: "vol-test-1234",
+				Size:           1,
+				ReadyToUse:     false,
+			},
+			expErr: nil,
+		},
+		{
+			name:     "success: pending snapshot without waiting",
+			volumeID: "vol-test-1234",
+			snapshotOptions: &SnapshotOptions{
+				Tags: map[string]string{SnapshotNameTagKey: "snap-test-name"},
+			},
+			pending: true,
+			expSnapshot: &Snapshot{
+				SnapshotID:     "snap-test-1234",
+				SourceVolumeID: "vol-test-1234",
+				Size:           1,
+				ReadyToUse:     false,
+			},
+			expErr: nil,
+		},
+		{
+			name:     "fail: CreateSnapshot returned an error",
+			volumeID: "vol-test-1234",
+			snapshotOptions: &SnapshotOptions{
+				Tags: map[string]string{SnapshotNameTagKey: "snap-test-name"},
+			},
+			expErr: fmt.Errorf("CreateSnapshot generic error"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+		c := newCloud(mockEC2)
+
+		ec2Snapshot := &ec2.Snapshot{}
+		if tc.expErr == nil {
+			ec2Snapshot = &ec2.Snapshot{
+				SnapshotId: aws.String(tc.expSnapshot.SnapshotID),
+				VolumeId:   aws.String(tc.volumeID),
+				VolumeSize: aws.Int64(tc.expSnapshot.Size),
+				StartTime:  aws.Time(time.Now()),
+				State:      aws.String(ec2.SnapshotStateCompleted),
+			}
+			if tc.pending {
+				ec2Snapshot.State = aws.String(ec2.SnapshotStatePending)
+			}
+		}
+		mockEC2.EXPECT().CreateSnapshotWithContext(gomock.Any(), gomock.Any()).Return(ec2Snapshot, tc.expErr)
+		if len(tc.describeState) != 0 {
+			described := &ec2.Snapshot{
+				SnapshotId: aws.String(tc.expSnapshot.SnapshotID),
+				VolumeId:   aws.String(tc.volumeID),
+				State:      aws.String(tc.describeState),
+			}
+			mockEC2.EXPECT().DescribeSnapshotsWithContext(gomock.Any(), gomock.Any()).Return(&ec2.DescribeSnapshotsOutput{Snapshots: []*ec2.Snapshot{described}}, nil).MinTimes(1)
+		}
+
+		snapshot, err := c.CreateSnapshot(context.Background(), tc.volumeID, tc.snapshotOptions)
+		if err != nil {
+			if tc.expErr == nil {
+				t.Fatalf("CreateSnapshot() failed: expected no error, got: %v", err)
+			}
+		} else {
+			if tc.expErr != nil {
+				t.Fatal("CreateSnapshot() failed: expected error, got nothing")
+			}
+			if snapshot.SnapshotID != tc.expSnapshot.SnapshotID {
+				t.Fatalf("CreateSnapshot() failed: expected ID %q, got %q", tc.expSnapshot.SnapshotID, snapshot.SnapshotID)
+			}
+			if snapshot.SourceVolumeID != tc.expSnapshot.SourceVolumeID {
+				t.Fatalf("CreateSnapshot() failed: expected source volume %q, got %q", tc.expSnapshot.SourceVolumeID, snapshot.SourceVolumeID)
+			}
+			if snapshot.Size != tc.expSnapshot.Size {
+				t.Fatalf("CreateSnapshot() failed: expected size %d, got %d", tc.expSnapshot.Size, snapshot.Size)
+			}
+			if snapshot.ReadyToUse != tc.expSnapshot.ReadyToUse {
+				t.Fatalf("CreateSnapshot() failed: expected ready %v, got %v", tc.expSnapshot.ReadyToUse, snapshot.ReadyToUse)
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	testCases := []struct {
+		name       string
+		snapshotID string
+		expResp    bool
+		expErr     error
+	}{
+		{
+			name:       "success: normal",
+			snapshotID: "snap-test-1234",
+			expResp:    true,
+			expErr:     nil,
+		},
+		{
+			name:       "fail: DeleteSnapshot returned generic error",
+			snapshotID: "snap-test-1234",
+			expResp:    false,
+			expErr:     fmt.Errorf("DeleteSnapshot generic error"),
+		},
+		{
+			name:       "fail: DeleteSnapshot returned not found error",
+			snapshotID: "snap-test-1234",
+			expResp:    false,
+			expErr:     awserr.New("InvalidSnapshot.NotFound", "", nil),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+		c := newCloud(mockEC2)
+
+		mockEC2.EXPECT().DeleteSnapshotWithContext(gomock.Any(), gomock.Any()).Return(&ec2.DeleteSnapshotOutput{}, tc.expErr)
+
+		ok, err := c.DeleteSnapshot(context.Background(), tc.snapshotID)
+		if err != nil && tc.expErr == nil {
+			t.Fatalf("DeleteSnapshot() failed: expected no error, got: %v", err)
+		}
+
+		if err == nil && tc.expErr != nil {
+			t.Fatal("DeleteSnapshot() failed: expected error, got nothing")
+		}
+
+		if isAWSErrorSnapshotNotFound(tc.expErr) && err != ErrSnapshotNotFound {
+			t.Fatalf("DeleteSnapshot() failed: expected error %v, got %v", ErrSnapshotNotFound, err)
+		}
+
+		if tc.expResp != ok {
+			t.Fatalf("DeleteSnapshot() failed: expected return %v, got %v", tc.expResp, ok)
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestGetSnapshotByName(t *testing.T) {
+	testCases := []struct {
+		name         string
+		snapshotName string
+		snapshots    []*ec2.Snapshot
+		describeErr  error
+		expErr       error
+	}{
+		{
+			name:         "success: normal",
+			snapshotName: "snap-test-name",
+			snapshots: []*ec2.Snapshot{
+				&ec2.Snapshot{SnapshotId: aws.String("snap-test-1234"), VolumeId: aws.String("vol-test-1234")},
+			},
+		},
+		{
+			name:         "fail: snapshot not found",
+			snapshotName: "snap-test-name",
+			snapshots:    []*ec2.Snapshot{},
+			expErr:       ErrSnapshotNotFound,
+		},
+		{
+			name:         "fail: multiple snapshots with same name",
+			snapshotName: "snap-test-name",
+			snapshots: []*ec2.Snapshot{
+				&ec2.Snapshot{SnapshotId: aws.String("snap-test-1234"), VolumeId: aws.String("vol-test-1234")},
+				&ec2.Snapshot{SnapshotId: aws.String("snap-test-5678"), VolumeId: aws.String("vol-test-1234")},
+			},
+			expErr: ErrMultiSnapshots,
+		},
+		{
+			name:         "fail: DescribeSnapshots returned generic error",
+			snapshotName: "snap-test-name",
+			describeErr:  fmt.Errorf("DescribeSnapshots generic error"),
+			expErr:       fmt.Errorf("DescribeSnapshots generic error"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+		c := newCloud(mockEC2)
+
+		mockEC2.EXPECT().DescribeSnapshotsWithContext(gomock.Any(), gomock.Any()).Return(&ec2.DescribeSnapshotsOutput{Snapshots: tc.snapshots}, tc.describeErr)
+
+		snapshot, err := c.GetSnapshotByName(context.Background(), tc.snapshotName)
+		if err != nil {
+			if tc.expErr == nil {
+				t.Fatalf("GetSnapshotByName() failed: expected no error, got: %v", err)
+			}
+			if tc.describeErr == nil && err != tc.expErr {
+				t.Fatalf("GetSnapshotByName() failed: expected error %v, got: %v", tc.expErr, err)
+			}
+		} else {
+			if tc.expErr != nil {
+				t.Fatal("GetSnapshotByName() failed: expected error, got nothing")
+			}
+			if snapshot.SnapshotID != aws.StringValue(tc.snapshots[0].SnapshotId) {
+				t.Fatalf("GetSnapshotByName() failed: expected ID %q, got %q", aws.StringValue(tc.snapshots[0].SnapshotId), snapshot.SnapshotID)
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestListSnapshots(t *testing.T) {
+	testCases := []struct {
+		name           string
+		snapshotIDs    []string
+		maxEntries     int64
+		startingToken  string
+		expSnapshotIDs []string
+		expNextToken   string
+		expErr         error
+	}{
+		{
+			name:           "success: all snapshots",
+			snapshotIDs:    []string{"snap-3", "snap-1", "snap-2"},
+			expSnapshotIDs: []string{"snap-1", "snap-2", "snap-3"},
+		},
+		{
+			name:           "success: limited number of entries",
+			snapshotIDs:    []string{"snap-3", "snap-1", "snap-2"},
+			maxEntries:     2,
+			expSnapshotIDs: []string{"snap-1", "snap-2"},
+			expNextToken:   "2",
+		},
+		{
+			name:           "success: continue from starting token",
+			snapshotIDs:    []string{"snap-3", "snap-1", "snap-2"},
+			maxEntries:     2,
+			startingToken:  "2",
+			expSnapshotIDs: []string{"snap-3"},
+		},
+		{
+			name:          "fail: invalid starting token",
+			snapshotIDs:   []string{"snap-1"},
+			startingToken: "invalid-token",
+			expErr:        ErrInvalidStartingToken,
+		},
+		{
+			name:          "fail: starting token beyond the number of snapshots",
+			snapshotIDs:   []string{"snap-1"},
+			startingToken: "5",
+			expErr:        ErrInvalidStartingToken,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+		c := newCloud(mockEC2)
+
+		var ec2Snapshots []*ec2.Snapshot
+		for _, id := range tc.snapshotIDs {
+			ec2Snapshots = append(ec2Snapshots, &ec2.Snapshot{SnapshotId: aws.String(id), VolumeId: aws.String("vol-test")})
+		}
+		mockEC2.EXPECT().DescribeSnapshotsWithContext(gomock.Any(), gomock.Any()).Return(&ec2.DescribeSnapshotsOutput{Snapshots: ec2Snapshots}, nil)
+
+		snapshots, nextToken, err := c.ListSnapshots(context.Background(), tc.maxEntries, tc.startingToken, "")
+		if err != nil {
+			if err != tc.expErr {
+				t.Fatalf("ListSnapshots() failed: expected error %v, got: %v", tc.expErr, err)
+			}
+		} else {
+			if tc.expErr != nil {
+				t.Fatal("ListSnapshots() failed: expected error, got nothing")
+			}
+			if len(snapshots) != len(tc.expSnapshotIDs) {
+				t.Fatalf("ListSnapshots() failed: expected %d snapshots, got %d", len(tc.expSnapshotIDs), len(snapshots))
+			}
+			for i, snapshot := range snapshots {
+				if snapshot.SnapshotID != tc.expSnapshotIDs[i] {
+					t.Fatalf("ListSnapshots() failed: expected snapshot %q at position %d, got %q", tc.expSnapshotIDs[i], i, snapshot.SnapshotID)
+				}
+			}
+			if nextToken != tc.expNextToken {
+				t.Fatalf("ListSnapshots() failed: expected next token %q, got %q", tc.expNextToken, nextToken)
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestAttachDiskInstanceCache(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockEC2 := mocks.NewMockEC2(mockCtrl)
+	m := &metadata{instanceID: "test-instance", region: "test-region", availabilityZone: "test-az"}
+	c := newEC2Cloud(m, mockEC2, &CloudOptions{InstanceCacheTTL: time.Minute})
+
+	volumeID, nodeID := "vol-test-1234", "node-1234"
+	var requestedDevice string
+
+	// The instance is described once before attaching and once again after the
+	// attachment invalidated it, however many times it's requested
+	mockEC2.EXPECT().DescribeInstancesWithContext(gomock.Any(), gomock.Any()).Return(newDescribeInstancesOutput(nodeID), nil).Times(2)
+	mockEC2.EXPECT().AttachVolumeWithContext(gomock.Any(), gomock.Any()).Do(func(ctx aws.Context, input *ec2.AttachVolumeInput) {
+		requestedDevice = aws.StringValue(input.Device)
+	}).Return(&ec2.VolumeAttachment{}, nil)
+	mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx aws.Context, input *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+		return newDescribeVolumesOutput(volumeID, requestedDevice, nodeID, "attached"), nil
+	})
+
+	ctx := context.Background()
+	if _, err := c.getInstance(ctx, nodeID); err != nil {
+		t.Fatalf("getInstance() failed: expected no error, got: %v", err)
+	}
+	if _, err := c.AttachDisk(ctx, volumeID, nodeID); err != nil {
+		t.Fatalf("AttachDisk() failed: expected no error, got: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.getInstance(ctx, nodeID); err != nil {
+			t.Fatalf("getInstance() failed: expected no error, got: %v", err)
+		}
+	}
+
+	mockCtrl.Finish()
+}
+
+func TestAttachDiskTimeout(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	mockEC2 := mocks.NewMockEC2(mockCtrl)
+	m := &metadata{instanceID: "test-instance", region: "test-region", availabilityZone: "test-az"}
+	c := newEC2Cloud(m, mockEC2, &CloudOptions{AttachmentTimeout: 50 * time.Millisecond})
+	c.pollInterval = time.Millisecond
+
+	volumeID, nodeID := "vol-test-1234", "node-1234"
+	var requestedDevice string
+
+	// The volume never leaves the attaching state. The device stays reserved, so
+	// the retry waits for the same attachment instead of attaching it again
+	mockEC2.EXPECT().DescribeInstancesWithContext(gomock.Any(), gomock.Any()).Return(newDescribeInstancesOutput(nodeID), nil).Times(2)
+	mockEC2.EXPECT().AttachVolumeWithContext(gomock.Any(), gomock.Any()).Do(func(ctx aws.Context, input *ec2.AttachVolumeInput) {
+		requestedDevice = aws.StringValue(input.Device)
+	}).Return(&ec2.VolumeAttachment{}, nil)
+	mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx aws.Context, input *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+		return newDescribeVolumesOutput(volumeID, requestedDevice, nodeID, "attaching"), nil
+	}).AnyTimes()
+
+	for i := 0; i < 2; i++ {
+		_, err := c.AttachDisk(context.Background(), volumeID, nodeID)
+		timeoutErr, ok := err.(*AttachmentTimeoutError)
+		if !ok {
+			t.Fatalf("AttachDisk() failed: expected attachment timeout error, got: %v", err)
+		}
+		if timeoutErr.Device != requestedDevice {
+			t.Fatalf("AttachDisk() failed: expected device %q, got %q", requestedDevice, timeoutErr.Device)
+		}
+	}
+
+	mockCtrl.Finish()
+}
+
+func newCloud(mockEC2 EC2) Cloud {
+	m := &metadata{
+		instanceID:       "test-instance",
+		region:           "test-region",
+		availabilityZone: "test-az",
+	}
+	return NewCloudWithEC2(m, mockEC2)
+}
+
+func newDescribeInstancesOutput(nodeID string) *ec2.DescribeInstancesOutput {
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []*ec2.Reservation{&ec2.Reservation{
+			Instances: []*ec2.Instance{
+				&ec2.Instance{InstanceId: aws.String(nodeID)},
+			},
+		}},
+	}
+}
+
+func newDescribeVolumesOutput(volumeID, device, instanceID, state string) *ec2.DescribeVolumesOutput {
+	return &ec2.DescribeVolumesOutput{
+		Volumes: []*ec2.Volume{
+			&ec2.Volume{
+				VolumeId: aws.String(volumeID),
+				Attachments: []*ec2.VolumeAttachment{
+					&ec2.VolumeAttachment{
+						Device:     aws.String(device),
+						InstanceId: aws.String(instanceID),
+						State:      aws.String(state),
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	manyTags := map[string]string{}
+	for i := 0; i <= MaxTagsPerResource; i++ {
+		manyTags[fmt.Sprintf("key-%d", i)] = "value"
+	}
+
+	testCases := []struct {
+		name   string
+		tags   map[string]string
+		expErr bool
+	}{
+		{
+			name: "success: normal",
+			tags: map[string]string{VolumeNameTagKey: "vol-test", "team": ""},
+		},
+		{
+			name:   "fail: too many tags",
+			tags:   manyTags,
+			expErr: true,
+		},
+		{
+			name:   "fail: empty key",
+			tags:   map[string]string{"": "value"},
+			expErr: true,
+		},
+		{
+			name:   "fail: key too long",
+			tags:   map[string]string{strings.Repeat("k", MaxTagKeyLength+1): "value"},
+			expErr: true,
+		},
+		{
+			name:   "fail: value too long",
+			tags:   map[string]string{"key": strings.Repeat("v", MaxTagValueLength+1)},
+			expErr: true,
+		},
+		{
+			name:   "fail: reserved prefix",
+			tags:   map[string]string{"AWS:key": "value"},
+			expErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		err := ValidateTags(tc.tags)
+		if err != nil && !tc.expErr {
+			t.Fatalf("ValidateTags() failed: expected no error, got: %v", err)
+		}
+		if err == nil && tc.expErr {
+			t.Fatal("ValidateTags() failed: expected error, got nothing")
+		}
+	}
+}
+
+func TestValidateWaitOptions(t *testing.T) {
+	testCases := []struct {
+		name   string
+		opts   *CloudOptions
+		expErr bool
+	}{
+		{
+			name: "success: defaults",
+			opts: &CloudOptions{},
+		},
+		{
+			name: "success: custom interval and timeouts",
+			opts: &CloudOptions{PollInterval: 5 * time.Second, AttachmentTimeout: time.Minute, ModificationTimeout: time.Minute},
+		},
+		{
+			name:   "fail: interval not shorter than the attachment timeout",
+			opts:   &CloudOptions{PollInterval: time.Minute, AttachmentTimeout: time.Minute},
+			expErr: true,
+		},
+		{
+			name: "success: interval longer than the deletion timeout without waiting for deletions",
+			opts: &CloudOptions{PollInterval: time.Minute, AttachmentTimeout: 2 * time.Minute, ModificationTimeout: 2 * time.Minute, DeletionTimeout: time.Minute},
+		},
+		{
+			name:   "fail: interval not shorter than the deletion timeout",
+			opts:   &CloudOptions{PollInterval: time.Minute, AttachmentTimeout: 2 * time.Minute, ModificationTimeout: 2 * time.Minute, WaitForDeletion: true, DeletionTimeout: time.Minute},
+			expErr: true,
+		},
+		{
+			name:   "fail: interval longer than the default modification timeout",
+			opts:   &CloudOptions{PollInterval: time.Hour, AttachmentTimeout: 2 * time.Hour},
+			expErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		err := validateWaitOptions(tc.opts)
+		if err != nil && !tc.expErr {
+			t.Fatalf("validateWaitOptions() failed: expected no error, got: %v", err)
+		}
+		if err == nil && tc.expErr {
+			t.Fatal("validateWaitOptions() failed: expected error, got nothing")
+		}
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	testCases := []struct {
+		name        string
+		describeErr error
+		expErr      bool
+	}{
+		{
+			name: "success: normal",
+		},
+		{
+			name:        "fail: invalid credentials",
+			describeErr: awserr.New("AuthFailure", "", nil),
+			expErr:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2 := mocks.NewMockEC2(mockCtrl)
+
+		mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), gomock.Any()).Return(&ec2.DescribeVolumesOutput{}, tc.describeErr)
+
+		err := checkCredentials(context.Background(), mockEC2)
+		if err != nil && !tc.expErr {
+			t.Fatalf("checkCredentials() failed: expected no error, got: %v", err)
+		}
+		if err == nil && tc.expErr {
+			t.Fatal("checkCredentials() failed: expected error, got nothing")
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestAssumeRoleOptions(t *testing.T) {
+	testCases := []struct {
+		name                string
+		options             *CloudOptions
+		expectedExternalID  *string
+		expectedSessionName string
+	}{
+		{
+			name:                "success: defaults",
+			options:             &CloudOptions{AssumeRoleARN: "arn:aws:iam::123456789012:role/ebs"},
+			expectedSessionName: "default-session",
+		},
+		{
+			name: "success: external ID and session name",
+			options: &CloudOptions{
+				AssumeRoleARN:         "arn:aws:iam::123456789012:role/ebs",
+				AssumeRoleExternalID:  "external-id",
+				AssumeRoleSessionName: "ebs-csi-driver",
+			},
+			expectedExternalID:  aws.String("external-id"),
+			expectedSessionName: "ebs-csi-driver",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		p := &stscreds.AssumeRoleProvider{RoleSessionName: "default-session"}
+		assumeRoleOptions(tc.options)(p)
+
+		if aws.StringValue(p.ExternalID) != aws.StringValue(tc.expectedExternalID) {
+			t.Errorf("Unexpected external ID: expected %v, got %v", aws.StringValue(tc.expectedExternalID), aws.StringValue(p.ExternalID))
+		}
+		if p.RoleSessionName != tc.expectedSessionName {
+			t.Errorf("Unexpected session name: expected %q, got %q", tc.expectedSessionName, p.RoleSessionName)
+		}
+	}
+}
+
+func TestEC2Endpoint(t *testing.T) {
+	testCases := []struct {
+		name        string
+		options     *CloudOptions
+		region      string
+		expEndpoint string
+		expErr      bool
+	}{
+		{
+			name:        "success: default endpoint",
+			options:     &CloudOptions{},
+			region:      "eu-west-1",
+			expEndpoint: "",
+		},
+		{
+			name:        "success: custom endpoint",
+			options:     &CloudOptions{EC2Endpoint: "http://localhost:4566"},
+			region:      "eu-west-1",
+			expEndpoint: "http://localhost:4566",
+		},
+		{
+			name:        "success: FIPS endpoint",
+			options:     &CloudOptions{UseFIPSEndpoint: true},
+			region:      "us-gov-west-1",
+			expEndpoint: "https://ec2-fips.us-gov-west-1.amazonaws.com",
+		},
+		{
+			name:    "fail: no FIPS endpoint in the region",
+			options: &CloudOptions{UseFIPSEndpoint: true},
+			region:  "eu-west-1",
+			expErr:  true,
+		},
+		{
+			name:    "fail: FIPS along with a custom endpoint",
+			options: &CloudOptions{UseFIPSEndpoint: true, EC2Endpoint: "http://localhost:4566"},
+			region:  "us-east-1",
+			expErr:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		endpoint, err := ec2Endpoint(tc.options, tc.region)
+		if err != nil {
+			if !tc.expErr {
+				t.Fatalf("ec2Endpoint() failed: expected no error, got: %v", err)
+			}
+			continue
+		}
+		if tc.expErr {
+			t.Fatal("ec2Endpoint() failed: expected error, got nothing")
+		}
+		if endpoint != tc.expEndpoint {
+			t.Fatalf("Unexpected endpoint: expected %q, got %q", tc.expEndpoint, endpoint)
+		}
+
+		// The client must send its requests to the endpoint
+		if len(endpoint) != 0 {
+			client := ec2.New(session.New(&aws.Config{Region: aws.String(tc.region), Endpoint: aws.String(endpoint)}))
+			if client.Endpoint != endpoint {
+				t.Fatalf("Unexpected client endpoint: expected %q, got %q", endpoint, client.Endpoint)
+			}
+		}
 	}
 }
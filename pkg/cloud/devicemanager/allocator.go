@@ -39,17 +39,31 @@ type ExistingDevices map[string]string
 // device name reuse.
 // All these allocations are in-memory, nothing is written to / read from
 // /dev directory.
+//
+// The allocation order is a contract the device manager relies on: GetNext
+// returns the free, non-reserved suffix that was deprioritized the longest time
+// ago. Suffixes that were never deprioritized come first, in the order ba..bz,
+// ca..cz, da..dx. Deprioritize moves a suffix to the end of that order.
 type DeviceAllocator interface {
 	// GetNext returns a free device name or error when there is no free device
 	// name. Only the device suffix is returned, e.g. "ba" for "/dev/xvdba".
 	// It's up to the called to add appropriate "/dev/sd" or "/dev/xvd" prefix.
+	// GetNext doesn't change the allocation order, so calling it twice with the
+	// same existing devices returns the same suffix.
 	GetNext(existingDevices ExistingDevices) (string, error)
 
 	// Deprioritize the device so as it can't be used immediately again
 	Deprioritize(string)
+
+	// Usage returns how many of the device names the allocator can assign are
+	// in existingDevices, and how many it can assign in total.
+	Usage(existingDevices ExistingDevices) (inUse int, total int)
 }
 
 type deviceAllocator struct {
+	// devices holds the possible device names in allocation order.
+	devices         []string
+	reserved        map[string]bool
 	possibleDevices map[string]int
 	counter         int
 	deviceLock      sync.Mutex
@@ -68,23 +82,62 @@ func (p devicePairList) Len() int           { return len(p) }
 func (p devicePairList) Less(i, j int) bool { return p[i].deviceIndex < p[j].deviceIndex }
 func (p devicePairList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
-// Allocates device names according to scheme ba..bz, ca..cz
-// it moves along the ring and always picks next device until
-// device list is exhausted.
+// Allocates device names according to scheme ba..bz, ca..cz, da..dx.
+// Single letters are never picked: the root device and the instance store
+// volumes use them, and the latter aren't reported in the block device
+// mappings of the instance, so they can't be told apart from free names.
+// It moves along the ring and always picks next device until device
+// list is exhausted.
 func NewDeviceAllocator() DeviceAllocator {
-	possibleDevices := make(map[string]int)
-	for _, firstChar := range []rune{'b', 'c'} {
+	return NewDeviceAllocatorWithReserved(nil)
+}
+
+// NewDeviceAllocatorWithReserved returns a DeviceAllocator that never picks
+// the given device suffixes, e.g. "ba" for "/dev/xvdba".
+func NewDeviceAllocatorWithReserved(reservedSuffixes []string) DeviceAllocator {
+	reserved := make(map[string]bool)
+	for _, suffix := range reservedSuffixes {
+		reserved[suffix] = true
+	}
+
+	var devices []string
+	for _, firstChar := range []rune{'b', 'c', 'd'} {
 		for i := 'a'; i <= 'z'; i++ {
 			dev := string([]rune{firstChar, i})
-			possibleDevices[dev] = 0
+			devices = append(devices, dev)
+			if dev == "dx" {
+				break
+			}
 		}
 	}
+
+	possibleDevices := make(map[string]int)
+	for _, dev := range devices {
+		possibleDevices[dev] = 0
+	}
 	return &deviceAllocator{
+		devices:         devices,
+		reserved:        reserved,
 		possibleDevices: possibleDevices,
 		counter:         0,
 	}
 }
 
+// IsDeviceSuffix reports whether suffix is one of the device suffixes the
+// allocators assign, e.g. "ba" for "/dev/xvdba".
+func IsDeviceSuffix(suffix string) bool {
+	if len(suffix) != 2 || suffix[1] < 'a' || suffix[1] > 'z' {
+		return false
+	}
+	switch suffix[0] {
+	case 'b', 'c':
+		return true
+	case 'd':
+		return suffix[1] <= 'x'
+	}
+	return false
+}
+
 // GetNext gets next available device from the pool, this function assumes that caller
 // holds the necessary lock on deviceAllocator
 func (d *deviceAllocator) GetNext(existingDevices ExistingDevices) (string, error) {
@@ -92,6 +145,9 @@ func (d *deviceAllocator) GetNext(existingDevices ExistingDevices) (string, erro
 	defer d.deviceLock.Unlock()
 
 	for _, devicePair := range d.sortByCount() {
+		if d.reserved[devicePair.deviceName] {
+			continue
+		}
 		if _, found := existingDevices[devicePair.deviceName]; !found {
 			return devicePair.deviceName, nil
 		}
@@ -109,11 +165,45 @@ func (d *deviceAllocator) Deprioritize(chosen string) {
 	}
 }
 
+// Usage returns how many of the device names the allocator can assign are in use.
+func (d *deviceAllocator) Usage(existingDevices ExistingDevices) (int, int) {
+	var inUse, total int
+	for _, deviceName := range d.devices {
+		if d.reserved[deviceName] {
+			continue
+		}
+		total++
+		if _, found := existingDevices[deviceName]; found {
+			inUse++
+		}
+	}
+	return inUse, total
+}
+
+// setPriorities overrides how recently the given devices were deprioritized, the
+// higher the more recently, e.g. to set the allocator up in a known state. The
+// devices that aren't given keep their priority.
+func (d *deviceAllocator) setPriorities(priorities map[string]int) {
+	d.deviceLock.Lock()
+	defer d.deviceLock.Unlock()
+	for deviceName, priority := range priorities {
+		if _, ok := d.possibleDevices[deviceName]; !ok {
+			continue
+		}
+		d.possibleDevices[deviceName] = priority
+		if priority > d.counter {
+			d.counter = priority
+		}
+	}
+}
+
+// sortByCount returns the devices sorted by how recently they were used,
+// keeping the allocation order between devices that were never used.
 func (d *deviceAllocator) sortByCount() devicePairList {
-	dpl := make(devicePairList, 0)
-	for deviceName, deviceIndex := range d.possibleDevices {
-		dpl = append(dpl, devicePair{deviceName, deviceIndex})
+	dpl := make(devicePairList, 0, len(d.devices))
+	for _, deviceName := range d.devices {
+		dpl = append(dpl, devicePair{deviceName, d.possibleDevices[deviceName]})
 	}
-	sort.Sort(dpl)
+	sort.Stable(dpl)
 	return dpl
 }
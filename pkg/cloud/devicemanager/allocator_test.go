@@ -31,15 +31,31 @@ func TestDeviceAllocator(t *testing.T) {
 			"empty device list with wrap",
 			ExistingDevices{},
 			generateUnsortedDeviceList(),
-			"bd", // next to 'cz' is the first one, 'ba'
+			"bd", // next to 'dx' is the first one, 'ba'
+		},
+		{
+			"first device",
+			ExistingDevices{},
+			map[string]int{},
+			"ba",
+		},
+		{
+			"recently used devices are skipped",
+			ExistingDevices{},
+			map[string]int{"ba": 1, "bb": 1},
+			"bc",
+		},
+		{
+			"devices in use are skipped",
+			ExistingDevices{"ba": "used", "bb": "used"},
+			map[string]int{},
+			"bc",
 		},
 	}
 
 	for _, test := range tests {
 		allocator := NewDeviceAllocator().(*deviceAllocator)
-		for k, v := range test.deviceMap {
-			allocator.possibleDevices[k] = v
-		}
+		allocator.setPriorities(test.deviceMap)
 
 		got, err := allocator.GetNext(test.existingDevices)
 		if err != nil {
@@ -53,27 +69,193 @@ func TestDeviceAllocator(t *testing.T) {
 
 func generateUnsortedDeviceList() map[string]int {
 	possibleDevices := make(map[string]int)
-	for _, firstChar := range []rune{'b', 'c'} {
-		for i := 'a'; i <= 'z'; i++ {
-			dev := string([]rune{firstChar, i})
-			possibleDevices[dev] = 3
-		}
+	for _, dev := range NewDeviceAllocator().(*deviceAllocator).devices {
+		possibleDevices[dev] = 3
 	}
 	possibleDevices["bd"] = 0
 	return possibleDevices
 }
 
+func TestDeviceAllocatorRollover(t *testing.T) {
+	allocator := NewDeviceAllocator()
+	existingDevices := ExistingDevices{}
+
+	// Names are handed out from 'ba' to 'cz' first, then extend up to 'dx'
+	var devices []string
+	for {
+		device, err := allocator.GetNext(existingDevices)
+		if err != nil {
+			break
+		}
+		if len(device) != 2 {
+			t.Fatalf("expected two-letter device, got %q", device)
+		}
+		existingDevices[device] = "used"
+		allocator.Deprioritize(device)
+		devices = append(devices, device)
+	}
+	if len(devices) != 76 {
+		t.Fatalf("expected 76 devices, got %d", len(devices))
+	}
+	for i, expected := range map[int]string{0: "ba", 25: "bz", 26: "ca", 51: "cz", 52: "da", 75: "dx"} {
+		if devices[i] != expected {
+			t.Fatalf("expected device %d to be %q, got %q", i, expected, devices[i])
+		}
+	}
+}
+
+func TestDeviceAllocatorOrdering(t *testing.T) {
+	type step struct {
+		// deprioritize is deprioritized before getting the next device, if set
+		deprioritize    string
+		existingDevices ExistingDevices
+		expectedOutput  string
+	}
+
+	tests := []struct {
+		name       string
+		priorities map[string]int
+		steps      []step
+	}{
+		{
+			name: "next device is stable until deprioritized",
+			steps: []step{
+				{existingDevices: ExistingDevices{}, expectedOutput: "ba"},
+				{existingDevices: ExistingDevices{}, expectedOutput: "ba"},
+				{deprioritize: "ba", existingDevices: ExistingDevices{}, expectedOutput: "bb"},
+			},
+		},
+		{
+			name: "freed device goes after never used ones",
+			steps: []step{
+				{deprioritize: "ba", existingDevices: ExistingDevices{"ba": "used"}, expectedOutput: "bb"},
+				{deprioritize: "bb", existingDevices: ExistingDevices{"ba": "used", "bb": "used"}, expectedOutput: "bc"},
+				// "ba" is detached, but "bc" was never used
+				{existingDevices: ExistingDevices{"bb": "used"}, expectedOutput: "bc"},
+			},
+		},
+		{
+			name:       "least recently deprioritized device is reused first",
+			priorities: allDevicePriorities(5),
+			steps: []step{
+				{deprioritize: "cc", existingDevices: ExistingDevices{}, expectedOutput: "ba"},
+				{deprioritize: "ba", existingDevices: ExistingDevices{}, expectedOutput: "bb"},
+				{deprioritize: "bb", existingDevices: ExistingDevices{"bc": "used"}, expectedOutput: "bd"},
+			},
+		},
+		{
+			name:       "in use devices are skipped whatever their priority",
+			priorities: map[string]int{"ba": 1, "bb": 2},
+			steps: []step{
+				{existingDevices: ExistingDevices{"bc": "used", "bd": "used"}, expectedOutput: "be"},
+			},
+		},
+		{
+			name:       "unknown devices are ignored",
+			priorities: map[string]int{"a": 1, "zz": 1},
+			steps: []step{
+				{deprioritize: "zz", existingDevices: ExistingDevices{}, expectedOutput: "ba"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		allocator := NewDeviceAllocator().(*deviceAllocator)
+		allocator.setPriorities(test.priorities)
+		for i, step := range test.steps {
+			if len(step.deprioritize) != 0 {
+				allocator.Deprioritize(step.deprioritize)
+			}
+			got, err := allocator.GetNext(step.existingDevices)
+			if err != nil {
+				t.Fatalf("test %q, step %d: unexpected error: %v", test.name, i, err)
+			}
+			if got != step.expectedOutput {
+				t.Fatalf("test %q, step %d: expected %q, got %q", test.name, i, step.expectedOutput, got)
+			}
+		}
+	}
+}
+
+// allDevicePriorities returns the same priority for all the devices.
+func allDevicePriorities(priority int) map[string]int {
+	priorities := make(map[string]int)
+	for _, dev := range NewDeviceAllocator().(*deviceAllocator).devices {
+		priorities[dev] = priority
+	}
+	return priorities
+}
+
+func TestDeviceAllocatorReserved(t *testing.T) {
+	tests := []struct {
+		name             string
+		reservedSuffixes []string
+		expectedOutput   string
+	}{
+		{
+			"no reserved suffixes",
+			nil,
+			"ba",
+		},
+		{
+			"custom reserved suffixes",
+			[]string{"ba", "bb", "bc"},
+			"bd",
+		},
+	}
+
+	for _, test := range tests {
+		allocator := NewDeviceAllocatorWithReserved(test.reservedSuffixes)
+		got, err := allocator.GetNext(ExistingDevices{})
+		if err != nil {
+			t.Errorf("text %q: unexpected error: %v", test.name, err)
+		}
+		if got != test.expectedOutput {
+			t.Errorf("text %q: expected %q, got %q", test.name, test.expectedOutput, got)
+		}
+	}
+}
+
+func TestDeviceAllocatorUsage(t *testing.T) {
+	tests := []struct {
+		name             string
+		reservedSuffixes []string
+		existingDevices  ExistingDevices
+		expectedInUse    int
+		expectedTotal    int
+	}{
+		{
+			"no devices in use",
+			nil,
+			ExistingDevices{},
+			0,
+			76,
+		},
+		{
+			"devices the allocator can't assign aren't counted",
+			[]string{"ba"},
+			ExistingDevices{"a": "root", "ba": "vol-1", "bb": "vol-2", "cz": "vol-3"},
+			2,
+			75,
+		},
+	}
+
+	for _, test := range tests {
+		allocator := NewDeviceAllocatorWithReserved(test.reservedSuffixes)
+		inUse, total := allocator.Usage(test.existingDevices)
+		if inUse != test.expectedInUse || total != test.expectedTotal {
+			t.Errorf("test %q: expected %d of %d devices in use, got %d of %d", test.name, test.expectedInUse, test.expectedTotal, inUse, total)
+		}
+	}
+}
+
 func TestDeviceAllocatorError(t *testing.T) {
 	allocator := NewDeviceAllocator().(*deviceAllocator)
 	existingDevices := ExistingDevices{}
 
 	// make all devices used
-	var first, second byte
-	for first = 'b'; first <= 'c'; first++ {
-		for second = 'a'; second <= 'z'; second++ {
-			device := [2]byte{first, second}
-			existingDevices[string(device[:])] = "used"
-		}
+	for _, device := range allocator.devices {
+		existingDevices[device] = "used"
 	}
 
 	device, err := allocator.GetNext(existingDevices)
@@ -81,3 +263,24 @@ func TestDeviceAllocatorError(t *testing.T) {
 		t.Errorf("expected error, got device  %q", device)
 	}
 }
+
+func TestIsDeviceSuffix(t *testing.T) {
+	tests := []struct {
+		suffix   string
+		expected bool
+	}{
+		{"ba", true},
+		{"cz", true},
+		{"dx", true},
+		{"dy", false},
+		{"a", false},
+		{"xvdba", false},
+		{"bA", false},
+	}
+
+	for _, test := range tests {
+		if got := IsDeviceSuffix(test.suffix); got != test.expected {
+			t.Errorf("suffix %q: expected %v, got %v", test.suffix, test.expected, got)
+		}
+	}
+}
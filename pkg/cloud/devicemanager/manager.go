@@ -23,10 +23,23 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/golang/glog"
+	"github.com/bertinatto/ebs-csi-driver/pkg/metrics"
+	"k8s.io/klog"
 )
 
-const devicePreffix = "/dev/xvd"
+const (
+	// DevicePrefixXVD is the prefix of devices named like /dev/xvdba.
+	DevicePrefixXVD = "/dev/xvd"
+
+	// DevicePrefixSD is the prefix of devices named like /dev/sdba.
+	DevicePrefixSD = "/dev/sd"
+
+	// DefaultDevicePrefix is the prefix used when none is given.
+	DefaultDevicePrefix = DevicePrefixXVD
+
+	// rootDeviceVolumeID marks the root device as in use when its volume is unknown.
+	rootDeviceVolumeID = "root"
+)
 
 type BlockDevice struct {
 	Instance          *ec2.Instance
@@ -41,7 +54,7 @@ type BlockDevice struct {
 func (d *BlockDevice) Release(force bool) {
 	if !d.isTainted || force {
 		if err := d.releaseFunc(); err != nil {
-			glog.Errorf("Error releasing device: %v", err)
+			klog.Errorf("Error releasing device: %v", err)
 		}
 	}
 }
@@ -68,16 +81,60 @@ type blockDeviceManager struct {
 	// attached, to avoid a race condition where we assign a device mapping
 	// and then get a second request before we attach the volume.
 	mux       sync.Mutex
-	attaching map[string]map[string]string
+	attaching Attachments
+
+	// devicePrefix is prepended to the allocated device suffixes, e.g. "/dev/xvd".
+	devicePrefix string
+
+	// reservedSuffixes are the device suffixes that are never allocated.
+	reservedSuffixes []string
+
+	// store persists the attachments in progress, if set. The attachments
+	// restored from it are kept in restored, and their devices held in
+	// attaching, until EC2 reports them in the block device mappings of
+	// their node.
+	store    AttachmentStore
+	restored Attachments
 }
 
 var _ BlockDeviceManager = &blockDeviceManager{}
 
-func NewBlockDeviceManager() BlockDeviceManager {
+// NewBlockDeviceManager returns a BlockDeviceManager that names the devices it
+// assigns with the given prefix, either DevicePrefixXVD or DevicePrefixSD.
+// DefaultDevicePrefix is used if the prefix is empty. The reserved suffixes,
+// e.g. "ba" for "/dev/xvdba", are never assigned.
+func NewBlockDeviceManager(devicePrefix string, reservedSuffixes []string) BlockDeviceManager {
+	if len(devicePrefix) == 0 {
+		devicePrefix = DefaultDevicePrefix
+	}
 	return &blockDeviceManager{
 		deviceAllocators: make(map[string]DeviceAllocator),
-		attaching:        make(map[string]map[string]string),
+		attaching:        make(Attachments),
+		devicePrefix:     devicePrefix,
+		reservedSuffixes: reservedSuffixes,
+		restored:         Attachments{},
+	}
+}
+
+// NewBlockDeviceManagerWithStore returns a BlockDeviceManager like NewBlockDeviceManager,
+// which also writes the attachments in progress through to the given store and restores
+// them from it.
+//
+// An AttachVolume call issued before the restart may still be in flight, so the devices
+// of the restored attachments are held like the ones of the attachments in progress,
+// until EC2 reports them in the block device mappings of their node, either attached to
+// their volume, which confirms the attachment, or to another volume, which means the
+// attachment was dropped. They're also released like the others, e.g. by DetachDisk.
+func NewBlockDeviceManagerWithStore(devicePrefix string, reservedSuffixes []string, store AttachmentStore) (BlockDeviceManager, error) {
+	restored, err := store.Load()
+	if err != nil {
+		return nil, fmt.Errorf("could not load attachments: %v", err)
 	}
+
+	d := NewBlockDeviceManager(devicePrefix, reservedSuffixes).(*blockDeviceManager)
+	d.store = store
+	d.restored = restored
+	return d, nil
 }
 
 func (d *blockDeviceManager) newBlockDevice(instance *ec2.Instance, volumeID string, path string, isAlreadyAssigned bool) *BlockDevice {
@@ -116,19 +173,17 @@ func (d *blockDeviceManager) NewBlockDevice(instance *ec2.Instance, volumeID str
 	}
 
 	// Find the next unused device name
-	deviceAllocator := d.deviceAllocators[nodeID]
-	if deviceAllocator == nil {
-		deviceAllocator = NewDeviceAllocator()
-		d.deviceAllocators[nodeID] = deviceAllocator
-	}
-
-	suffix, err := deviceAllocator.GetNext(deviceMappings)
+	deviceAllocator := d.getDeviceAllocator(nodeID)
+	existingDevices := toExistingDevices(deviceMappings)
+	suffix, err := deviceAllocator.GetNext(existingDevices)
 	if err != nil {
-		glog.Warningf("Could not assign a mount device.  mappings=%v, error: %v", deviceMappings, err)
+		klog.Warningf("Could not assign a mount device.  mappings=%v, error: %v", deviceMappings, err)
+		metrics.DeviceAllocationFailures.WithLabelValues(nodeID).Inc()
+		observeDeviceUsage(nodeID, deviceAllocator, existingDevices)
 		return nil, fmt.Errorf("too many EBS volumes attached to node %s", nodeID)
 	}
 
-	path := devicePreffix + suffix
+	path := d.devicePrefix + suffix
 
 	// Add the chosen device and volume to the "attachments in progress" map
 	attaching := d.attaching[nodeID]
@@ -137,10 +192,13 @@ func (d *blockDeviceManager) NewBlockDevice(instance *ec2.Instance, volumeID str
 		d.attaching[nodeID] = attaching
 	}
 	attaching[path] = volumeID
-	glog.V(5).Infof("Assigned mount device %s to volume %s", path, volumeID)
+	klog.V(5).Infof("Assigned mount device %s to volume %s", path, volumeID)
 
 	// Deprioritize this suffix so it's not picked again right away.
 	deviceAllocator.Deprioritize(suffix)
+	d.persist()
+	existingDevices[suffix] = volumeID
+	observeDeviceUsage(nodeID, deviceAllocator, existingDevices)
 
 	return d.newBlockDevice(instance, volumeID, path, false), nil
 }
@@ -159,6 +217,8 @@ func (d *blockDeviceManager) GetBlockDevice(instance *ec2.Instance, volumeID str
 		return nil, fmt.Errorf("could not get devices used in instance %q", nodeID)
 	}
 
+	observeDeviceUsage(nodeID, d.getDeviceAllocator(nodeID), toExistingDevices(inUse))
+
 	path := d.getPath(inUse, volumeID)
 	device := d.newBlockDevice(instance, volumeID, path, false)
 
@@ -179,9 +239,12 @@ func (d *blockDeviceManager) release(device *BlockDevice) error {
 	d.mux.Lock()
 	defer d.mux.Unlock()
 
+	// Devices already attached, e.g. when AttachDisk finds the volume attached,
+	// were never added to the attachments in progress
 	existingVolumeID, found := d.attaching[nodeID][device.Path]
 	if !found {
-		return fmt.Errorf("release called for disk %q when attach not in progress", device.VolumeID)
+		klog.V(5).Infof("Attachment of volume %s at %s not in progress, nothing to release", device.VolumeID, device.Path)
+		return nil
 	}
 
 	if device.VolumeID != existingVolumeID {
@@ -192,28 +255,143 @@ func (d *blockDeviceManager) release(device *BlockDevice) error {
 		return fmt.Errorf("release on device %q assigned to different volume: %q vs %q", device.Path, device.VolumeID, existingVolumeID)
 	}
 
-	glog.V(5).Infof("Releasing in-process attachment entry: %s -> volume %s", device, device.VolumeID)
+	klog.V(5).Infof("Releasing in-process attachment entry: %s -> volume %s", device.Path, device.VolumeID)
 	delete(d.attaching[nodeID], device.Path)
+	if d.restored[nodeID][device.Path] == device.VolumeID {
+		delete(d.restored[nodeID], device.Path)
+	}
+	d.persist()
 
 	return nil
 }
 
+func (d *blockDeviceManager) getDeviceAllocator(nodeID string) DeviceAllocator {
+	deviceAllocator := d.deviceAllocators[nodeID]
+	if deviceAllocator == nil {
+		deviceAllocator = NewDeviceAllocatorWithReserved(d.reservedSuffixes)
+		d.deviceAllocators[nodeID] = deviceAllocator
+	}
+	return deviceAllocator
+}
+
+// observeDeviceUsage updates the metrics of the device names in use on the node.
+// They're only updated when the devices of the node are looked up: release can't
+// tell whether the attachment of the released device went through.
+func observeDeviceUsage(nodeID string, deviceAllocator DeviceAllocator, existingDevices ExistingDevices) {
+	inUse, total := deviceAllocator.Usage(existingDevices)
+	metrics.DevicesInUse.WithLabelValues(nodeID).Set(float64(inUse))
+	metrics.DevicesAllocatable.WithLabelValues(nodeID).Set(float64(total))
+}
+
+// reconcile holds the devices of the attachments restored for the node that
+// EC2 doesn't report yet, and forgets about the ones it reports, either
+// attached to their volume or to another one. This function assumes that
+// the caller holds the lock.
+func (d *blockDeviceManager) reconcile(instance *ec2.Instance, nodeID string) {
+	restored := d.restored[nodeID]
+	if len(restored) == 0 {
+		delete(d.restored, nodeID)
+		return
+	}
+
+	mapped := map[string]string{}
+	for _, blockDevice := range instance.BlockDeviceMappings {
+		if blockDevice.Ebs == nil {
+			continue
+		}
+		mapped[trimDevicePrefix(aws.StringValue(blockDevice.DeviceName))] = aws.StringValue(blockDevice.Ebs.VolumeId)
+	}
+
+	attaching := d.attaching[nodeID]
+	if attaching == nil {
+		attaching = make(map[string]string)
+		d.attaching[nodeID] = attaching
+	}
+
+	deviceAllocator := d.getDeviceAllocator(nodeID)
+	for path, volumeID := range restored {
+		suffix := trimDevicePrefix(path)
+		mappedVolumeID, found := mapped[suffix]
+		if !found {
+			// The attachment may still be in flight, so its device must not be reused
+			if _, held := attaching[path]; !held {
+				klog.V(4).Infof("Holding device %s of restored attachment of volume %s to node %s", path, volumeID, nodeID)
+				attaching[path] = volumeID
+				deviceAllocator.Deprioritize(suffix)
+			}
+			continue
+		}
+
+		if mappedVolumeID == volumeID {
+			klog.V(4).Infof("Restored attachment of volume %s to node %s at %s confirmed by EC2", volumeID, nodeID, path)
+		} else {
+			klog.V(4).Infof("Restored attachment of volume %s to node %s dropped, EC2 reports volume %s at %s", volumeID, nodeID, mappedVolumeID, path)
+		}
+		delete(restored, path)
+		if attaching[path] == volumeID {
+			delete(attaching, path)
+		}
+	}
+
+	if len(restored) == 0 {
+		delete(d.restored, nodeID)
+	}
+	d.persist()
+}
+
+// persist saves the attachments in progress, including the restored ones
+// not reconciled yet, if a store is set. This function assumes that the
+// caller holds the lock.
+func (d *blockDeviceManager) persist() {
+	if d.store == nil {
+		return
+	}
+
+	attachments := Attachments{}
+	for _, all := range []Attachments{d.restored, d.attaching} {
+		for nodeID, devices := range all {
+			if len(devices) == 0 {
+				continue
+			}
+			if attachments[nodeID] == nil {
+				attachments[nodeID] = map[string]string{}
+			}
+			for path, volumeID := range devices {
+				attachments[nodeID][path] = volumeID
+			}
+		}
+	}
+
+	if err := d.store.Save(attachments); err != nil {
+		klog.Warningf("Could not save attachments in progress: %v", err)
+	}
+}
+
+// getDevicesInUse returns the full paths of the devices attached and being
+// attached to the node, e.g. "/dev/xvdba", mapped to the IDs of their volumes.
 func (d *blockDeviceManager) getDevicesInUse(instance *ec2.Instance, nodeID string) (map[string]string, error) {
+	d.reconcile(instance, nodeID)
+
 	deviceMappings := map[string]string{}
 	for _, blockDevice := range instance.BlockDeviceMappings {
-		name := aws.StringValue(blockDevice.DeviceName)
-		if strings.HasPrefix(name, "/dev/sd") {
-			name = name[7:]
+		if blockDevice.Ebs == nil {
+			continue
 		}
-		if strings.HasPrefix(name, "/dev/xvd") {
-			name = name[8:]
-		}
-		if len(name) < 1 || len(name) > 2 {
-			glog.Warningf("Unexpected EBS DeviceName: %q", aws.StringValue(blockDevice.DeviceName))
+		name := aws.StringValue(blockDevice.DeviceName)
+		if suffix := trimDevicePrefix(name); len(suffix) < 1 || len(suffix) > 2 {
+			klog.Warningf("Unexpected EBS DeviceName: %q", name)
 		}
 		deviceMappings[name] = aws.StringValue(blockDevice.Ebs.VolumeId)
 	}
 
+	// The root device is permanently in use, even when it's not in the block device
+	// mappings. Its name may refer to a partition, e.g. "/dev/sda1" for "/dev/sda".
+	if root := strings.TrimRight(aws.StringValue(instance.RootDeviceName), "0123456789"); len(root) != 0 {
+		if _, found := deviceMappings[root]; !found {
+			deviceMappings[root] = rootDeviceVolumeID
+		}
+	}
+
 	for device, volume := range d.attaching[nodeID] {
 		deviceMappings[device] = volume
 	}
@@ -230,6 +408,28 @@ func (d *blockDeviceManager) getPath(deviceMappings map[string]string, volumeID
 	return ""
 }
 
+// toExistingDevices returns the devices in use keyed by their suffixes, as
+// expected by the DeviceAllocator. Names with different prefixes but the same
+// suffix, e.g. "/dev/sdba" and "/dev/xvdba", refer to the same device.
+func toExistingDevices(devicesInUse map[string]string) ExistingDevices {
+	existing := ExistingDevices{}
+	for path, volumeID := range devicesInUse {
+		existing[trimDevicePrefix(path)] = volumeID
+	}
+	return existing
+}
+
+// trimDevicePrefix returns the suffix of the device name, e.g. "ba" for "/dev/xvdba".
+func trimDevicePrefix(name string) string {
+	if strings.HasPrefix(name, DevicePrefixSD) {
+		return name[len(DevicePrefixSD):]
+	}
+	if strings.HasPrefix(name, DevicePrefixXVD) {
+		return name[len(DevicePrefixXVD):]
+	}
+	return name
+}
+
 func getInstanceID(instance *ec2.Instance) (string, error) {
 	if instance == nil {
 		return "", fmt.Errorf("can't get ID from a nil instance")
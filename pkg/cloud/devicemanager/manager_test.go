@@ -17,6 +17,7 @@ limitations under the License.
 package devicemanager
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -54,7 +55,7 @@ func TestNewBlockDevice(t *testing.T) {
 		},
 	}
 	// Use a shared BlockDeviceManager to make sure that there are no race conditions
-	dm := NewBlockDeviceManager()
+	dm := NewBlockDeviceManager("", nil)
 
 	for _, tc := range testCases {
 		tc := tc // capture tc
@@ -114,7 +115,7 @@ func TestGetBlockDevice(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			dm := NewBlockDeviceManager()
+			dm := NewBlockDeviceManager("", nil)
 			fakeInstance := newFakeInstance(tc.instanceID, tc.existingVolumeID, tc.existingDevicePath)
 
 			// Should create valid BlockDevice with valid path
@@ -148,7 +149,7 @@ func TestReleaseBlockDevice(t *testing.T) {
 		},
 	}
 
-	dm := NewBlockDeviceManager()
+	dm := NewBlockDeviceManager("", nil)
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			fakeInstance := newFakeInstance(tc.instanceID, tc.existingVolumeID, tc.existingDevicePath)
@@ -172,6 +173,23 @@ func TestReleaseBlockDevice(t *testing.T) {
 	}
 }
 
+func TestReleaseAlreadyAttachedBlockDevice(t *testing.T) {
+	dm := NewBlockDeviceManager("", nil).(*blockDeviceManager)
+	fakeInstance := newFakeInstance("instance-1", "vol-1", "/dev/xvdbc")
+
+	newDev, err := dm.NewBlockDevice(fakeInstance, "vol-1")
+	assertBlockDevice(t, newDev, true /*IsAlreadyAssigned*/, err)
+	if err := dm.release(newDev); err != nil {
+		t.Fatalf("Expected no error releasing already attached device, got: %v", err)
+	}
+
+	getDev, err := dm.GetBlockDevice(fakeInstance, "vol-1")
+	assertBlockDevice(t, getDev, true /*IsAlreadyAssigned*/, err)
+	if err := dm.release(getDev); err != nil {
+		t.Fatalf("Expected no error releasing already attached device, got: %v", err)
+	}
+}
+
 func TestExaustBlockDevices(t *testing.T) {
 	testCases := []struct {
 		name               string
@@ -189,7 +207,7 @@ func TestExaustBlockDevices(t *testing.T) {
 		},
 	}
 
-	dm := NewBlockDeviceManager()
+	dm := NewBlockDeviceManager("", nil)
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			fakeInstance := newFakeInstance(tc.instanceID, tc.existingVolumeID, tc.existingDevicePath)
@@ -199,9 +217,9 @@ func TestExaustBlockDevices(t *testing.T) {
 			assertBlockDevice(t, dev, false /*IsAlreadyAssigned*/, err)
 			dev.Release(true)
 
-			// The maximum number of the ring is 52, so create enough devices
-			// to circle back to the first device gotten, i.e., dev
-			for i := 0; i < 51; i++ {
+			// Create enough devices to circle back to the first device gotten, i.e., dev
+			ringSize := len(NewDeviceAllocator().(*deviceAllocator).devices)
+			for i := 0; i < ringSize-1; i++ {
 				d, err := dm.NewBlockDevice(fakeInstance, tc.volumeID)
 				assertBlockDevice(t, d, false, err)
 				// Make sure none of them have the same path as the first device created
@@ -222,6 +240,135 @@ func TestExaustBlockDevices(t *testing.T) {
 	}
 }
 
+func TestNewBlockDeviceAlreadyAttached(t *testing.T) {
+	testCases := []struct {
+		name               string
+		devicePrefix       string
+		existingDevicePath string
+	}{
+		{
+			name:               "success: xvd device",
+			existingDevicePath: "/dev/xvdbc",
+		},
+		{
+			name:               "success: sd device with xvd prefix",
+			existingDevicePath: "/dev/sdbc",
+		},
+		{
+			name:               "success: sd device with sd prefix",
+			devicePrefix:       DevicePrefixSD,
+			existingDevicePath: "/dev/sdbc",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dm := NewBlockDeviceManager(tc.devicePrefix, nil)
+			fakeInstance := newFakeInstance("instance-1", "vol-1", tc.existingDevicePath)
+
+			// The full path of the attached device should be returned
+			dev, err := dm.NewBlockDevice(fakeInstance, "vol-1")
+			assertBlockDevice(t, dev, true /*IsAlreadyAssigned*/, err)
+			if dev.Path != tc.existingDevicePath {
+				t.Fatalf("Expected path %q, got %q", tc.existingDevicePath, dev.Path)
+			}
+
+			dev, err = dm.GetBlockDevice(fakeInstance, "vol-1")
+			assertBlockDevice(t, dev, true /*IsAlreadyAssigned*/, err)
+			if dev.Path != tc.existingDevicePath {
+				t.Fatalf("Expected path %q, got %q", tc.existingDevicePath, dev.Path)
+			}
+
+			// The suffix of the attached device shouldn't be assigned to another volume
+			dev, err = dm.NewBlockDevice(fakeInstance, "vol-2")
+			assertBlockDevice(t, dev, false /*IsAlreadyAssigned*/, err)
+			if strings.HasSuffix(dev.Path, "bc") {
+				t.Fatalf("Expected device path different from the one in use, got %q", dev.Path)
+			}
+		})
+	}
+}
+
+func TestNewBlockDevicePrefix(t *testing.T) {
+	testCases := []struct {
+		name         string
+		devicePrefix string
+		expPrefix    string
+	}{
+		{
+			name:         "success: default prefix",
+			devicePrefix: "",
+			expPrefix:    DevicePrefixXVD,
+		},
+		{
+			name:         "success: sd prefix",
+			devicePrefix: DevicePrefixSD,
+			expPrefix:    DevicePrefixSD,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dm := NewBlockDeviceManager(tc.devicePrefix, nil)
+			fakeInstance := newFakeInstance("instance-1", "vol-1", "/dev/sdbc")
+
+			dev, err := dm.NewBlockDevice(fakeInstance, "vol-2")
+			assertBlockDevice(t, dev, false /*IsAlreadyAssigned*/, err)
+			if !strings.HasPrefix(dev.Path, tc.expPrefix) {
+				t.Fatalf("Expected device path with prefix %q, got %q", tc.expPrefix, dev.Path)
+			}
+			if dev.Path == tc.expPrefix+"bc" {
+				t.Fatalf("Expected device path different from the one in use, got %q", dev.Path)
+			}
+		})
+	}
+}
+
+func TestNewBlockDeviceRootDevice(t *testing.T) {
+	testCases := []struct {
+		name           string
+		rootDeviceName string
+		mappedDevice   string
+	}{
+		{
+			name:           "success: root device mapped",
+			rootDeviceName: "/dev/xvdba",
+			mappedDevice:   "/dev/xvdba",
+		},
+		{
+			name:           "success: root device partition not mapped",
+			rootDeviceName: "/dev/xvdba1",
+			mappedDevice:   "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dm := NewBlockDeviceManager("", nil)
+
+			fakeInstance := newFakeInstance("instance-1", "vol-root", tc.mappedDevice)
+			fakeInstance.RootDeviceName = aws.String(tc.rootDeviceName)
+
+			dev, err := dm.NewBlockDevice(fakeInstance, "vol-2")
+			assertBlockDevice(t, dev, false /*IsAlreadyAssigned*/, err)
+			if dev.Path == "/dev/xvdba" {
+				t.Fatalf("Expected root device not to be assigned, got %q", dev.Path)
+			}
+		})
+	}
+}
+
+func TestNewBlockDeviceReserved(t *testing.T) {
+	dm := NewBlockDeviceManager("", []string{"ba", "bb"})
+	fakeInstance := newFakeInstance("instance-1", "vol-1", "/dev/xvdbc")
+
+	dev, err := dm.NewBlockDevice(fakeInstance, "vol-2")
+	assertBlockDevice(t, dev, false /*IsAlreadyAssigned*/, err)
+	if dev.Path != "/dev/xvdbd" {
+		t.Fatalf("Expected the first device not reserved nor in use %q, got %q", "/dev/xvdbd", dev.Path)
+	}
+}
+
 func newFakeInstance(instanceID, volumeID, devicePath string) *ec2.Instance {
 	return &ec2.Instance{
 		InstanceId: aws.String(instanceID),
@@ -0,0 +1,90 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package devicemanager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Attachments maps node IDs to the devices being attached to them,
+// and each device to the ID of the volume being attached.
+type Attachments map[string]map[string]string
+
+// AttachmentStore persists the attachments in progress so that device
+// reservations survive restarts of the driver.
+type AttachmentStore interface {
+	// Load returns the attachments saved last, or nothing if none were saved.
+	Load() (Attachments, error)
+
+	// Save replaces the saved attachments.
+	Save(attachments Attachments) error
+}
+
+type fileAttachmentStore struct {
+	path string
+}
+
+var _ AttachmentStore = &fileAttachmentStore{}
+
+// NewFileAttachmentStore returns an AttachmentStore that keeps the
+// attachments as JSON in the file at path.
+func NewFileAttachmentStore(path string) AttachmentStore {
+	return &fileAttachmentStore{path: path}
+}
+
+func (s *fileAttachmentStore) Load() (Attachments, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Attachments{}, nil
+		}
+		return nil, err
+	}
+
+	attachments := Attachments{}
+	if err := json.Unmarshal(data, &attachments); err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+func (s *fileAttachmentStore) Save(attachments Attachments) error {
+	data, err := json.Marshal(attachments)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, so that the file is never left half-written
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
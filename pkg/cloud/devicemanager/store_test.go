@@ -0,0 +1,186 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package devicemanager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestFileAttachmentStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-attachments")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileAttachmentStore(filepath.Join(dir, "attachments.json"))
+
+	// Nothing saved yet
+	attachments, err := store.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(attachments) != 0 {
+		t.Fatalf("Expected no attachments, got %v", attachments)
+	}
+
+	expAttachments := Attachments{"instance-1": {"/dev/xvdb": "vol-1"}}
+	if err := store.Save(expAttachments); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	attachments, err = store.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(attachments, expAttachments) {
+		t.Fatalf("Expected attachments %v, got %v", expAttachments, attachments)
+	}
+}
+
+func TestBlockDeviceManagerWithStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-attachments")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileAttachmentStore(filepath.Join(dir, "attachments.json"))
+	fakeInstance := newFakeInstance("instance-1", "vol-1", "/dev/xvdbz")
+
+	dm, err := NewBlockDeviceManagerWithStore("", nil, store)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The reservation must be written through to the store
+	dev, err := dm.NewBlockDevice(fakeInstance, "vol-2")
+	assertBlockDevice(t, dev, false /*IsAlreadyAssigned*/, err)
+	assertAttachments(t, store, Attachments{"instance-1": {dev.Path: "vol-2"}})
+
+	// Releasing must remove the reservation from the store
+	dev.Release(false)
+	assertAttachments(t, store, Attachments{})
+}
+
+func TestBlockDeviceManagerRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-attachments")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileAttachmentStore(filepath.Join(dir, "attachments.json"))
+	fakeInstance := newFakeInstance("instance-1", "vol-1", "/dev/xvdbz")
+
+	dm, err := NewBlockDeviceManagerWithStore("", nil, store)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The driver restarts while vol-2 and vol-3 are being attached
+	dev2, err := dm.NewBlockDevice(fakeInstance, "vol-2")
+	assertBlockDevice(t, dev2, false /*IsAlreadyAssigned*/, err)
+	dev3, err := dm.NewBlockDevice(fakeInstance, "vol-3")
+	assertBlockDevice(t, dev3, false /*IsAlreadyAssigned*/, err)
+
+	restartedDM, err := NewBlockDeviceManagerWithStore("", nil, store)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The devices of the attachments in flight must be held for their volumes
+	dev, err := restartedDM.NewBlockDevice(fakeInstance, "vol-2")
+	assertBlockDevice(t, dev, true /*IsAlreadyAssigned*/, err)
+	if dev.Path != dev2.Path {
+		t.Fatalf("Expected restored device %q, got %q", dev2.Path, dev.Path)
+	}
+	for i := 0; i < len(NewDeviceAllocator().(*deviceAllocator).devices)-4; i++ {
+		dev, err := restartedDM.NewBlockDevice(fakeInstance, fmt.Sprintf("vol-new-%d", i))
+		assertBlockDevice(t, dev, false /*IsAlreadyAssigned*/, err)
+		if dev.Path == dev2.Path || dev.Path == dev3.Path {
+			t.Fatalf("Expected a device different from the restored ones, got %q", dev.Path)
+		}
+		dev.Release(true)
+	}
+
+	// EC2 confirms the attachment of vol-2 and reports another volume at the device of
+	// vol-3, whose attachment was dropped, so both are forgotten about
+	fakeInstance.BlockDeviceMappings = append(fakeInstance.BlockDeviceMappings,
+		&ec2.InstanceBlockDeviceMapping{
+			DeviceName: aws.String(dev2.Path),
+			Ebs:        &ec2.EbsInstanceBlockDevice{VolumeId: aws.String("vol-2")},
+		},
+		&ec2.InstanceBlockDeviceMapping{
+			DeviceName: aws.String(dev3.Path),
+			Ebs:        &ec2.EbsInstanceBlockDevice{VolumeId: aws.String("vol-4")},
+		},
+		// Mappings of instance store volumes have no EBS details
+		&ec2.InstanceBlockDeviceMapping{
+			DeviceName: aws.String("/dev/xvdb"),
+		},
+	)
+	dev, err = restartedDM.GetBlockDevice(fakeInstance, "vol-3")
+	assertBlockDevice(t, dev, false /*IsAlreadyAssigned*/, err)
+	assertAttachments(t, store, Attachments{})
+}
+
+func TestBlockDeviceManagerRestartRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-attachments")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileAttachmentStore(filepath.Join(dir, "attachments.json"))
+	fakeInstance := newFakeInstance("instance-1", "vol-1", "/dev/xvdbz")
+	if err := store.Save(Attachments{"instance-1": {"/dev/xvdba": "vol-2"}}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	dm, err := NewBlockDeviceManagerWithStore("", nil, store)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Detaching the volume of a restored attachment releases its device for good
+	dev, err := dm.GetBlockDevice(fakeInstance, "vol-2")
+	assertBlockDevice(t, dev, true /*IsAlreadyAssigned*/, err)
+	dev.Release(true)
+	assertAttachments(t, store, Attachments{})
+
+	dev, err = dm.GetBlockDevice(fakeInstance, "vol-2")
+	assertBlockDevice(t, dev, false /*IsAlreadyAssigned*/, err)
+}
+
+func assertAttachments(t *testing.T, store AttachmentStore, expAttachments Attachments) {
+	attachments, err := store.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(attachments, expAttachments) {
+		t.Fatalf("Expected attachments %v, got %v", expAttachments, attachments)
+	}
+}
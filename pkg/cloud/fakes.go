@@ -17,15 +17,58 @@ limitations under the License.
 package cloud
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"sort"
 	"time"
 
 	"github.com/bertinatto/ebs-csi-driver/pkg/util"
 )
 
 type FakeCloudProvider struct {
-	disks map[string]*fakeDisk
+	// Metadata is returned by GetMetadata, tests may change its values.
+	Metadata *FakeMetadata
+
+	// AttachErr is returned by AttachDisk, if set.
+	AttachErr error
+
+	// CreateDiskZoneErrs are returned by CreateDisk for the volumes
+	// created in the zones they're keyed by.
+	CreateDiskZoneErrs map[string]error
+
+	// SnapshotOptions holds the options of the last CreateSnapshot call.
+	SnapshotOptions *SnapshotOptions
+
+	disks     map[string]*fakeDisk
+	snapshots map[string]*fakeSnapshot
+}
+
+// FakeMetadata is a MetadataService returning fixed values, to test
+// code that depends on the instance metadata off EC2.
+type FakeMetadata struct {
+	InstanceID       string
+	Region           string
+	AvailabilityZone string
+	InstanceType     string
+}
+
+var _ MetadataService = &FakeMetadata{}
+
+func (m *FakeMetadata) GetInstanceID() string {
+	return m.InstanceID
+}
+
+func (m *FakeMetadata) GetRegion() string {
+	return m.Region
+}
+
+func (m *FakeMetadata) GetAvailabilityZone() string {
+	return m.AvailabilityZone
+}
+
+func (m *FakeMetadata) GetInstanceType() string {
+	return m.InstanceType
 }
 
 type fakeDisk struct {
@@ -33,22 +76,43 @@ type fakeDisk struct {
 	tags map[string]string
 }
 
+type fakeSnapshot struct {
+	*Snapshot
+	tags map[string]string
+}
+
 func NewFakeCloudProvider() *FakeCloudProvider {
 	return &FakeCloudProvider{
-		disks: make(map[string]*fakeDisk),
+		Metadata: &FakeMetadata{
+			InstanceID:       "instanceID",
+			Region:           "region",
+			AvailabilityZone: "az",
+			InstanceType:     "m5.large",
+		},
+		disks:     make(map[string]*fakeDisk),
+		snapshots: make(map[string]*fakeSnapshot),
 	}
 }
 
 func (c *FakeCloudProvider) GetMetadata() MetadataService {
-	return &metadata{"instanceID", "region", "az"}
+	return c.Metadata
 }
 
-func (c *FakeCloudProvider) CreateDisk(volumeName string, diskOptions *DiskOptions) (*Disk, error) {
+func (c *FakeCloudProvider) CreateDisk(ctx context.Context, volumeName string, diskOptions *DiskOptions) (*Disk, error) {
 	r1 := rand.New(rand.NewSource(time.Now().UnixNano()))
+	zone := diskOptions.AvailabilityZone
+	if len(zone) == 0 {
+		zone = c.GetMetadata().GetAvailabilityZone()
+	}
+	if err := c.CreateDiskZoneErrs[zone]; err != nil {
+		return nil, err
+	}
 	d := &fakeDisk{
 		Disk: &Disk{
-			VolumeID:    fmt.Sprintf("vol-%d", r1.Uint64()),
-			CapacityGiB: util.BytesToGiB(diskOptions.CapacityBytes),
+			VolumeID:         fmt.Sprintf("vol-%d", r1.Uint64()),
+			CapacityGiB:      util.RoundUpGiB(diskOptions.CapacityBytes),
+			AvailabilityZone: zone,
+			SnapshotID:       diskOptions.SnapshotID,
 		},
 		tags: diskOptions.Tags,
 	}
@@ -56,7 +120,7 @@ func (c *FakeCloudProvider) CreateDisk(volumeName string, diskOptions *DiskOptio
 	return d.Disk, nil
 }
 
-func (c *FakeCloudProvider) DeleteDisk(volumeID string) (bool, error) {
+func (c *FakeCloudProvider) DeleteDisk(ctx context.Context, volumeID string) (bool, error) {
 	for volName, f := range c.disks {
 		if f.Disk.VolumeID == volumeID {
 			delete(c.disks, volName)
@@ -65,15 +129,18 @@ func (c *FakeCloudProvider) DeleteDisk(volumeID string) (bool, error) {
 	return true, nil
 }
 
-func (c *FakeCloudProvider) AttachDisk(volumeID, nodeID string) (string, error) {
+func (c *FakeCloudProvider) AttachDisk(ctx context.Context, volumeID, nodeID string) (string, error) {
+	if c.AttachErr != nil {
+		return "", c.AttachErr
+	}
 	return "/dev/xvdbc", nil
 }
 
-func (c *FakeCloudProvider) DetachDisk(volumeID, nodeID string) error {
+func (c *FakeCloudProvider) DetachDisk(ctx context.Context, volumeID, nodeID string) error {
 	return nil
 }
 
-func (c *FakeCloudProvider) GetDisk(name string, capacityBytes int64) (*Disk, error) {
+func (c *FakeCloudProvider) GetDiskByNameAndSize(ctx context.Context, name string, capacityBytes int64) (*Disk, error) {
 	var disks []*fakeDisk
 	for _, d := range c.disks {
 		for key, value := range d.tags {
@@ -85,10 +152,129 @@ func (c *FakeCloudProvider) GetDisk(name string, capacityBytes int64) (*Disk, er
 	if len(disks) > 1 {
 		return nil, ErrMultiDisks
 	} else if len(disks) == 1 {
-		if capacityBytes != disks[0].Disk.CapacityGiB*1024*1024*1024 {
+		if util.RoundUpGiB(capacityBytes) > disks[0].Disk.CapacityGiB {
 			return nil, ErrDiskExistsDiffSize
 		}
 		return disks[0].Disk, nil
 	}
 	return nil, nil
 }
+
+func (c *FakeCloudProvider) GetDiskByID(ctx context.Context, volumeID string) (*Disk, error) {
+	for _, f := range c.disks {
+		if f.Disk.VolumeID == volumeID {
+			return f.Disk, nil
+		}
+	}
+	return nil, ErrVolumeNotFound
+}
+
+func (c *FakeCloudProvider) GetDisksByIDs(ctx context.Context, volumeIDs []string) (map[string]*Disk, error) {
+	disks := make(map[string]*Disk)
+	for _, volumeID := range volumeIDs {
+		for _, f := range c.disks {
+			if f.Disk.VolumeID == volumeID {
+				disks[volumeID] = f.Disk
+			}
+		}
+	}
+	return disks, nil
+}
+
+func (c *FakeCloudProvider) ListDisks(ctx context.Context, maxEntries int64, startingToken string) ([]*Disk, string, error) {
+	var disks []*Disk
+	for _, f := range c.disks {
+		disks = append(disks, f.Disk)
+	}
+	sort.Slice(disks, func(i, j int) bool {
+		return disks[i].VolumeID < disks[j].VolumeID
+	})
+
+	start, end, nextToken, err := paginate(int64(len(disks)), maxEntries, startingToken)
+	if err != nil {
+		return nil, "", err
+	}
+	return disks[start:end], nextToken, nil
+}
+
+func (c *FakeCloudProvider) ResizeDisk(ctx context.Context, volumeID string, newSizeBytes int64) (int64, error) {
+	for _, f := range c.disks {
+		if f.Disk.VolumeID == volumeID {
+			if newSizeGiB := util.RoundUpGiB(newSizeBytes); newSizeGiB > f.Disk.CapacityGiB {
+				f.Disk.CapacityGiB = newSizeGiB
+			}
+			return f.Disk.CapacityGiB, nil
+		}
+	}
+	return 0, ErrVolumeNotFound
+}
+
+func (c *FakeCloudProvider) CreateSnapshot(ctx context.Context, volumeID string, snapshotOptions *SnapshotOptions) (*Snapshot, error) {
+	c.SnapshotOptions = snapshotOptions
+	r1 := rand.New(rand.NewSource(time.Now().UnixNano()))
+	snapshotID := fmt.Sprintf("snapshot-%d", r1.Uint64())
+
+	var size int64
+	for _, d := range c.disks {
+		if d.Disk.VolumeID == volumeID {
+			size = d.Disk.CapacityGiB
+		}
+	}
+
+	s := &fakeSnapshot{
+		Snapshot: &Snapshot{
+			SnapshotID:     snapshotID,
+			SourceVolumeID: volumeID,
+			Size:           size,
+			CreationTime:   time.Now(),
+			ReadyToUse:     true,
+		},
+		tags: snapshotOptions.Tags,
+	}
+	c.snapshots[snapshotID] = s
+	return s.Snapshot, nil
+}
+
+func (c *FakeCloudProvider) DeleteSnapshot(ctx context.Context, snapshotID string) (bool, error) {
+	if _, ok := c.snapshots[snapshotID]; !ok {
+		return false, ErrSnapshotNotFound
+	}
+	delete(c.snapshots, snapshotID)
+	return true, nil
+}
+
+func (c *FakeCloudProvider) GetSnapshotByName(ctx context.Context, name string) (*Snapshot, error) {
+	var snapshots []*fakeSnapshot
+	for _, s := range c.snapshots {
+		for key, value := range s.tags {
+			if key == SnapshotNameTagKey && value == name {
+				snapshots = append(snapshots, s)
+			}
+		}
+	}
+	if len(snapshots) > 1 {
+		return nil, ErrMultiSnapshots
+	} else if len(snapshots) == 0 {
+		return nil, ErrSnapshotNotFound
+	}
+	return snapshots[0].Snapshot, nil
+}
+
+func (c *FakeCloudProvider) GetSnapshotByID(ctx context.Context, snapshotID string) (*Snapshot, error) {
+	s, ok := c.snapshots[snapshotID]
+	if !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	return s.Snapshot, nil
+}
+
+func (c *FakeCloudProvider) ListSnapshots(ctx context.Context, maxEntries int64, startingToken string, sourceVolumeID string) ([]*Snapshot, string, error) {
+	var snapshots []*Snapshot
+	for _, s := range c.snapshots {
+		if len(sourceVolumeID) != 0 && s.Snapshot.SourceVolumeID != sourceVolumeID {
+			continue
+		}
+		snapshots = append(snapshots, s.Snapshot)
+	}
+	return paginateSnapshots(snapshots, maxEntries, startingToken)
+}
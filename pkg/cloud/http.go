@@ -0,0 +1,90 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// metadataRequestTimeout bounds each request sent to the instance metadata
+// service, like the SDK does when it builds the metadata client itself.
+const metadataRequestTimeout = 5 * time.Second
+
+// newTransport returns an HTTP transport with the same settings as
+// http.DefaultTransport, sending the requests through the given proxy.
+func newTransport(proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// newHTTPClient returns the HTTP client of the AWS API requests, which go
+// through the proxy set by the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables, if any. If caBundle isn't empty, it's the PEM file
+// of the certificate authorities trusted instead of the system ones, e.g.
+// the private CA of a VPC endpoint.
+func newHTTPClient(caBundle string) (*http.Client, error) {
+	transport := newTransport(http.ProxyFromEnvironment)
+	if len(caBundle) != 0 {
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA bundle: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("could not parse any certificate from CA bundle %q", caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// newMetadataHTTPClient returns the HTTP client of the instance metadata
+// requests. The metadata service is link-local, so it's never reached through
+// a proxy, whether NO_PROXY lists it or not.
+func newMetadataHTTPClient() *http.Client {
+	return &http.Client{
+		Timeout:   metadataRequestTimeout,
+		Transport: newTransport(nil),
+	}
+}
+
+// userAgentHandler appends userAgent to the User-Agent header of the AWS API
+// requests, so that the driver can be told apart in CloudTrail.
+func userAgentHandler(userAgent string) request.NamedHandler {
+	return request.NamedHandler{
+		Name: "ebscsi.UserAgentHandler",
+		Fn:   request.MakeAddToUserAgentFreeFormHandler(userAgent),
+	}
+}
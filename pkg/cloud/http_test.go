@@ -0,0 +1,177 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestHTTPClientProxy(t *testing.T) {
+	testCases := []struct {
+		name     string
+		client   *http.Client
+		expProxy bool
+	}{
+		{
+			name:     "success: AWS API requests go through the proxy",
+			client:   mustNewHTTPClient(t, ""),
+			expProxy: true,
+		},
+		{
+			name:     "success: metadata requests bypass the proxy",
+			client:   newMetadataHTTPClient(),
+			expProxy: false,
+		},
+		{
+			name:     "success: metadata client bypasses the proxy",
+			client:   newEC2MetadataClient(session.New()).Config.HTTPClient,
+			expProxy: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		transport, ok := tc.client.Transport.(*http.Transport)
+		if !ok {
+			t.Fatalf("Expected an *http.Transport, got %T", tc.client.Transport)
+		}
+		if hasProxy := transport.Proxy != nil; hasProxy != tc.expProxy {
+			t.Fatalf("Expected proxy %v, got %v", tc.expProxy, hasProxy)
+		}
+	}
+}
+
+func TestHTTPClientCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ca-bundle")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverCA := filepath.Join(dir, "server.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(serverCA, certPEM, 0600); err != nil {
+		t.Fatalf("Could not write CA bundle: %v", err)
+	}
+	invalidCA := filepath.Join(dir, "invalid.pem")
+	if err := ioutil.WriteFile(invalidCA, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("Could not write CA bundle: %v", err)
+	}
+
+	testCases := []struct {
+		name          string
+		caBundle      string
+		expClientErr  bool
+		expRequestErr bool
+	}{
+		{
+			name:     "success: server trusted through the CA bundle",
+			caBundle: serverCA,
+		},
+		{
+			name:          "fail: server not trusted by the system CAs",
+			caBundle:      "",
+			expRequestErr: true,
+		},
+		{
+			name:         "fail: CA bundle without certificates",
+			caBundle:     invalidCA,
+			expClientErr: true,
+		},
+		{
+			name:         "fail: CA bundle doesn't exist",
+			caBundle:     filepath.Join(dir, "missing.pem"),
+			expClientErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		client, err := newHTTPClient(tc.caBundle)
+		if err != nil {
+			if !tc.expClientErr {
+				t.Fatalf("newHTTPClient() failed: expected no error, got: %v", err)
+			}
+			continue
+		}
+		if tc.expClientErr {
+			t.Fatal("newHTTPClient() failed: expected error, got nothing")
+		}
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			if !tc.expRequestErr {
+				t.Fatalf("Get() failed: expected no error, got: %v", err)
+			}
+			continue
+		}
+		resp.Body.Close()
+		if tc.expRequestErr {
+			t.Fatal("Get() failed: expected error, got nothing")
+		}
+	}
+}
+
+func TestUserAgentHandler(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		w.Write([]byte("<DescribeVolumesResponse></DescribeVolumesResponse>"))
+	}))
+	defer server.Close()
+
+	sess := session.New(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	sess.Handlers.Build.PushBackNamed(userAgentHandler("ebs.csi.aws.com/v0.1.0 test"))
+
+	if _, err := ec2.New(sess).DescribeVolumes(&ec2.DescribeVolumesInput{}); err != nil {
+		t.Fatalf("DescribeVolumes() failed: expected no error, got: %v", err)
+	}
+	if !strings.HasSuffix(userAgent, " ebs.csi.aws.com/v0.1.0 test") {
+		t.Fatalf("Expected user agent ending with the driver's, got %q", userAgent)
+	}
+	if !strings.HasPrefix(userAgent, aws.SDKName) {
+		t.Fatalf("Expected user agent starting with the SDK's, got %q", userAgent)
+	}
+}
+
+func mustNewHTTPClient(t *testing.T, caBundle string) *http.Client {
+	client, err := newHTTPClient(caBundle)
+	if err != nil {
+		t.Fatalf("newHTTPClient() failed: %v", err)
+	}
+	return client
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// instanceCache holds the instances described recently, so that attaching
+// and detaching volumes doesn't describe the instance every time.
+type instanceCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	instances map[string]cachedInstance
+}
+
+type cachedInstance struct {
+	instance  *ec2.Instance
+	expiresAt time.Time
+}
+
+// newInstanceCache returns a cache whose entries expire after ttl.
+// Nothing is cached if ttl isn't positive.
+func newInstanceCache(ttl time.Duration) *instanceCache {
+	return &instanceCache{
+		ttl:       ttl,
+		instances: make(map[string]cachedInstance),
+	}
+}
+
+// get returns the cached instance, if it hasn't expired yet.
+func (c *instanceCache) get(nodeID string) (*ec2.Instance, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.instances[nodeID]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(cached.expiresAt) {
+		delete(c.instances, nodeID)
+		return nil, false
+	}
+	return cached.instance, true
+}
+
+func (c *instanceCache) set(nodeID string, instance *ec2.Instance) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.instances[nodeID] = cachedInstance{instance: instance, expiresAt: time.Now().Add(c.ttl)}
+}
+
+// invalidate forgets the instance, e.g. after a volume was attached to or
+// detached from it, so that its block device mappings are described again.
+func (c *instanceCache) invalidate(nodeID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.instances, nodeID)
+}
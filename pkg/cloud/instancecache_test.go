@@ -0,0 +1,78 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestInstanceCache(t *testing.T) {
+	instance := &ec2.Instance{InstanceId: aws.String("node-1234")}
+
+	testCases := []struct {
+		name       string
+		ttl        time.Duration
+		wait       time.Duration
+		invalidate bool
+		expCached  bool
+	}{
+		{
+			name:      "success: cached",
+			ttl:       time.Minute,
+			expCached: true,
+		},
+		{
+			name:      "success: caching disabled",
+			ttl:       0,
+			expCached: false,
+		},
+		{
+			name:      "success: expired",
+			ttl:       time.Millisecond,
+			wait:      5 * time.Millisecond,
+			expCached: false,
+		},
+		{
+			name:       "success: invalidated",
+			ttl:        time.Minute,
+			invalidate: true,
+			expCached:  false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		cache := newInstanceCache(tc.ttl)
+		cache.set("node-1234", instance)
+		time.Sleep(tc.wait)
+		if tc.invalidate {
+			cache.invalidate("node-1234")
+		}
+
+		cached, ok := cache.get("node-1234")
+		if ok != tc.expCached {
+			t.Fatalf("Expected cached %v, got %v", tc.expCached, ok)
+		}
+		if ok && cached != instance {
+			t.Fatalf("Expected cached instance %v, got %v", instance, cached)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"strings"
+)
+
+const (
+	// maxVolumesXen is the number of EBS volumes that can be attached to
+	// instances built on the Xen hypervisor, besides the root volume.
+	maxVolumesXen int64 = 39
+
+	// maxVolumesNitro is the number of EBS volumes that can be attached to
+	// Nitro instances. Nitro instances share 28 attachments between EBS
+	// volumes and network interfaces, including the root volume and the
+	// primary network interface, so a couple more interfaces are left room for.
+	maxVolumesNitro int64 = 25
+)
+
+// xenInstanceFamilies are the instance families built on the Xen hypervisor.
+// Any other family is assumed to be built on Nitro, whose limit is the lowest.
+var xenInstanceFamilies = map[string]bool{
+	"c1": true, "c3": true, "c4": true,
+	"cc2": true, "cr1": true,
+	"d2": true,
+	"f1": true,
+	"g2": true, "g3": true, "g3s": true,
+	"h1": true, "hs1": true,
+	"i2": true, "i3": true,
+	"m1": true, "m2": true, "m3": true, "m4": true,
+	"p2": true, "p3": true,
+	"r3": true, "r4": true,
+	"t1": true, "t2": true,
+	"x1": true, "x1e": true,
+}
+
+// MaxVolumesPerInstance returns how many EBS volumes can be attached to an
+// instance of the given type, e.g. "m5.large", on top of its root volume.
+func MaxVolumesPerInstance(instanceType string) int64 {
+	parts := strings.SplitN(instanceType, ".", 2)
+	// Bare metal instances are built on Nitro regardless of their family
+	if len(parts) == 2 && xenInstanceFamilies[parts[0]] && !strings.HasPrefix(parts[1], "metal") {
+		return maxVolumesXen
+	}
+	return maxVolumesNitro
+}
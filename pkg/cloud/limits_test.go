@@ -0,0 +1,67 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"testing"
+)
+
+func TestMaxVolumesPerInstance(t *testing.T) {
+	testCases := []struct {
+		name         string
+		instanceType string
+		expLimit     int64
+	}{
+		{
+			name:         "xen instance",
+			instanceType: "m4.xlarge",
+			expLimit:     maxVolumesXen,
+		},
+		{
+			name:         "nitro instance",
+			instanceType: "m5.large",
+			expLimit:     maxVolumesNitro,
+		},
+		{
+			name:         "bare metal instance of a xen family",
+			instanceType: "i3.metal",
+			expLimit:     maxVolumesNitro,
+		},
+		{
+			name:         "nitro variant of a xen family",
+			instanceType: "p3dn.24xlarge",
+			expLimit:     maxVolumesNitro,
+		},
+		{
+			name:         "unknown instance",
+			instanceType: "zz9.large",
+			expLimit:     maxVolumesNitro,
+		},
+		{
+			name:         "empty instance type",
+			instanceType: "",
+			expLimit:     maxVolumesNitro,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		if limit := MaxVolumesPerInstance(tc.instanceType); limit != tc.expLimit {
+			t.Fatalf("Expected limit %d for %q, got %d", tc.expLimit, tc.instanceType, limit)
+		}
+	}
+}
@@ -17,9 +17,32 @@ limitations under the License.
 package cloud
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	// metadataTokenTTL is the lifetime requested for IMDSv2 session tokens.
+	metadataTokenTTL = 6 * time.Hour
+
+	// metadataTokenHeader is the header carrying the IMDSv2 session token.
+	metadataTokenHeader = "X-aws-ec2-metadata-token"
+
+	// metadataTokenTTLHeader is the header carrying the requested token lifetime.
+	metadataTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
 )
 
 type EC2Metadata interface {
@@ -32,12 +55,14 @@ type MetadataService interface {
 	GetInstanceID() string
 	GetRegion() string
 	GetAvailabilityZone() string
+	GetInstanceType() string
 }
 
 type metadata struct {
 	instanceID       string
 	region           string
 	availabilityZone string
+	instanceType     string
 }
 
 var _ MetadataService = &metadata{}
@@ -57,32 +82,199 @@ func (m *metadata) GetAvailabilityZone() string {
 	return m.availabilityZone
 }
 
+// GetInstanceType returns the type of the instance, e.g. "m5.large".
+func (m *metadata) GetInstanceType() string {
+	return m.instanceType
+}
+
+// invalidMetadataError is returned when the metadata service answered with an
+// invalid instance identity document. Unlike the metadata service being
+// unreachable or failing, e.g. while the instance boots or when it's throttled,
+// asking again won't help.
+type invalidMetadataError string
+
+func (e invalidMetadataError) Error() string {
+	return string(e)
+}
+
 // NewMetadataService returns a new MetadataServiceImplementation.
 func NewMetadataService(svc EC2Metadata) (MetadataService, error) {
 	if !svc.Available() {
-		return nil, fmt.Errorf("EC2 instance metadata is not available")
+		return nil, fmt.Errorf("EC2 instance metadata is not available; when running in a container, make sure the instance metadata hop limit is at least 2")
 	}
 
 	doc, err := svc.GetInstanceIdentityDocument()
 	if err != nil {
-		return nil, fmt.Errorf("could not get EC2 instance identity metadata")
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "SerializationError" {
+			return nil, invalidMetadataError(fmt.Sprintf("could not decode EC2 instance identity metadata: %v", err))
+		}
+		return nil, fmt.Errorf("could not get EC2 instance identity metadata: %v", err)
 	}
 
 	if len(doc.InstanceID) == 0 {
-		return nil, fmt.Errorf("could not get valid EC2 instance ID")
+		return nil, invalidMetadataError("could not get valid EC2 instance ID")
 	}
 
 	if len(doc.Region) == 0 {
-		return nil, fmt.Errorf("could not get valid EC2 region")
+		return nil, invalidMetadataError("could not get valid EC2 region")
 	}
 
 	if len(doc.AvailabilityZone) == 0 {
-		return nil, fmt.Errorf("could not get valid EC2 availavility zone")
+		return nil, invalidMetadataError("could not get valid EC2 availavility zone")
 	}
 
 	return &metadata{
 		instanceID:       doc.InstanceID,
 		region:           doc.Region,
 		availabilityZone: doc.AvailabilityZone,
+		instanceType:     doc.InstanceType,
 	}, nil
 }
+
+// getMetadataService returns the instance metadata with its region replaced by the
+// one given in the options, if any. Fetching the metadata is retried, since the
+// metadata service may take a while to answer right after the instance boots,
+// until the context is done. An invalid identity document isn't retried. The
+// vendored SDK doesn't report the status code of the failed requests, so a
+// missing document can't be told apart from throttling and is retried too.
+// When it isn't available, e.g. when running the controller service outside of
+// EC2, only the given region is used if the metadata is optional, falling back
+// to sharedRegion, the one of the AWS environment variables or shared config
+// file; otherwise, an error is returned.
+func getMetadataService(ctx context.Context, svc EC2Metadata, opts *CloudOptions, sharedRegion string) (MetadataService, error) {
+	var (
+		m           MetadataService
+		metadataErr error
+	)
+	err := wait.ExponentialBackoff(metadataBackoff, func() (bool, error) {
+		m, metadataErr = newMetadataServiceWithContext(ctx, svc)
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if _, ok := metadataErr.(invalidMetadataError); ok {
+			return false, metadataErr
+		}
+		if metadataErr != nil {
+			klog.Warningf("Could not get metadata, retrying: %v", metadataErr)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		if !opts.MetadataOptional {
+			return nil, fmt.Errorf("could not get metadata from AWS: %v", metadataErr)
+		}
+		region := opts.Region
+		if len(region) == 0 {
+			region = sharedRegion
+		}
+		if len(region) == 0 {
+			return nil, fmt.Errorf("could not get metadata from AWS and no region was provided: %v", metadataErr)
+		}
+		klog.Warningf("Could not get metadata from AWS, using region %q: %v", region, metadataErr)
+		return &metadata{region: region}, nil
+	}
+
+	if len(opts.Region) == 0 {
+		return m, nil
+	}
+
+	return &metadata{
+		instanceID:       m.GetInstanceID(),
+		region:           opts.Region,
+		availabilityZone: m.GetAvailabilityZone(),
+		instanceType:     m.GetInstanceType(),
+	}, nil
+}
+
+// newMetadataServiceWithContext is like NewMetadataService, but gives up once the
+// context is done. The metadata client calls don't take a context, so they're
+// left running in the background if they hang.
+func newMetadataServiceWithContext(ctx context.Context, svc EC2Metadata) (MetadataService, error) {
+	type result struct {
+		m   MetadataService
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		m, err := NewMetadataService(svc)
+		done <- result{m: m, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.m, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("could not get EC2 instance metadata: %v", ctx.Err())
+	}
+}
+
+// newEC2MetadataClient returns an EC2 metadata client that authenticates its
+// requests with IMDSv2 session tokens, falling back to IMDSv1 requests when
+// a token can't be obtained. The requests never go through a proxy.
+func newEC2MetadataClient(p client.ConfigProvider) *ec2metadata.EC2Metadata {
+	svc := ec2metadata.New(p, aws.NewConfig().WithHTTPClient(newMetadataHTTPClient()))
+	tokens := &metadataTokenProvider{
+		endpoint: svc.Endpoint,
+		client:   svc.Config.HTTPClient,
+	}
+	svc.Handlers.Sign.PushBack(tokens.sign)
+	return svc
+}
+
+// metadataTokenProvider fetches and caches IMDSv2 session tokens.
+type metadataTokenProvider struct {
+	endpoint string
+	client   *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// sign adds a session token to the metadata request. Requests are sent
+// without a token if none can be obtained, e.g. from an IMDSv1-only service.
+func (p *metadataTokenProvider) sign(r *request.Request) {
+	token, err := p.getToken()
+	if err != nil {
+		klog.V(4).Infof("Could not get IMDSv2 token, falling back to IMDSv1: %v", err)
+		return
+	}
+	r.HTTPRequest.Header.Set(metadataTokenHeader, token)
+}
+
+// getToken returns the cached session token, requesting a new one if it's about to expire.
+func (p *metadataTokenProvider) getToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.token) != 0 && time.Now().Before(p.expiresAt) {
+		return p.token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, p.endpoint+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(metadataTokenTTLHeader, strconv.Itoa(int(metadataTokenTTL.Seconds())))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %q requesting token", resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	p.token = string(body)
+	// Refresh the token a bit before it actually expires
+	p.expiresAt = time.Now().Add(metadataTokenTTL - time.Minute)
+	return p.token, nil
+}
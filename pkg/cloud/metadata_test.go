@@ -17,18 +17,26 @@ limitations under the License.
 package cloud
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/bertinatto/ebs-csi-driver/pkg/cloud/mocks"
 	"github.com/golang/mock/gomock"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 var (
 	stdInstanceID       = "instance-1"
 	stdRegion           = "instance-1"
 	stdAvailabilityZone = "az-1"
+	stdInstanceType     = "m5.large"
 )
 
 func TestNewMetadataService(t *testing.T) {
@@ -46,6 +54,7 @@ func TestNewMetadataService(t *testing.T) {
 				InstanceID:       stdInstanceID,
 				Region:           stdRegion,
 				AvailabilityZone: stdAvailabilityZone,
+				InstanceType:     stdInstanceType,
 			},
 			err: nil,
 		},
@@ -131,6 +140,10 @@ func TestNewMetadataService(t *testing.T) {
 			if m.GetAvailabilityZone() != tc.identityDocument.AvailabilityZone {
 				t.Fatalf("GetAvailabilityZone() failed: expected %v, got %v", tc.identityDocument.AvailabilityZone, m.GetAvailabilityZone())
 			}
+
+			if m.GetInstanceType() != tc.identityDocument.InstanceType {
+				t.Fatalf("GetInstanceType() failed: expected %v, got %v", tc.identityDocument.InstanceType, m.GetInstanceType())
+			}
 		} else {
 			if err == nil {
 				t.Fatal("NewMetadataService() failed: expected error when GetInstanceIdentityDocument returns partial data, got nothing")
@@ -140,3 +153,245 @@ func TestNewMetadataService(t *testing.T) {
 		mockCtrl.Finish()
 	}
 }
+
+func TestGetMetadataService(t *testing.T) {
+	testCases := []struct {
+		name             string
+		unavailableTimes int
+		// invalidDoc makes the metadata service return a document without region
+		invalidDoc       bool
+		region           string
+		sharedRegion     string
+		metadataOptional bool
+		expRegion        string
+		expInstanceID    string
+		expErr           bool
+	}{
+		{
+			name:          "success: region from metadata",
+			region:        "",
+			expRegion:     stdRegion,
+			expInstanceID: stdInstanceID,
+		},
+		{
+			name:          "success: region overrides metadata",
+			region:        "us-west-2",
+			expRegion:     "us-west-2",
+			expInstanceID: stdInstanceID,
+		},
+		{
+			name:             "success: metadata available after retrying",
+			unavailableTimes: 2,
+			region:           "us-west-2",
+			metadataOptional: true,
+			expRegion:        "us-west-2",
+			expInstanceID:    stdInstanceID,
+		},
+		{
+			name:             "success: metadata optional and not available but region provided",
+			unavailableTimes: 3,
+			region:           "us-west-2",
+			metadataOptional: true,
+			expRegion:        "us-west-2",
+			expInstanceID:    "",
+		},
+		{
+			name:             "success: metadata optional and not available but shared region found",
+			unavailableTimes: 3,
+			sharedRegion:     "eu-west-1",
+			metadataOptional: true,
+			expRegion:        "eu-west-1",
+			expInstanceID:    "",
+		},
+		{
+			name:          "success: metadata region preferred over shared region",
+			sharedRegion:  "eu-west-1",
+			expRegion:     stdRegion,
+			expInstanceID: stdInstanceID,
+		},
+		{
+			name:             "fail: metadata required and not available",
+			unavailableTimes: 3,
+			region:           "us-west-2",
+			expErr:           true,
+		},
+		{
+			name:       "fail: invalid document isn't retried",
+			invalidDoc: true,
+			expErr:     true,
+		},
+		{
+			name:             "fail: metadata optional and not available and no region provided",
+			unavailableTimes: 3,
+			region:           "",
+			metadataOptional: true,
+			expErr:           true,
+		},
+	}
+
+	defer func(backoff wait.Backoff) { metadataBackoff = backoff }(metadataBackoff)
+	metadataBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2Metadata := mocks.NewMockEC2Metadata(mockCtrl)
+
+		// Every attempt is expected before giving up
+		if tc.unavailableTimes > 0 {
+			mockEC2Metadata.EXPECT().Available().Return(false).Times(tc.unavailableTimes)
+		}
+		if tc.unavailableTimes < metadataBackoff.Steps {
+			doc := ec2metadata.EC2InstanceIdentityDocument{
+				InstanceID:       stdInstanceID,
+				Region:           stdRegion,
+				AvailabilityZone: stdAvailabilityZone,
+			}
+			if tc.invalidDoc {
+				doc.Region = ""
+			}
+			mockEC2Metadata.EXPECT().Available().Return(true)
+			mockEC2Metadata.EXPECT().GetInstanceIdentityDocument().Return(doc, nil)
+		}
+
+		m, err := getMetadataService(context.Background(), mockEC2Metadata, &CloudOptions{Region: tc.region, MetadataOptional: tc.metadataOptional}, tc.sharedRegion)
+		if err != nil {
+			if !tc.expErr {
+				t.Fatalf("getMetadataService() failed: expected no error, got %v", err)
+			}
+		} else {
+			if tc.expErr {
+				t.Fatal("getMetadataService() failed: expected error, got nothing")
+			}
+			if m.GetRegion() != tc.expRegion {
+				t.Fatalf("GetRegion() failed: expected %v, got %v", tc.expRegion, m.GetRegion())
+			}
+			if m.GetInstanceID() != tc.expInstanceID {
+				t.Fatalf("GetInstanceID() failed: expected %v, got %v", tc.expInstanceID, m.GetInstanceID())
+			}
+		}
+
+		mockCtrl.Finish()
+	}
+}
+
+func TestGetMetadataServiceTimeout(t *testing.T) {
+	testCases := []struct {
+		name             string
+		metadataOptional bool
+		expErr           bool
+	}{
+		{
+			name:             "success: metadata optional falls back to the region",
+			metadataOptional: true,
+		},
+		{
+			name:   "fail: metadata required",
+			expErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mockCtrl := gomock.NewController(t)
+		mockEC2Metadata := mocks.NewMockEC2Metadata(mockCtrl)
+
+		// The metadata service hangs until the test is over
+		release := make(chan struct{})
+		mockEC2Metadata.EXPECT().Available().DoAndReturn(func() bool {
+			<-release
+			return false
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		m, err := getMetadataService(ctx, mockEC2Metadata, &CloudOptions{Region: "us-west-2", MetadataOptional: tc.metadataOptional}, "")
+		if err != nil {
+			if !tc.expErr {
+				t.Fatalf("getMetadataService() failed: expected no error, got %v", err)
+			}
+		} else {
+			if tc.expErr {
+				t.Fatal("getMetadataService() failed: expected error, got nothing")
+			}
+			if m.GetRegion() != "us-west-2" {
+				t.Fatalf("GetRegion() failed: expected %v, got %v", "us-west-2", m.GetRegion())
+			}
+		}
+
+		cancel()
+		close(release)
+		mockCtrl.Finish()
+	}
+}
+
+func TestNewEC2MetadataClient(t *testing.T) {
+	testCases := []struct {
+		name           string
+		tokenSupported bool
+		tokenRequired  bool
+		expErr         bool
+	}{
+		{
+			name:           "success: IMDSv2",
+			tokenSupported: true,
+			tokenRequired:  true,
+		},
+		{
+			name:           "success: fall back to IMDSv1",
+			tokenSupported: false,
+		},
+		{
+			name:          "fail: token required but not available",
+			tokenRequired: true,
+			expErr:        true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		tokenRequests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/latest/api/token":
+				if !tc.tokenSupported || r.Method != http.MethodPut {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				tokenRequests++
+				fmt.Fprint(w, "token")
+			case tc.tokenRequired && r.Header.Get(metadataTokenHeader) != "token":
+				w.WriteHeader(http.StatusUnauthorized)
+			default:
+				fmt.Fprint(w, stdInstanceID)
+			}
+		}))
+
+		svc := newEC2MetadataClient(session.New(&aws.Config{
+			Endpoint:   aws.String(server.URL + "/latest"),
+			MaxRetries: aws.Int(0),
+		}))
+
+		for i := 0; i < 2; i++ {
+			instanceID, err := svc.GetMetadata("instance-id")
+			if err != nil {
+				if !tc.expErr {
+					t.Fatalf("GetMetadata() failed: expected no error, got %v", err)
+				}
+				continue
+			}
+			if tc.expErr {
+				t.Fatal("GetMetadata() failed: expected error, got nothing")
+			}
+			if instanceID != stdInstanceID {
+				t.Fatalf("GetMetadata() failed: expected %q, got %q", stdInstanceID, instanceID)
+			}
+		}
+
+		// The token must be reused across requests
+		if tc.tokenSupported && tokenRequests != 1 {
+			t.Fatalf("Expected 1 token request, got %d", tokenRequests)
+		}
+
+		server.Close()
+	}
+}
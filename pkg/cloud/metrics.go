@@ -0,0 +1,153 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bertinatto/ebs-csi-driver/pkg/metrics"
+	"k8s.io/klog"
+)
+
+// instrumentedEC2 is an EC2 decorator that records the latency
+// and the errors of every call to the underlying client.
+type instrumentedEC2 struct {
+	ec2 EC2
+}
+
+var _ EC2 = &instrumentedEC2{}
+
+func newInstrumentedEC2(ec2Client EC2) EC2 {
+	return &instrumentedEC2{ec2: ec2Client}
+}
+
+// retryHandler logs the AWS requests that are going to be retried after a
+// backoff, counting the throttled ones, so that throttling shows up before the
+// retries run out. It runs before the SDK's own AfterRetry handler, which
+// sleeps for the backoff and honors the retry decision taken here.
+var retryHandler = request.NamedHandler{
+	Name: "ebscsi.RetryHandler",
+	Fn: func(r *request.Request) {
+		if r.Retryable == nil {
+			r.Retryable = aws.Bool(r.ShouldRetry(r))
+		}
+		if !r.WillRetry() {
+			return
+		}
+		code := "Unknown"
+		if awsErr, ok := r.Error.(awserr.Error); ok {
+			code = awsErr.Code()
+		}
+		klog.V(2).Infof("Retrying %s request after error %s, attempt %d of %d", r.Operation.Name, code, r.RetryCount+1, r.MaxRetries())
+		if request.IsErrorThrottle(r.Error) {
+			metrics.APIRequestThrottles.WithLabelValues(r.Operation.Name).Inc()
+		}
+	},
+}
+
+// observe records an operation that started at start and failed with err, if any.
+func observe(operation string, start time.Time, err error) {
+	metrics.APIRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		code := "Unknown"
+		if awsErr, ok := err.(awserr.Error); ok {
+			code = awsErr.Code()
+		}
+		metrics.APIRequestErrors.WithLabelValues(operation, code).Inc()
+	}
+}
+
+func (i *instrumentedEC2) DescribeVolumesWithContext(ctx aws.Context, input *ec2.DescribeVolumesInput, opts ...request.Option) (*ec2.DescribeVolumesOutput, error) {
+	start := time.Now()
+	output, err := i.ec2.DescribeVolumesWithContext(ctx, input, opts...)
+	observe("DescribeVolumes", start, err)
+	return output, err
+}
+
+func (i *instrumentedEC2) CreateVolumeWithContext(ctx aws.Context, input *ec2.CreateVolumeInput, opts ...request.Option) (*ec2.Volume, error) {
+	start := time.Now()
+	output, err := i.ec2.CreateVolumeWithContext(ctx, input, opts...)
+	observe("CreateVolume", start, err)
+	return output, err
+}
+
+func (i *instrumentedEC2) DeleteVolumeWithContext(ctx aws.Context, input *ec2.DeleteVolumeInput, opts ...request.Option) (*ec2.DeleteVolumeOutput, error) {
+	start := time.Now()
+	output, err := i.ec2.DeleteVolumeWithContext(ctx, input, opts...)
+	observe("DeleteVolume", start, err)
+	return output, err
+}
+
+func (i *instrumentedEC2) DetachVolumeWithContext(ctx aws.Context, input *ec2.DetachVolumeInput, opts ...request.Option) (*ec2.VolumeAttachment, error) {
+	start := time.Now()
+	output, err := i.ec2.DetachVolumeWithContext(ctx, input, opts...)
+	observe("DetachVolume", start, err)
+	return output, err
+}
+
+func (i *instrumentedEC2) AttachVolumeWithContext(ctx aws.Context, input *ec2.AttachVolumeInput, opts ...request.Option) (*ec2.VolumeAttachment, error) {
+	start := time.Now()
+	output, err := i.ec2.AttachVolumeWithContext(ctx, input, opts...)
+	observe("AttachVolume", start, err)
+	return output, err
+}
+
+func (i *instrumentedEC2) DescribeInstancesWithContext(ctx aws.Context, input *ec2.DescribeInstancesInput, opts ...request.Option) (*ec2.DescribeInstancesOutput, error) {
+	start := time.Now()
+	output, err := i.ec2.DescribeInstancesWithContext(ctx, input, opts...)
+	observe("DescribeInstances", start, err)
+	return output, err
+}
+
+func (i *instrumentedEC2) CreateSnapshotWithContext(ctx aws.Context, input *ec2.CreateSnapshotInput, opts ...request.Option) (*ec2.Snapshot, error) {
+	start := time.Now()
+	output, err := i.ec2.CreateSnapshotWithContext(ctx, input, opts...)
+	observe("CreateSnapshot", start, err)
+	return output, err
+}
+
+func (i *instrumentedEC2) DeleteSnapshotWithContext(ctx aws.Context, input *ec2.DeleteSnapshotInput, opts ...request.Option) (*ec2.DeleteSnapshotOutput, error) {
+	start := time.Now()
+	output, err := i.ec2.DeleteSnapshotWithContext(ctx, input, opts...)
+	observe("DeleteSnapshot", start, err)
+	return output, err
+}
+
+func (i *instrumentedEC2) DescribeSnapshotsWithContext(ctx aws.Context, input *ec2.DescribeSnapshotsInput, opts ...request.Option) (*ec2.DescribeSnapshotsOutput, error) {
+	start := time.Now()
+	output, err := i.ec2.DescribeSnapshotsWithContext(ctx, input, opts...)
+	observe("DescribeSnapshots", start, err)
+	return output, err
+}
+
+func (i *instrumentedEC2) ModifyVolumeWithContext(ctx aws.Context, input *ec2.ModifyVolumeInput, opts ...request.Option) (*ec2.ModifyVolumeOutput, error) {
+	start := time.Now()
+	output, err := i.ec2.ModifyVolumeWithContext(ctx, input, opts...)
+	observe("ModifyVolume", start, err)
+	return output, err
+}
+
+func (i *instrumentedEC2) DescribeVolumesModificationsWithContext(ctx aws.Context, input *ec2.DescribeVolumesModificationsInput, opts ...request.Option) (*ec2.DescribeVolumesModificationsOutput, error) {
+	start := time.Now()
+	output, err := i.ec2.DescribeVolumesModificationsWithContext(ctx, input, opts...)
+	observe("DescribeVolumesModifications", start, err)
+	return output, err
+}
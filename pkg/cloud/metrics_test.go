@@ -0,0 +1,87 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bertinatto/ebs-csi-driver/pkg/metrics"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRetryHandler(t *testing.T) {
+	testCases := []struct {
+		name         string
+		err          error
+		retryCount   int
+		expRetry     bool
+		expThrottled bool
+	}{
+		{
+			name:         "throttled request",
+			err:          awserr.New("RequestLimitExceeded", "", nil),
+			expRetry:     true,
+			expThrottled: true,
+		},
+		{
+			name:       "throttled request without retries left",
+			err:        awserr.New("RequestLimitExceeded", "", nil),
+			retryCount: 3,
+		},
+		{
+			name:     "retryable error",
+			err:      awserr.New("RequestError", "", nil),
+			expRetry: true,
+		},
+		{
+			name: "non-retryable error",
+			err:  awserr.New("InvalidVolume.NotFound", "", nil),
+		},
+	}
+
+	svc := ec2.New(session.New(&aws.Config{Region: aws.String("us-east-1"), MaxRetries: aws.Int(3)}))
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		req, _ := svc.DescribeVolumesRequest(&ec2.DescribeVolumesInput{})
+		req.Error = tc.err
+		req.RetryCount = tc.retryCount
+		req.HTTPResponse = &http.Response{StatusCode: 400}
+
+		throttles := throttleCount(t, req.Operation.Name)
+		retryHandler.Fn(req)
+
+		if retry := req.WillRetry(); retry != tc.expRetry {
+			t.Fatalf("Expected request to be retried: %v, got: %v", tc.expRetry, retry)
+		}
+		if throttled := throttleCount(t, req.Operation.Name) > throttles; throttled != tc.expThrottled {
+			t.Fatalf("Expected request to be counted as throttled: %v, got: %v", tc.expThrottled, throttled)
+		}
+	}
+}
+
+func throttleCount(t *testing.T, operation string) float64 {
+	m := &dto.Metric{}
+	if err := metrics.APIRequestThrottles.WithLabelValues(operation).Write(m); err != nil {
+		t.Fatalf("Could not read throttle count: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
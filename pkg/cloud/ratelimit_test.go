@@ -0,0 +1,113 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bertinatto/ebs-csi-driver/pkg/cloud/mocks"
+	"github.com/golang/mock/gomock"
+)
+
+func TestTokenBucketWait(t *testing.T) {
+	testCases := []struct {
+		name      string
+		qps       float32
+		burst     int
+		calls     int
+		minTime   time.Duration
+		maxTime   time.Duration
+		cancelled bool
+		expErr    bool
+	}{
+		{
+			name:    "success: calls within burst don't wait",
+			qps:     1,
+			burst:   3,
+			calls:   3,
+			maxTime: 100 * time.Millisecond,
+		},
+		{
+			name:    "success: calls over burst wait for a token",
+			qps:     10,
+			burst:   1,
+			calls:   3,
+			minTime: 150 * time.Millisecond,
+			maxTime: time.Second,
+		},
+		{
+			name:      "fail: context cancelled while waiting",
+			qps:       0.1,
+			burst:     1,
+			calls:     2,
+			maxTime:   100 * time.Millisecond,
+			cancelled: true,
+			expErr:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		limiter := newTokenBucket(tc.qps, tc.burst)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if tc.cancelled {
+			time.AfterFunc(10*time.Millisecond, cancel)
+		}
+
+		var err error
+		start := time.Now()
+		for i := 0; i < tc.calls && err == nil; i++ {
+			err = limiter.Wait(ctx)
+		}
+		elapsed := time.Since(start)
+		cancel()
+
+		if err != nil && !tc.expErr {
+			t.Fatalf("Wait() failed: expected no error, got: %v", err)
+		}
+		if err == nil && tc.expErr {
+			t.Fatal("Wait() failed: expected error, got nothing")
+		}
+		if elapsed < tc.minTime || elapsed > tc.maxTime {
+			t.Fatalf("Wait() failed: expected to take between %v and %v, took %v", tc.minTime, tc.maxTime, elapsed)
+		}
+	}
+}
+
+func TestRateLimitedEC2(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockEC2 := mocks.NewMockEC2(mockCtrl)
+	input := &ec2.DescribeVolumesInput{VolumeIds: []*string{aws.String("vol-test")}}
+	output := &ec2.DescribeVolumesOutput{}
+	mockEC2.EXPECT().DescribeVolumesWithContext(gomock.Any(), input).Return(output, nil)
+
+	limited := newRateLimitedEC2(mockEC2, 10, 1)
+	got, err := limited.DescribeVolumesWithContext(context.Background(), input)
+	if err != nil {
+		t.Fatalf("DescribeVolumes() failed: expected no error, got: %v", err)
+	}
+	if got != output {
+		t.Fatalf("DescribeVolumes() failed: expected output %v, got %v", output, got)
+	}
+}
@@ -18,32 +18,64 @@ package driver
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/bertinatto/ebs-csi-driver/pkg/cloud"
 	"github.com/bertinatto/ebs-csi-driver/pkg/util"
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
-	"github.com/golang/glog"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog"
 )
 
-func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	glog.V(4).Infof("CreateVolume: called with args %#v", req)
-	volName := req.GetName()
-	if len(volName) == 0 {
-		return nil, status.Error(codes.InvalidArgument, "Volume name not provided")
-	}
+// Keys of the StorageClass parameters accepted by CreateVolume.
+const (
+	// volumeTypeKey is the EBS volume type, e.g. gp2 or io1.
+	volumeTypeKey = "type"
 
-	volSize := cloud.DefaultVolumeSize
-	if req.GetCapacityRange() != nil {
-		volSize = req.GetCapacityRange().GetRequiredBytes()
-	}
+	// iopsPerGBKey is the number of I/O operations per second per GiB of io1 volumes.
+	iopsPerGBKey = "iopsPerGB"
+
+	// iopsKey is the total number of I/O operations per second of io1
+	// volumes, regardless of their size. It can't be combined with iopsPerGB.
+	iopsKey = "iops"
+
+	// encryptedKey tells whether the volume is encrypted.
+	encryptedKey = "encrypted"
+
+	// kmsKeyIDKey is the KMS key used to encrypt the volume.
+	kmsKeyIDKey = "kmsKeyId"
+
+	// fsTypeKey is the filesystem the volume is formatted with. It's also
+	// passed along in the volume attributes and in the publish info.
+	fsTypeKey = "fsType"
+
+	// pvcNameKey, pvcNamespaceKey and pvNameKey are passed by the external
+	// provisioner to identify the PVC and the PV the volume is created for.
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	pvNameKey       = "csi.storage.k8s.io/pv/name"
+)
 
-	volSizeBytes := util.RoundUpBytes(volSize)
+// Tags added to the created volumes to trace them back to Kubernetes objects.
+const (
+	pvcNameTag      = "kubernetes.io/created-for/pvc/name"
+	pvcNamespaceTag = "kubernetes.io/created-for/pvc/namespace"
+	pvNameTag       = "kubernetes.io/created-for/pv/name"
+)
 
-	maxVolSize := req.GetCapacityRange().GetLimitBytes()
-	if (maxVolSize > 0) && (maxVolSize < volSizeBytes) {
-		return nil, status.Error(codes.InvalidArgument, "After round-up, volume size exceeds the limit specified")
+func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	klog.V(4).Infof("CreateVolume: called with args %#v", req)
+	if len(req.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume name not provided")
+	}
+	// The name is stored in a tag to find the volume again on retries, so the
+	// normalized name must be used for both the creation and the lookup
+	volName, err := util.NormalizeVolumeName(req.GetName(), cloud.MaxTagValueLength)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid volume name: %v", err)
 	}
 
 	volCaps := req.GetVolumeCapabilities()
@@ -55,7 +87,45 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities not supported")
 	}
 
-	disk, err := d.cloud.GetDisk(volName, volSizeBytes)
+	if !d.namesInFlight.Insert(volName) {
+		return nil, status.Errorf(codes.Aborted, "An operation with the given volume name %q is already in progress", volName)
+	}
+	defer d.namesInFlight.Delete(volName)
+
+	opts, fsType, err := parseVolumeParameters(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(opts.VolumeType) == 0 {
+		opts.VolumeType = d.defaultVolumeType
+	}
+
+	volSizeBytes, err := getVolSizeBytes(req.GetCapacityRange(), opts.VolumeType)
+	if err != nil {
+		return nil, status.Error(codes.OutOfRange, err.Error())
+	}
+
+	// TODO: clone volumes through a temporary snapshot once the driver moves to
+	// CSI v1.0, the v0.3 content source can only be a snapshot.
+	contentSource := req.GetVolumeContentSource()
+	if snapshotSource := contentSource.GetSnapshot(); snapshotSource != nil {
+		snapshotID := snapshotSource.GetId()
+		snapshot, err := d.cloud.GetSnapshotByID(ctx, snapshotID)
+		if err != nil {
+			if err == cloud.ErrSnapshotNotFound {
+				return nil, status.Errorf(codes.NotFound, "Snapshot %q not found", snapshotID)
+			}
+			return nil, status.Errorf(codes.Internal, "Could not get snapshot %q: %v", snapshotID, err)
+		}
+		volSizeBytes, err = getRestoreSizeBytes(volSizeBytes, req.GetCapacityRange(), snapshot)
+		if err != nil {
+			return nil, status.Error(codes.OutOfRange, err.Error())
+		}
+		opts.SnapshotID = snapshotID
+		opts.Tags[cloud.SourceSnapshotTagKey] = snapshotID
+	}
+
+	disk, err := d.cloud.GetDiskByNameAndSize(ctx, volName, volSizeBytes)
 	if err != nil {
 		switch err {
 		case cloud.ErrVolumeNotFound:
@@ -68,36 +138,207 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 
+	// A retried restore finds the volume it created, which must come from
+	// the same snapshot to satisfy the request
+	if disk != nil && disk.SnapshotID != opts.SnapshotID {
+		return nil, status.Errorf(codes.AlreadyExists, "Volume %q already exists with a different content source", volName)
+	}
+
 	if disk == nil {
-		opts := &cloud.DiskOptions{
-			CapacityBytes: volSizeBytes,
-			Tags:          map[string]string{cloud.VolumeNameTagKey: volName},
+		opts.CapacityBytes = volSizeBytes
+		for key, value := range d.extraTags {
+			opts.Tags[key] = value
+		}
+		if len(d.clusterID) != 0 {
+			opts.Tags[cloud.ClusterTagKey(d.clusterID)] = cloud.ClusterTagOwned
+		}
+		opts.Tags[cloud.VolumeNameTagKey] = volName
+		if err := cloud.ValidateTags(opts.Tags); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid volume tags: %v", err)
+		}
+
+		zones := pickAvailabilityZones(req.GetAccessibilityRequirements(), d.cloud.GetMetadata().GetAvailabilityZone())
+		if len(zones) == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "Could not determine the zone of volume %q: no topology requirement given and the controller's zone is unknown", volName)
+		}
+
+		// A zone may lack the capacity for the volume, the next one is tried then
+		var newDisk *cloud.Disk
+		for _, zone := range zones {
+			opts.AvailabilityZone = zone
+			newDisk, err = d.cloud.CreateDisk(ctx, volName, opts)
+			if err != cloud.ErrInsufficientVolumeCapacity {
+				break
+			}
 		}
-		newDisk, err := d.cloud.CreateDisk(volName, opts)
 		if err != nil {
+			if err == cloud.ErrInsufficientVolumeCapacity {
+				return nil, status.Errorf(codes.ResourceExhausted, "Could not create volume %q in any of the requested zones: %v", volName, err)
+			}
 			return nil, status.Errorf(codes.Internal, "Could not create volume %q: %v", volName, err)
 		}
 		disk = newDisk
 	}
 
+	var attributes map[string]string
+	if len(fsType) != 0 {
+		attributes = map[string]string{fsTypeKey: fsType}
+	}
+
+	var topology []*csi.Topology
+	if len(disk.AvailabilityZone) != 0 {
+		topology = []*csi.Topology{
+			{Segments: map[string]string{topologyKey: disk.AvailabilityZone}},
+		}
+	}
+
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			Id:            disk.VolumeID,
-			CapacityBytes: util.GiBToBytes(disk.CapacityGiB),
+			Id:                 disk.VolumeID,
+			CapacityBytes:      util.GiBToBytes(disk.CapacityGiB),
+			Attributes:         attributes,
+			AccessibleTopology: topology,
+			ContentSource:      contentSource,
 		},
 	}, nil
 }
 
+// getRestoreSizeBytes returns the size of a volume restored from the snapshot: the
+// given size, rounded up to the size of the snapshot if it's smaller. An error is
+// returned if the snapshot doesn't fit in the limit of the capacity range, since
+// EBS would otherwise only reject the volume once it's being created.
+func getRestoreSizeBytes(volSizeBytes int64, capRange *csi.CapacityRange, snapshot *cloud.Snapshot) (int64, error) {
+	snapshotBytes := util.GiBToBytes(snapshot.Size)
+	if volSizeBytes >= snapshotBytes {
+		return volSizeBytes, nil
+	}
+	if limitBytes := capRange.GetLimitBytes(); limitBytes > 0 && snapshotBytes > limitBytes {
+		return 0, fmt.Errorf("snapshot %q size (%d) exceeds the limit (%d)", snapshot.SnapshotID, snapshotBytes, limitBytes)
+	}
+	return snapshotBytes, nil
+}
+
+// getVolSizeBytes returns the size of the volume to create: the required bytes
+// rounded up to whole GiB, or the default size if none is required, but never
+// less than the minimum size of the volume type. An error is returned if that
+// size is beyond the limit of the capacity range.
+func getVolSizeBytes(capRange *csi.CapacityRange, volumeType string) (int64, error) {
+	requiredBytes := capRange.GetRequiredBytes()
+	limitBytes := capRange.GetLimitBytes()
+	if limitBytes > 0 && requiredBytes > limitBytes {
+		return 0, fmt.Errorf("required bytes (%d) exceed the limit (%d)", requiredBytes, limitBytes)
+	}
+
+	volSizeBytes := cloud.DefaultVolumeSize
+	if requiredBytes > 0 {
+		volSizeBytes = util.RoundUpBytes(requiredBytes)
+	}
+
+	minBytes := util.GiBToBytes(cloud.MinVolumeSizeGiB(volumeType))
+	if volSizeBytes < minBytes {
+		volSizeBytes = minBytes
+	}
+
+	if limitBytes > 0 && volSizeBytes > limitBytes {
+		return 0, fmt.Errorf("volume size (%d) exceeds the limit (%d) after round-up", volSizeBytes, limitBytes)
+	}
+	return volSizeBytes, nil
+}
+
+// pickAvailabilityZones returns the zones to try to create a volume in, in
+// order: the zones of the preferred topologies, then the ones of the requisite
+// topologies. Without topology requirements, defaultZone is the only zone
+// returned, unless it's empty too.
+func pickAvailabilityZones(requirement *csi.TopologyRequirement, defaultZone string) []string {
+	var zones []string
+	seen := map[string]bool{}
+	for _, topologies := range [][]*csi.Topology{requirement.GetPreferred(), requirement.GetRequisite()} {
+		for _, topology := range topologies {
+			if zone, ok := topology.GetSegments()[topologyKey]; ok && !seen[zone] {
+				seen[zone] = true
+				zones = append(zones, zone)
+			}
+		}
+	}
+	if len(zones) == 0 && len(defaultZone) != 0 {
+		return []string{defaultZone}
+	}
+	return zones
+}
+
+// parseVolumeParameters translates the StorageClass parameters into disk options,
+// returning the filesystem type separately. Keys are matched case-insensitively
+// and unknown keys are rejected.
+func parseVolumeParameters(params map[string]string) (*cloud.DiskOptions, string, error) {
+	opts := &cloud.DiskOptions{Tags: map[string]string{}}
+	var fsType string
+
+	for key, value := range params {
+		switch strings.ToLower(key) {
+		case strings.ToLower(volumeTypeKey):
+			opts.VolumeType = value
+		case strings.ToLower(iopsPerGBKey):
+			iopsPerGB, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid %s parameter %q: %v", iopsPerGBKey, value, err)
+			}
+			opts.IOPSPerGB = iopsPerGB
+		case strings.ToLower(iopsKey):
+			iops, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid %s parameter %q: %v", iopsKey, value, err)
+			}
+			opts.IOPS = iops
+		case strings.ToLower(encryptedKey):
+			encrypted, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid %s parameter %q: %v", encryptedKey, value, err)
+			}
+			opts.Encrypted = encrypted
+		case strings.ToLower(kmsKeyIDKey):
+			opts.KmsKeyID = value
+		case strings.ToLower(fsTypeKey):
+			if !supportedFsTypes[value] {
+				return nil, "", fmt.Errorf("invalid %s parameter %q, filesystem not supported", fsTypeKey, value)
+			}
+			fsType = value
+		case pvcNameKey:
+			opts.Tags[pvcNameTag] = value
+		case pvcNamespaceKey:
+			opts.Tags[pvcNamespaceTag] = value
+		case pvNameKey:
+			opts.Tags[pvNameTag] = value
+		default:
+			return nil, "", fmt.Errorf("invalid parameter %q", key)
+		}
+	}
+
+	if opts.IOPS != 0 && opts.IOPSPerGB != 0 {
+		return nil, "", fmt.Errorf("parameters %s and %s are mutually exclusive", iopsKey, iopsPerGBKey)
+	}
+
+	if len(opts.KmsKeyID) != 0 && !opts.Encrypted {
+		return nil, "", fmt.Errorf("parameter %s requires %s to be true", kmsKeyIDKey, encryptedKey)
+	}
+
+	return opts, fsType, nil
+}
+
 func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	glog.V(4).Infof("DeleteVolume: called with args: %#v", req)
+	klog.V(4).Infof("DeleteVolume: called with args: %#v", req)
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
 	}
 
-	if _, err := d.cloud.DeleteDisk(volumeID); err != nil {
+	if !d.volumesInFlight.Insert(volumeID) {
+		return nil, status.Errorf(codes.Aborted, "An operation with the given volume %q is already in progress", volumeID)
+	}
+	defer d.volumesInFlight.Delete(volumeID)
+
+	if _, err := d.cloud.DeleteDisk(ctx, volumeID); err != nil {
 		if err == cloud.ErrVolumeNotFound {
-			glog.V(4).Info("DeleteVolume: volume not found, returning with success")
+			klog.V(4).Info("DeleteVolume: volume not found, returning with success")
 			return &csi.DeleteVolumeResponse{}, nil
 		}
 		return nil, status.Errorf(codes.Internal, "Could not delete volume ID %q: %v", volumeID, err)
@@ -107,7 +348,7 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 }
 
 func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	glog.V(4).Infof("ControllerPublishVolume: called with args %#v", req)
+	klog.V(4).Infof("ControllerPublishVolume: called with args %#v", req)
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
@@ -128,18 +369,42 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		return nil, status.Error(codes.InvalidArgument, "Volume capability not supported")
 	}
 
-	devicePath, err := d.cloud.AttachDisk(volumeID, nodeID)
+	fsType, hasFs := req.GetVolumeAttributes()[fsTypeKey]
+	if volCap.GetBlock() != nil && hasFs {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume %q has filesystem %q and can't be published as a block device", volumeID, fsType)
+	}
+
+	if !d.volumesInFlight.Insert(volumeID) {
+		return nil, status.Errorf(codes.Aborted, "An operation with the given volume %q is already in progress", volumeID)
+	}
+	defer d.volumesInFlight.Delete(volumeID)
+
+	devicePath, err := d.cloud.AttachDisk(ctx, volumeID, nodeID)
 	if err != nil {
+		if err == cloud.ErrAttachmentLimitExceeded {
+			return nil, status.Errorf(codes.ResourceExhausted, "Could not attach volume %q to node %q: %v", volumeID, nodeID, err)
+		}
+		if inUse, ok := err.(*cloud.VolumeInUseError); ok {
+			return nil, status.Errorf(codes.FailedPrecondition, "Could not attach volume %q to node %q: it's attached to node %q", volumeID, nodeID, inUse.InstanceID)
+		}
+		// The device stays reserved, so a retry waits for the same attachment
+		// rather than attaching the volume again as another device
+		if timeout, ok := err.(*cloud.AttachmentTimeoutError); ok {
+			return nil, status.Errorf(codes.DeadlineExceeded, "Volume %q is still attaching to node %q as %s, the node may need to be rebooted", volumeID, nodeID, timeout.Device)
+		}
 		return nil, status.Errorf(codes.Internal, "Could not attach volume %q to node %q: %v", volumeID, nodeID, err)
 	}
-	glog.V(5).Infof("ControllerPublishVolume: volume %s attached to node %s through device %s", volumeID, nodeID, devicePath)
+	klog.V(5).Infof("ControllerPublishVolume: volume %s attached to node %s through device %s", volumeID, nodeID, devicePath)
 
 	pvInfo := map[string]string{"devicePath": devicePath}
+	if hasFs {
+		pvInfo[fsTypeKey] = fsType
+	}
 	return &csi.ControllerPublishVolumeResponse{PublishInfo: pvInfo}, nil
 }
 
 func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	glog.V(4).Infof("ControllerUnpublishVolume: called with args %#v", req)
+	klog.V(4).Infof("ControllerUnpublishVolume: called with args %#v", req)
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
@@ -150,16 +415,21 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 		return nil, status.Error(codes.InvalidArgument, "Node ID not provided")
 	}
 
-	if err := d.cloud.DetachDisk(volumeID, nodeID); err != nil {
+	if !d.volumesInFlight.Insert(volumeID) {
+		return nil, status.Errorf(codes.Aborted, "An operation with the given volume %q is already in progress", volumeID)
+	}
+	defer d.volumesInFlight.Delete(volumeID)
+
+	if err := d.cloud.DetachDisk(ctx, volumeID, nodeID); err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not detach volume %q from node %q: %v", volumeID, nodeID, err)
 	}
-	glog.V(5).Infof("ControllerUnpublishVolume: volume %s detached from node %s", volumeID, nodeID)
+	klog.V(5).Infof("ControllerUnpublishVolume: volume %s detached from node %s", volumeID, nodeID)
 
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
 func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	glog.V(4).Infof("ControllerGetCapabilities: called with args %#v", req)
+	klog.V(4).Infof("ControllerGetCapabilities: called with args %#v", req)
 	var caps []*csi.ControllerServiceCapability
 	for _, cap := range d.controllerCaps {
 		c := &csi.ControllerServiceCapability{
@@ -174,19 +444,70 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 	return &csi.ControllerGetCapabilitiesResponse{Capabilities: caps}, nil
 }
 
+// GetCapacity reports the largest volume that can be created with the given
+// parameters in the given zone. EBS doesn't expose the capacity left in a zone,
+// and the account quotas aren't available to the driver, so this is only an
+// approximation: any zone of the region is assumed to fit a volume of the
+// maximum size, and zones of other regions can't fit any volume.
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	glog.V(4).Infof("GetCapacity: called with args %#v", req)
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.V(4).Infof("GetCapacity: called with args %#v", req)
+	opts, _, err := parseVolumeParameters(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if len(opts.VolumeType) != 0 && !cloud.IsValidVolumeType(opts.VolumeType) {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid volume type %q", opts.VolumeType)
+	}
+
+	if zone, ok := req.GetAccessibleTopology().GetSegments()[topologyKey]; ok {
+		if !strings.HasPrefix(zone, d.cloud.GetMetadata().GetRegion()) {
+			return &csi.GetCapacityResponse{}, nil
+		}
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: util.GiBToBytes(cloud.MaxVolumeSizeGiB),
+	}, nil
 }
 
 func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	glog.V(4).Infof("ListVolumes: called with args %#v", req)
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.V(4).Infof("ListVolumes: called with args %#v", req)
+	maxEntries := req.GetMaxEntries()
+	if maxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "Max entries can't be negative")
+	}
+
+	disks, nextToken, err := d.cloud.ListDisks(ctx, int64(maxEntries), req.GetStartingToken())
+	if err != nil {
+		if err == cloud.ErrInvalidStartingToken {
+			return nil, status.Error(codes.Aborted, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "Could not list volumes: %v", err)
+	}
+
+	// CSI v0.3 has no field for the nodes the volumes are published on,
+	// so only the volumes themselves are listed
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, disk := range disks {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				Id:            disk.VolumeID,
+				CapacityBytes: util.GiBToBytes(disk.CapacityGiB),
+				AccessibleTopology: []*csi.Topology{
+					{Segments: map[string]string{topologyKey: disk.AvailabilityZone}},
+				},
+			},
+		})
+	}
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
 }
 
 func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	glog.V(4).Infof("ValidateVolumeCapabilities: called with args %#v", req)
-	//TODO: validate if volume exists
+	klog.V(4).Infof("ValidateVolumeCapabilities: called with args %#v", req)
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
@@ -197,39 +518,158 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities not provided")
 	}
 
+	if _, err := d.cloud.GetDiskByID(ctx, volumeID); err != nil {
+		if err == cloud.ErrVolumeNotFound {
+			return nil, status.Error(codes.NotFound, "Volume not found")
+		}
+		return nil, status.Errorf(codes.Internal, "Could not get volume with ID %q: %v", volumeID, err)
+	}
+
 	found := d.isValidVolumeCapabilities(volCaps)
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Supported: found,
 	}, nil
 }
 
+// isValidVolumeCapabilities returns whether the access modes of all the
+// capabilities are among the ones supported by the driver. It's shared by the
+// controller and node RPCs so that they accept the same capabilities. EBS
+// volumes can't be written from several nodes, so MULTI_NODE_MULTI_WRITER is
+// rejected for both block and mount access.
 func (d *Driver) isValidVolumeCapabilities(volCaps []*csi.VolumeCapability) bool {
 	hasSupport := func(cap *csi.VolumeCapability) bool {
 		for _, c := range d.volumeCaps {
-			if c.GetMode() == cap.AccessMode.GetMode() {
+			if c.GetMode() == cap.GetAccessMode().GetMode() {
 				return true
 			}
 		}
 		return false
 	}
 
-	foundAll := true
 	for _, c := range volCaps {
 		if !hasSupport(c) {
-			foundAll = false
+			return false
 		}
 	}
-	return foundAll
+	return true
 }
 
 func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.V(4).Infof("CreateSnapshot: called with args %#v", req)
+	snapshotName := req.GetName()
+	if len(snapshotName) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot name not provided")
+	}
+
+	volumeID := req.GetSourceVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot volume source ID not provided")
+	}
+
+	snapshot, err := d.cloud.GetSnapshotByName(ctx, snapshotName)
+	if err != nil && err != cloud.ErrSnapshotNotFound {
+		return nil, status.Errorf(codes.Internal, "Could not get snapshot %q: %v", snapshotName, err)
+	}
+
+	if snapshot != nil {
+		if snapshot.SourceVolumeID != volumeID {
+			return nil, status.Errorf(codes.AlreadyExists, "Snapshot %q for another source volume already exists", snapshotName)
+		}
+		klog.V(4).Infof("CreateSnapshot: snapshot %q already exists", snapshotName)
+		return newCreateSnapshotResponse(snapshot), nil
+	}
+
+	opts := &cloud.SnapshotOptions{
+		Tags:         map[string]string{cloud.SnapshotNameTagKey: snapshotName},
+		ReadyTimeout: d.snapshotReadyTimeout,
+	}
+	snapshot, err = d.cloud.CreateSnapshot(ctx, volumeID, opts)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not create snapshot %q: %v", snapshotName, err)
+	}
+
+	return newCreateSnapshotResponse(snapshot), nil
+}
+
+func newCreateSnapshotResponse(snapshot *cloud.Snapshot) *csi.CreateSnapshotResponse {
+	return &csi.CreateSnapshotResponse{
+		Snapshot: newCSISnapshot(snapshot),
+	}
+}
+
+func newCSISnapshot(snapshot *cloud.Snapshot) *csi.Snapshot {
+	snapshotStatus := csi.SnapshotStatus_UPLOADING
+	if snapshot.ReadyToUse {
+		snapshotStatus = csi.SnapshotStatus_READY
+	}
+	return &csi.Snapshot{
+		Id:             snapshot.SnapshotID,
+		SourceVolumeId: snapshot.SourceVolumeID,
+		SizeBytes:      util.GiBToBytes(snapshot.Size),
+		CreatedAt:      snapshot.CreationTime.UnixNano(),
+		Status: &csi.SnapshotStatus{
+			Type: snapshotStatus,
+		},
+	}
 }
 
 func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.V(4).Infof("DeleteSnapshot: called with args %#v", req)
+	snapshotID := req.GetSnapshotId()
+	if len(snapshotID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID not provided")
+	}
+
+	if _, err := d.cloud.DeleteSnapshot(ctx, snapshotID); err != nil {
+		if err == cloud.ErrSnapshotNotFound {
+			klog.V(4).Info("DeleteSnapshot: snapshot not found, returning with success")
+			return &csi.DeleteSnapshotResponse{}, nil
+		}
+		return nil, status.Errorf(codes.Internal, "Could not delete snapshot ID %q: %v", snapshotID, err)
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.V(4).Infof("ListSnapshots: called with args %#v", req)
+	if snapshotID := req.GetSnapshotId(); len(snapshotID) != 0 {
+		snapshot, err := d.cloud.GetSnapshotByID(ctx, snapshotID)
+		if err != nil {
+			if err == cloud.ErrSnapshotNotFound {
+				klog.V(4).Info("ListSnapshots: snapshot not found, returning with success")
+				return &csi.ListSnapshotsResponse{}, nil
+			}
+			return nil, status.Errorf(codes.Internal, "Could not get snapshot ID %q: %v", snapshotID, err)
+		}
+		return newListSnapshotsResponse([]*cloud.Snapshot{snapshot}, ""), nil
+	}
+
+	maxEntries := req.GetMaxEntries()
+	if maxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "Max entries can't be negative")
+	}
+
+	snapshots, nextToken, err := d.cloud.ListSnapshots(ctx, int64(maxEntries), req.GetStartingToken(), req.GetSourceVolumeId())
+	if err != nil {
+		if err == cloud.ErrInvalidStartingToken {
+			return nil, status.Error(codes.Aborted, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "Could not list snapshots: %v", err)
+	}
+
+	return newListSnapshotsResponse(snapshots, nextToken), nil
+}
+
+func newListSnapshotsResponse(snapshots []*cloud.Snapshot, nextToken string) *csi.ListSnapshotsResponse {
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, snapshot := range snapshots {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: newCSISnapshot(snapshot),
+		})
+	}
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}
 }
@@ -18,9 +18,13 @@ package driver
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/bertinatto/ebs-csi-driver/pkg/cloud"
+	"github.com/bertinatto/ebs-csi-driver/pkg/util"
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -72,6 +76,26 @@ func TestCreateVolume(t *testing.T) {
 			},
 			expErrCode: codes.InvalidArgument,
 		},
+		{
+			name: "fail name too long",
+			req: &csi.CreateVolumeRequest{
+				Name:               strings.Repeat("a", cloud.MaxTagValueLength+1),
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCap,
+				Parameters:         stdParams,
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail name with invalid characters",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-vol;",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCap,
+				Parameters:         stdParams,
+			},
+			expErrCode: codes.InvalidArgument,
+		},
 		{
 			name: "success same name and same capacity",
 			req: &csi.CreateVolumeRequest{
@@ -93,7 +117,7 @@ func TestCreateVolume(t *testing.T) {
 			},
 		},
 		{
-			name: "fail same name and different capacity",
+			name: "success same name and smaller capacity",
 			req: &csi.CreateVolumeRequest{
 				Name:               "test-vol",
 				CapacityRange:      stdCapRange,
@@ -106,6 +130,26 @@ func TestCreateVolume(t *testing.T) {
 				VolumeCapabilities: stdVolCap,
 				Parameters:         stdParams,
 			},
+			expVol: &csi.Volume{
+				CapacityBytes: stdVolSize,
+				Id:            "vol-test",
+				Attributes:    nil,
+			},
+		},
+		{
+			name: "fail same name and larger capacity",
+			req: &csi.CreateVolumeRequest{
+				Name:               "test-vol",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCap,
+				Parameters:         stdParams,
+			},
+			extraReq: &csi.CreateVolumeRequest{
+				Name:               "test-vol",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * stdVolSize},
+				VolumeCapabilities: stdVolCap,
+				Parameters:         stdParams,
+			},
 			expErrCode: codes.AlreadyExists,
 		},
 		{
@@ -135,11 +179,168 @@ func TestCreateVolume(t *testing.T) {
 				Attributes:    nil,
 			},
 		},
+		{
+			name: "success with parameters",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCap,
+				Parameters: map[string]string{
+					"type":      cloud.VolumeTypeIO1,
+					"IOPSPerGB": "10",
+					"encrypted": "true",
+					"kmsKeyId":  "arn:aws:kms:us-east-1:000000000000:key/test",
+					"FsType":    "xfs",
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes: stdVolSize,
+				Id:            "vol-test",
+				Attributes:    map[string]string{"fsType": "xfs"},
+			},
+		},
+		{
+			name: "success with topology",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCap,
+				AccessibilityRequirements: &csi.TopologyRequirement{
+					Requisite: []*csi.Topology{
+						{Segments: map[string]string{topologyKey: "us-east-1a"}},
+						{Segments: map[string]string{topologyKey: "us-east-1b"}},
+					},
+					Preferred: []*csi.Topology{
+						{Segments: map[string]string{topologyKey: "us-east-1b"}},
+					},
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes: stdVolSize,
+				Id:            "vol-test",
+				AccessibleTopology: []*csi.Topology{
+					{Segments: map[string]string{topologyKey: "us-east-1b"}},
+				},
+			},
+		},
+		{
+			name: "fail unknown parameter",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCap,
+				Parameters:         map[string]string{"unknown": "value"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail invalid iopsPerGB parameter",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCap,
+				Parameters:         map[string]string{"iopsPerGB": "many"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail invalid iops parameter",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCap,
+				Parameters:         map[string]string{"iops": "many"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail both iops and iopsPerGB parameters",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCap,
+				Parameters:         map[string]string{"type": cloud.VolumeTypeIO1, "iops": "1000", "iopsPerGB": "10"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail unsupported fsType parameter",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCap,
+				Parameters:         map[string]string{"fsType": "btrfs"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail KMS key without encryption",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCap,
+				Parameters:         map[string]string{"kmsKeyId": "arn:aws:kms:us-east-1:000000000000:key/test"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "success round up within limit",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: stdVolSize - 1, LimitBytes: stdVolSize},
+				VolumeCapabilities: stdVolCap,
+			},
+			expVol: &csi.Volume{
+				CapacityBytes: stdVolSize,
+				Id:            "vol-test",
+			},
+		},
+		{
+			name: "success volume type minimum size",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: stdVolSize},
+				VolumeCapabilities: stdVolCap,
+				Parameters:         map[string]string{"type": cloud.VolumeTypeST1},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes: util.GiBToBytes(cloud.MinVolumeSizeGiBHDD),
+				Id:            "vol-test",
+			},
+		},
+		{
+			name: "fail round up beyond limit",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: stdVolSize + 1, LimitBytes: stdVolSize + 1},
+				VolumeCapabilities: stdVolCap,
+			},
+			expErrCode: codes.OutOfRange,
+		},
+		{
+			name: "fail required bytes beyond limit",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * stdVolSize, LimitBytes: stdVolSize},
+				VolumeCapabilities: stdVolCap,
+			},
+			expErrCode: codes.OutOfRange,
+		},
+		{
+			name: "fail volume type minimum size beyond limit",
+			req: &csi.CreateVolumeRequest{
+				Name:               "vol-test",
+				CapacityRange:      &csi.CapacityRange{RequiredBytes: stdVolSize, LimitBytes: stdVolSize},
+				VolumeCapabilities: stdVolCap,
+				Parameters:         map[string]string{"type": cloud.VolumeTypeSC1},
+			},
+			expErrCode: codes.OutOfRange,
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Logf("Test case: %s", tc.name)
-		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), "")
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{})
 
 		resp, err := awsDriver.CreateVolume(context.TODO(), tc.req)
 		if err != nil {
@@ -190,36 +391,965 @@ func TestCreateVolume(t *testing.T) {
 		if tc.expVol.GetAttributes() == nil && vol.GetAttributes() != nil {
 			t.Fatalf("Expected volume attributes to be nil, got: %#v", vol.GetAttributes())
 		}
+
+		for i, expTopology := range tc.expVol.GetAccessibleTopology() {
+			if i >= len(vol.GetAccessibleTopology()) {
+				t.Fatalf("Expected accessible topology %v, got: %v", tc.expVol.GetAccessibleTopology(), vol.GetAccessibleTopology())
+			}
+			if zone := vol.GetAccessibleTopology()[i].GetSegments()[topologyKey]; zone != expTopology.GetSegments()[topologyKey] {
+				t.Fatalf("Expected accessible zone %q, got: %q", expTopology.GetSegments()[topologyKey], zone)
+			}
+		}
 	}
 }
 
-func TestDeleteVolume(t *testing.T) {
+func TestCreateVolumeTags(t *testing.T) {
+	volCaps := []*csi.VolumeCapability{stdNodeVolCap}
+
 	testCases := []struct {
 		name       string
-		req        *csi.DeleteVolumeRequest
-		expResp    *csi.DeleteVolumeResponse
+		opts       *DriverOptions
+		params     map[string]string
 		expErrCode codes.Code
 	}{
 		{
-			name: "success normal",
-			req: &csi.DeleteVolumeRequest{
-				VolumeId: "vol-test",
+			name: "success with PVC parameters and extra tags",
+			opts: &DriverOptions{
+				ExtraTags: map[string]string{"team": "storage"},
+				ClusterID: "test-cluster",
+			},
+			params: map[string]string{
+				pvcNameKey:      "test-pvc",
+				pvcNamespaceKey: "default",
+				pvNameKey:       "pv-test",
 			},
-			expResp: &csi.DeleteVolumeResponse{},
 		},
 		{
-			name: "success invalid volume id",
-			req: &csi.DeleteVolumeRequest{
-				VolumeId: "invalid-volume-name",
+			name: "fail reserved extra tag",
+			opts: &DriverOptions{
+				ExtraTags: map[string]string{"aws:team": "storage"},
 			},
-			expResp: &csi.DeleteVolumeResponse{},
+			expErrCode: codes.InvalidArgument,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Logf("Test case: %s", tc.name)
-		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), "")
-		_, err := awsDriver.DeleteVolume(context.TODO(), tc.req)
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), tc.opts)
+
+		_, err := awsDriver.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:               "test-vol",
+			VolumeCapabilities: volCaps,
+			Parameters:         tc.params,
+		})
+		if err != nil {
+			expectErrCode(t, err, tc.expErrCode)
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+	}
+}
+
+func TestCreateVolumeDefaultVolumeType(t *testing.T) {
+	volCaps := []*csi.VolumeCapability{stdNodeVolCap}
+
+	testCases := []struct {
+		name              string
+		defaultVolumeType string
+		params            map[string]string
+		expSize           int64
+	}{
+		{
+			name:    "success with the default type",
+			expSize: cloud.DefaultVolumeSize,
+		},
+		{
+			name:              "success with a custom default type",
+			defaultVolumeType: cloud.VolumeTypeST1,
+			expSize:           util.GiBToBytes(cloud.MinVolumeSizeGiBHDD),
+		},
+		{
+			name:              "success with a type parameter overriding the default",
+			defaultVolumeType: cloud.VolumeTypeST1,
+			params:            map[string]string{volumeTypeKey: cloud.VolumeTypeGP2},
+			expSize:           cloud.DefaultVolumeSize,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{DefaultVolumeType: tc.defaultVolumeType})
+
+		resp, err := awsDriver.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:               "test-vol",
+			VolumeCapabilities: volCaps,
+			Parameters:         tc.params,
+		})
+		if err != nil {
+			t.Fatalf("Could not create volume: %v", err)
+		}
+		if size := resp.GetVolume().GetCapacityBytes(); size != tc.expSize {
+			t.Fatalf("Expected volume capacity bytes: %v, got: %v", tc.expSize, size)
+		}
+	}
+}
+
+func TestCreateVolumeZoneFallback(t *testing.T) {
+	volCaps := []*csi.VolumeCapability{stdNodeVolCap}
+	requirement := &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{
+			{Segments: map[string]string{topologyKey: "us-east-1a"}},
+			{Segments: map[string]string{topologyKey: "us-east-1b"}},
+		},
+		Preferred: []*csi.Topology{
+			{Segments: map[string]string{topologyKey: "us-east-1b"}},
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		requirement *csi.TopologyRequirement
+		fullZones   []string
+		// unknownZone clears the controller's zone
+		unknownZone bool
+		expZone     string
+		expErrCode  codes.Code
+	}{
+		{
+			name:        "success in the preferred zone",
+			requirement: requirement,
+			expZone:     "us-east-1b",
+		},
+		{
+			name:        "success in the next zone when the preferred one is full",
+			requirement: requirement,
+			fullZones:   []string{"us-east-1b"},
+			expZone:     "us-east-1a",
+		},
+		{
+			name:        "fail all zones full",
+			requirement: requirement,
+			fullZones:   []string{"us-east-1a", "us-east-1b"},
+			expErrCode:  codes.ResourceExhausted,
+		},
+		{
+			name:       "fail default zone full",
+			fullZones:  []string{"az"},
+			expErrCode: codes.ResourceExhausted,
+		},
+		{
+			name:        "success in the requested zone when the controller's zone is unknown",
+			requirement: requirement,
+			unknownZone: true,
+			expZone:     "us-east-1b",
+		},
+		{
+			name:        "fail no requirement and the controller's zone is unknown",
+			unknownZone: true,
+			expErrCode:  codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		fakeCloud := cloud.NewFakeCloudProvider()
+		fakeCloud.CreateDiskZoneErrs = map[string]error{}
+		for _, zone := range tc.fullZones {
+			fakeCloud.CreateDiskZoneErrs[zone] = cloud.ErrInsufficientVolumeCapacity
+		}
+		if tc.unknownZone {
+			fakeCloud.Metadata.AvailabilityZone = ""
+		}
+		awsDriver := NewDriver(fakeCloud, NewFakeMounter(), &DriverOptions{})
+
+		resp, err := awsDriver.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:                      "test-vol",
+			VolumeCapabilities:        volCaps,
+			AccessibilityRequirements: tc.requirement,
+		})
+		if err != nil {
+			expectErrCode(t, err, tc.expErrCode)
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+		if zone := resp.GetVolume().GetAccessibleTopology()[0].GetSegments()[topologyKey]; zone != tc.expZone {
+			t.Fatalf("Expected volume in zone %q, got: %q", tc.expZone, zone)
+		}
+	}
+}
+
+func TestCreateVolumeFromSnapshot(t *testing.T) {
+	volCaps := []*csi.VolumeCapability{stdNodeVolCap}
+	snapshotBytes := util.GiBToBytes(10)
+
+	testCases := []struct {
+		name       string
+		capRange   *csi.CapacityRange
+		snapshotID string
+		expSize    int64
+		expErrCode codes.Code
+	}{
+		{
+			name:     "success larger than snapshot",
+			capRange: &csi.CapacityRange{RequiredBytes: util.GiBToBytes(20)},
+			expSize:  util.GiBToBytes(20),
+		},
+		{
+			name:     "success rounded up to snapshot size",
+			capRange: &csi.CapacityRange{RequiredBytes: util.GiBToBytes(5)},
+			expSize:  snapshotBytes,
+		},
+		{
+			name:       "fail limit below snapshot size",
+			capRange:   &csi.CapacityRange{RequiredBytes: util.GiBToBytes(5), LimitBytes: util.GiBToBytes(5)},
+			expErrCode: codes.OutOfRange,
+		},
+		{
+			name:       "fail snapshot not found",
+			capRange:   &csi.CapacityRange{RequiredBytes: util.GiBToBytes(20)},
+			snapshotID: "snap-not-found",
+			expErrCode: codes.NotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{})
+
+		source, err := awsDriver.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:               "source-vol",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: snapshotBytes},
+			VolumeCapabilities: volCaps,
+		})
+		if err != nil {
+			t.Fatalf("Could not create source volume: %v", err)
+		}
+		snap, err := awsDriver.CreateSnapshot(context.TODO(), &csi.CreateSnapshotRequest{
+			Name:           "test-snapshot",
+			SourceVolumeId: source.GetVolume().GetId(),
+		})
+		if err != nil {
+			t.Fatalf("Could not create snapshot: %v", err)
+		}
+		snapshotID := snap.GetSnapshot().GetId()
+		if len(tc.snapshotID) != 0 {
+			snapshotID = tc.snapshotID
+		}
+
+		contentSource := &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{Id: snapshotID},
+			},
+		}
+		resp, err := awsDriver.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:                "restored-vol",
+			CapacityRange:       tc.capRange,
+			VolumeCapabilities:  volCaps,
+			VolumeContentSource: contentSource,
+		})
+		if err != nil {
+			expectErrCode(t, err, tc.expErrCode)
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+
+		vol := resp.GetVolume()
+		if vol.GetCapacityBytes() != tc.expSize {
+			t.Fatalf("Expected volume capacity %d, got %d", tc.expSize, vol.GetCapacityBytes())
+		}
+		if vol.GetContentSource().GetSnapshot().GetId() != snapshotID {
+			t.Fatalf("Expected content source snapshot %q, got %v", snapshotID, vol.GetContentSource())
+		}
+
+		// A retried restore returns the same volume, but the name can't be
+		// reused for a volume without the snapshot
+		retried, err := awsDriver.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:                "restored-vol",
+			CapacityRange:       tc.capRange,
+			VolumeCapabilities:  volCaps,
+			VolumeContentSource: contentSource,
+		})
+		if err != nil {
+			t.Fatalf("Could not retry restore: %v", err)
+		}
+		if retried.GetVolume().GetId() != vol.GetId() {
+			t.Fatalf("Expected retried restore to return volume %q, got %q", vol.GetId(), retried.GetVolume().GetId())
+		}
+		_, err = awsDriver.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:               "restored-vol",
+			CapacityRange:      tc.capRange,
+			VolumeCapabilities: volCaps,
+		})
+		expectErrCode(t, err, codes.AlreadyExists)
+	}
+}
+
+func TestIsValidVolumeCapabilities(t *testing.T) {
+	newCap := func(block bool, mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		c := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode}}
+		if block {
+			c.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+		} else {
+			c.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}
+		}
+		return c
+	}
+
+	testCases := []struct {
+		name                string
+		multiNodeReaderOnly bool
+		volCaps             []*csi.VolumeCapability
+		expValid            bool
+	}{
+		{
+			name:     "single node writer mount",
+			volCaps:  []*csi.VolumeCapability{newCap(false, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			expValid: true,
+		},
+		{
+			name:     "single node writer block",
+			volCaps:  []*csi.VolumeCapability{newCap(true, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			expValid: true,
+		},
+		{
+			name: "multi node reader only disabled",
+			volCaps: []*csi.VolumeCapability{
+				newCap(false, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+			},
+		},
+		{
+			name:                "several supported modes",
+			multiNodeReaderOnly: true,
+			volCaps: []*csi.VolumeCapability{
+				newCap(false, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				newCap(false, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+			},
+			expValid: true,
+		},
+		{
+			name:    "multi node multi writer block",
+			volCaps: []*csi.VolumeCapability{newCap(true, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+		},
+		{
+			name: "one unsupported mode",
+			volCaps: []*csi.VolumeCapability{
+				newCap(false, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				newCap(false, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			},
+		},
+		{
+			name:    "no access mode",
+			volCaps: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{MultiNodeReaderOnly: tc.multiNodeReaderOnly})
+		if valid := awsDriver.isValidVolumeCapabilities(tc.volCaps); valid != tc.expValid {
+			t.Fatalf("Expected volume capabilities to be valid: %v, got: %v", tc.expValid, valid)
+		}
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	testCases := []struct {
+		name       string
+		req        *csi.DeleteVolumeRequest
+		expResp    *csi.DeleteVolumeResponse
+		expErrCode codes.Code
+	}{
+		{
+			name: "success normal",
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: "vol-test",
+			},
+			expResp: &csi.DeleteVolumeResponse{},
+		},
+		{
+			name: "success invalid volume id",
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: "invalid-volume-name",
+			},
+			expResp: &csi.DeleteVolumeResponse{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{})
+		_, err := awsDriver.DeleteVolume(context.TODO(), tc.req)
+		if err != nil {
+			srvErr, ok := status.FromError(err)
+			if !ok {
+				t.Fatalf("Could not get error status code from error: %v", srvErr)
+			}
+			if srvErr.Code() != tc.expErrCode {
+				t.Fatalf("Expected error code %d, got %d", tc.expErrCode, srvErr.Code())
+			}
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+	}
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	testCases := []struct {
+		name       string
+		req        *csi.CreateSnapshotRequest
+		extraReq   *csi.CreateSnapshotRequest
+		expSnap    *csi.Snapshot
+		expErrCode codes.Code
+	}{
+		{
+			name: "success normal",
+			req: &csi.CreateSnapshotRequest{
+				Name:           "test-snapshot",
+				SourceVolumeId: "vol-test",
+			},
+			expSnap: &csi.Snapshot{
+				SourceVolumeId: "vol-test",
+				Status:         &csi.SnapshotStatus{Type: csi.SnapshotStatus_READY},
+			},
+		},
+		{
+			name: "fail no name",
+			req: &csi.CreateSnapshotRequest{
+				SourceVolumeId: "vol-test",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no source volume",
+			req: &csi.CreateSnapshotRequest{
+				Name: "test-snapshot",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "success same name and same source volume",
+			req: &csi.CreateSnapshotRequest{
+				Name:           "test-snapshot",
+				SourceVolumeId: "vol-test",
+			},
+			extraReq: &csi.CreateSnapshotRequest{
+				Name:           "test-snapshot",
+				SourceVolumeId: "vol-test",
+			},
+			expSnap: &csi.Snapshot{
+				SourceVolumeId: "vol-test",
+				Status:         &csi.SnapshotStatus{Type: csi.SnapshotStatus_READY},
+			},
+		},
+		{
+			name: "fail same name and different source volume",
+			req: &csi.CreateSnapshotRequest{
+				Name:           "test-snapshot",
+				SourceVolumeId: "vol-test",
+			},
+			extraReq: &csi.CreateSnapshotRequest{
+				Name:           "test-snapshot",
+				SourceVolumeId: "vol-other",
+			},
+			expErrCode: codes.AlreadyExists,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{})
+
+		resp, err := awsDriver.CreateSnapshot(context.TODO(), tc.req)
+		if err != nil {
+			srvErr, ok := status.FromError(err)
+			if !ok {
+				t.Fatalf("Could not get error status code from error: %v", srvErr)
+			}
+			if srvErr.Code() != tc.expErrCode {
+				t.Fatalf("Expected error code %d, got %d", tc.expErrCode, srvErr.Code())
+			}
+			continue
+		}
+
+		// Repeat the same request and check the results of the second call
+		if tc.extraReq != nil {
+			firstID := resp.GetSnapshot().GetId()
+			resp, err = awsDriver.CreateSnapshot(context.TODO(), tc.extraReq)
+			if err != nil {
+				srvErr, ok := status.FromError(err)
+				if !ok {
+					t.Fatalf("Could not get error status code from error: %v", srvErr)
+				}
+				if srvErr.Code() != tc.expErrCode {
+					t.Fatalf("Expected error code %d, got %d", tc.expErrCode, srvErr.Code())
+				}
+				continue
+			}
+			if resp.GetSnapshot().GetId() != firstID {
+				t.Fatalf("Expected snapshot ID %q, got %q", firstID, resp.GetSnapshot().GetId())
+			}
+		}
+
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+
+		snap := resp.GetSnapshot()
+		if snap == nil {
+			t.Fatalf("Expected snapshot %v, got nil", tc.expSnap)
+		}
+		if len(snap.GetId()) == 0 {
+			t.Fatalf("Expected snapshot ID, got empty string")
+		}
+		if snap.GetSourceVolumeId() != tc.expSnap.GetSourceVolumeId() {
+			t.Fatalf("Expected source volume ID %q, got %q", tc.expSnap.GetSourceVolumeId(), snap.GetSourceVolumeId())
+		}
+		if snap.GetStatus().GetType() != tc.expSnap.GetStatus().GetType() {
+			t.Fatalf("Expected snapshot status %v, got %v", tc.expSnap.GetStatus().GetType(), snap.GetStatus().GetType())
+		}
+	}
+}
+
+func TestCreateSnapshotReadyTimeout(t *testing.T) {
+	testCases := []struct {
+		name       string
+		timeout    time.Duration
+		expTimeout time.Duration
+	}{
+		{
+			name:       "default timeout",
+			expTimeout: DefaultSnapshotReadyTimeout,
+		},
+		{
+			name:       "custom timeout",
+			timeout:    time.Minute,
+			expTimeout: time.Minute,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		fakeCloud := cloud.NewFakeCloudProvider()
+		awsDriver := NewDriver(fakeCloud, NewFakeMounter(), &DriverOptions{SnapshotReadyTimeout: tc.timeout})
+
+		_, err := awsDriver.CreateSnapshot(context.TODO(), &csi.CreateSnapshotRequest{
+			Name:           "test-snapshot",
+			SourceVolumeId: "vol-test",
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if timeout := fakeCloud.SnapshotOptions.ReadyTimeout; timeout != tc.expTimeout {
+			t.Fatalf("Expected ready timeout %v, got %v", tc.expTimeout, timeout)
+		}
+	}
+}
+
+func TestDeleteSnapshot(t *testing.T) {
+	testCases := []struct {
+		name string
+		req  *csi.DeleteSnapshotRequest
+		// If set, a snapshot is created beforehand and its ID is used in the request
+		existing   bool
+		expErrCode codes.Code
+	}{
+		{
+			name:     "success normal",
+			req:      &csi.DeleteSnapshotRequest{},
+			existing: true,
+		},
+		{
+			name: "success not found",
+			req: &csi.DeleteSnapshotRequest{
+				SnapshotId: "snap-not-found",
+			},
+		},
+		{
+			name:       "fail no snapshot id",
+			req:        &csi.DeleteSnapshotRequest{},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{})
+
+		if tc.existing {
+			resp, err := awsDriver.CreateSnapshot(context.TODO(), &csi.CreateSnapshotRequest{Name: "test-snapshot", SourceVolumeId: "vol-test"})
+			if err != nil {
+				t.Fatalf("Could not create snapshot: %v", err)
+			}
+			tc.req.SnapshotId = resp.GetSnapshot().GetId()
+		}
+
+		_, err := awsDriver.DeleteSnapshot(context.TODO(), tc.req)
+		if err != nil {
+			srvErr, ok := status.FromError(err)
+			if !ok {
+				t.Fatalf("Could not get error status code from error: %v", srvErr)
+			}
+			if srvErr.Code() != tc.expErrCode {
+				t.Fatalf("Expected error code %d, got %d", tc.expErrCode, srvErr.Code())
+			}
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+	}
+}
+
+func TestListSnapshots(t *testing.T) {
+	testCases := []struct {
+		name       string
+		req        *csi.ListSnapshotsRequest
+		expEntries int
+		expToken   string
+		expErrCode codes.Code
+	}{
+		{
+			name:       "success normal",
+			req:        &csi.ListSnapshotsRequest{},
+			expEntries: 3,
+		},
+		{
+			name:       "success max entries",
+			req:        &csi.ListSnapshotsRequest{MaxEntries: 2},
+			expEntries: 2,
+			expToken:   "2",
+		},
+		{
+			name:       "success source volume",
+			req:        &csi.ListSnapshotsRequest{SourceVolumeId: "vol-test-1"},
+			expEntries: 1,
+		},
+		{
+			name:       "success snapshot not found",
+			req:        &csi.ListSnapshotsRequest{SnapshotId: "snap-not-found"},
+			expEntries: 0,
+		},
+		{
+			name:       "fail negative max entries",
+			req:        &csi.ListSnapshotsRequest{MaxEntries: -1},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "fail invalid starting token",
+			req:        &csi.ListSnapshotsRequest{StartingToken: "invalid-token"},
+			expErrCode: codes.Aborted,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{})
+		for i := 0; i < 3; i++ {
+			req := &csi.CreateSnapshotRequest{
+				Name:           fmt.Sprintf("test-snapshot-%d", i),
+				SourceVolumeId: fmt.Sprintf("vol-test-%d", i),
+			}
+			if _, err := awsDriver.CreateSnapshot(context.TODO(), req); err != nil {
+				t.Fatalf("Could not create snapshot: %v", err)
+			}
+		}
+
+		resp, err := awsDriver.ListSnapshots(context.TODO(), tc.req)
+		if err != nil {
+			srvErr, ok := status.FromError(err)
+			if !ok {
+				t.Fatalf("Could not get error status code from error: %v", srvErr)
+			}
+			if srvErr.Code() != tc.expErrCode {
+				t.Fatalf("Expected error code %d, got %d", tc.expErrCode, srvErr.Code())
+			}
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+
+		if len(resp.GetEntries()) != tc.expEntries {
+			t.Fatalf("Expected %d entries, got %d", tc.expEntries, len(resp.GetEntries()))
+		}
+		if resp.GetNextToken() != tc.expToken {
+			t.Fatalf("Expected next token %q, got %q", tc.expToken, resp.GetNextToken())
+		}
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	stdVolSize := int64(5 * 1024 * 1024 * 1024)
+
+	testCases := []struct {
+		name       string
+		req        *csi.ListVolumesRequest
+		expEntries int
+		expToken   string
+		expErrCode codes.Code
+	}{
+		{
+			name:       "success normal",
+			req:        &csi.ListVolumesRequest{},
+			expEntries: 3,
+		},
+		{
+			name:       "success max entries",
+			req:        &csi.ListVolumesRequest{MaxEntries: 2},
+			expEntries: 2,
+			expToken:   "2",
+		},
+		{
+			name:       "success starting token",
+			req:        &csi.ListVolumesRequest{StartingToken: "2"},
+			expEntries: 1,
+		},
+		{
+			name:       "fail negative max entries",
+			req:        &csi.ListVolumesRequest{MaxEntries: -1},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "fail invalid starting token",
+			req:        &csi.ListVolumesRequest{StartingToken: "invalid-token"},
+			expErrCode: codes.Aborted,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		fakeCloud := cloud.NewFakeCloudProvider()
+		for i := 0; i < 3; i++ {
+			if _, err := fakeCloud.CreateDisk(context.TODO(), fmt.Sprintf("test-volume-%d", i), &cloud.DiskOptions{CapacityBytes: stdVolSize}); err != nil {
+				t.Fatalf("Could not create disk: %v", err)
+			}
+		}
+		awsDriver := NewDriver(fakeCloud, NewFakeMounter(), &DriverOptions{})
+
+		resp, err := awsDriver.ListVolumes(context.TODO(), tc.req)
+		if err != nil {
+			srvErr, ok := status.FromError(err)
+			if !ok {
+				t.Fatalf("Could not get error status code from error: %v", srvErr)
+			}
+			if srvErr.Code() != tc.expErrCode {
+				t.Fatalf("Expected error code %d, got %d", tc.expErrCode, srvErr.Code())
+			}
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+
+		if len(resp.GetEntries()) != tc.expEntries {
+			t.Fatalf("Expected %d entries, got %d", tc.expEntries, len(resp.GetEntries()))
+		}
+		if resp.GetNextToken() != tc.expToken {
+			t.Fatalf("Expected next token %q, got %q", tc.expToken, resp.GetNextToken())
+		}
+		for _, entry := range resp.GetEntries() {
+			if entry.GetVolume().GetCapacityBytes() != stdVolSize {
+				t.Fatalf("Expected capacity %d, got %d", stdVolSize, entry.GetVolume().GetCapacityBytes())
+			}
+		}
+	}
+}
+
+func TestControllerGetCapabilities(t *testing.T) {
+	awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{})
+
+	resp, err := awsDriver.ControllerGetCapabilities(context.TODO(), &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("Could not get controller capabilities: %v", err)
+	}
+
+	expCaps := map[csi.ControllerServiceCapability_RPC_Type]bool{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME:     true,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME: true,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT:   true,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS:           true,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES:             true,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY:             true,
+	}
+	caps := resp.GetCapabilities()
+	if len(caps) != len(expCaps) {
+		t.Fatalf("Expected %d capabilities, got: %v", len(expCaps), caps)
+	}
+	for _, c := range caps {
+		if !expCaps[c.GetRpc().GetType()] {
+			t.Fatalf("Unexpected capability %v", c.GetRpc().GetType())
+		}
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	maxCapacity := int64(16 * 1024 * 1024 * 1024 * 1024)
+
+	testCases := []struct {
+		name        string
+		req         *csi.GetCapacityRequest
+		expCapacity int64
+		expErrCode  codes.Code
+	}{
+		{
+			name:        "success normal",
+			req:         &csi.GetCapacityRequest{},
+			expCapacity: maxCapacity,
+		},
+		{
+			name: "success zone and volume type",
+			req: &csi.GetCapacityRequest{
+				Parameters:         map[string]string{"type": cloud.VolumeTypeIO1},
+				AccessibleTopology: &csi.Topology{Segments: map[string]string{topologyKey: "regiona"}},
+			},
+			expCapacity: maxCapacity,
+		},
+		{
+			name: "success zone of another region",
+			req: &csi.GetCapacityRequest{
+				AccessibleTopology: &csi.Topology{Segments: map[string]string{topologyKey: "us-west-2a"}},
+			},
+			expCapacity: 0,
+		},
+		{
+			name: "fail invalid volume type",
+			req: &csi.GetCapacityRequest{
+				Parameters: map[string]string{"type": "standard"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail invalid parameter",
+			req: &csi.GetCapacityRequest{
+				Parameters: map[string]string{"unknown": "value"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{})
+
+		resp, err := awsDriver.GetCapacity(context.TODO(), tc.req)
+		if err != nil {
+			srvErr, ok := status.FromError(err)
+			if !ok {
+				t.Fatalf("Could not get error status code from error: %v", srvErr)
+			}
+			if srvErr.Code() != tc.expErrCode {
+				t.Fatalf("Expected error code %d, got %d", tc.expErrCode, srvErr.Code())
+			}
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+		if resp.GetAvailableCapacity() != tc.expCapacity {
+			t.Fatalf("Expected capacity %d, got %d", tc.expCapacity, resp.GetAvailableCapacity())
+		}
+	}
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	blockVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+
+	stdVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+
+	testCases := []struct {
+		name       string
+		req        *csi.ControllerPublishVolumeRequest
+		attachErr  error
+		expErrCode codes.Code
+	}{
+		{
+			name: "success normal",
+			req: &csi.ControllerPublishVolumeRequest{
+				VolumeId:         "vol-test",
+				NodeId:           "instanceID",
+				VolumeCapability: stdVolCap,
+			},
+			expErrCode: codes.OK,
+		},
+		{
+			name: "fail attachment limit exceeded",
+			req: &csi.ControllerPublishVolumeRequest{
+				VolumeId:         "vol-test",
+				NodeId:           "instanceID",
+				VolumeCapability: stdVolCap,
+			},
+			attachErr:  cloud.ErrAttachmentLimitExceeded,
+			expErrCode: codes.ResourceExhausted,
+		},
+		{
+			name: "fail volume attached to another node",
+			req: &csi.ControllerPublishVolumeRequest{
+				VolumeId:         "vol-test",
+				NodeId:           "instanceID",
+				VolumeCapability: stdVolCap,
+			},
+			attachErr:  &cloud.VolumeInUseError{VolumeID: "vol-test", InstanceID: "otherInstanceID"},
+			expErrCode: codes.FailedPrecondition,
+		},
+		{
+			name: "fail volume stuck attaching",
+			req: &csi.ControllerPublishVolumeRequest{
+				VolumeId:         "vol-test",
+				NodeId:           "instanceID",
+				VolumeCapability: stdVolCap,
+			},
+			attachErr:  &cloud.AttachmentTimeoutError{VolumeID: "vol-test", InstanceID: "instanceID", Device: "/dev/xvdba"},
+			expErrCode: codes.DeadlineExceeded,
+		},
+		{
+			name: "fail block volume with filesystem",
+			req: &csi.ControllerPublishVolumeRequest{
+				VolumeId:         "vol-test",
+				NodeId:           "instanceID",
+				VolumeCapability: blockVolCap,
+				VolumeAttributes: map[string]string{"fsType": "ext4"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no volume capability",
+			req: &csi.ControllerPublishVolumeRequest{
+				VolumeId: "vol-test",
+				NodeId:   "instanceID",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		fakeCloud := cloud.NewFakeCloudProvider()
+		fakeCloud.AttachErr = tc.attachErr
+		awsDriver := NewDriver(fakeCloud, NewFakeMounter(), &DriverOptions{})
+
+		_, err := awsDriver.ControllerPublishVolume(context.TODO(), tc.req)
 		if err != nil {
 			srvErr, ok := status.FromError(err)
 			if !ok {
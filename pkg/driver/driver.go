@@ -17,59 +17,237 @@ limitations under the License.
 package driver
 
 import (
-	"context"
+	"fmt"
 	"net"
+	"os"
+	"regexp"
+	"sync"
+	"time"
 
 	"github.com/bertinatto/ebs-csi-driver/pkg/cloud"
 	"github.com/bertinatto/ebs-csi-driver/pkg/util"
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
-	"github.com/golang/glog"
 	"google.golang.org/grpc"
-	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/klog"
 )
 
 const (
-	driverName    = "com.amazon.aws.csi.ebs"
-	vendorVersion = "0.0.1" // FIXME
+	// DefaultDriverName is the name the driver is registered with by default.
+	DefaultDriverName = "com.amazon.aws.csi.ebs"
+
+	// maxDriverNameLength is the longest driver name allowed by the CSI spec.
+	maxDriverNameLength = 63
+
+	// topologyKey is the topology segment holding the availability zone.
+	topologyKey = "topology.ebs.csi.aws.com/zone"
+
+	// DefaultShutdownTimeout is how long Stop waits for the RPCs in progress
+	// to finish before cancelling them.
+	DefaultShutdownTimeout = 30 * time.Second
+
+	// DefaultSnapshotReadyTimeout is how long CreateSnapshot waits for a new
+	// snapshot to be ready by default.
+	DefaultSnapshotReadyTimeout = 10 * time.Second
+)
+
+// version and gitCommit identify the build, they're set with -ldflags "-X".
+var (
+	version   = "unknown"
+	gitCommit = "unknown"
+)
+
+// driverNameRegexp matches the names allowed by the CSI spec: alphanumerics,
+// dashes and dots, beginning and ending with an alphanumeric.
+var driverNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([-a-zA-Z0-9.]*[a-zA-Z0-9])?$`)
+
+// Mode selects the CSI services run by the driver.
+type Mode string
+
+const (
+	// AllMode runs both the controller and the node services.
+	AllMode Mode = "all"
+
+	// ControllerMode runs the controller service only, which doesn't
+	// need to run on the EC2 instances the volumes are attached to.
+	ControllerMode Mode = "controller"
+
+	// NodeMode runs the node service only.
+	NodeMode Mode = "node"
 )
 
 type Driver struct {
+	name     string
 	endpoint string
 	nodeID   string
+	mode     Mode
 
 	cloud cloud.Cloud
-	srv   *grpc.Server
 
-	mounter *mount.SafeFormatAndMount
+	// srvMu guards srv and ready, which are set by Run and may be read
+	// by Stop and the health checks from other goroutines, and stopped,
+	// which is set by Stop so that Run doesn't serve after it was called.
+	srvMu   sync.Mutex
+	srv     *grpc.Server
+	ready   bool
+	stopped bool
+
+	shutdownTimeout time.Duration
+
+	// snapshotReadyTimeout is how long CreateSnapshot waits for a new
+	// snapshot to be ready. After that, the snapshot is reported as
+	// uploading so the CO can poll it again.
+	snapshotReadyTimeout time.Duration
+
+	// rpcTimeout is how long an RPC may run, unless its method has its own
+	// timeout in rpcTimeouts. Zero means no timeout.
+	rpcTimeout  time.Duration
+	rpcTimeouts map[string]time.Duration
+
+	mounter Mounter
+
+	extraTags map[string]string
+	clusterID string
+
+	// defaultVolumeType is the type of the volumes created without a type
+	// parameter, empty for the cloud's default.
+	defaultVolumeType string
+
+	volumeAttachLimit int64
+
+	// volumesInFlight and namesInFlight hold the volume IDs and the volume
+	// names of the mutating operations in progress, respectively.
+	volumesInFlight *inFlight
+	namesInFlight   *inFlight
 
 	volumeCaps     []csi.VolumeCapability_AccessMode
 	controllerCaps []csi.ControllerServiceCapability_RPC_Type
 	nodeCaps       []csi.NodeServiceCapability_RPC_Type
 }
 
-func NewDriver(cloud cloud.Cloud, mounter *mount.SafeFormatAndMount, endpoint string) *Driver {
-	glog.Infof("Driver: %v", driverName)
+// DriverOptions holds the options used to create a Driver.
+type DriverOptions struct {
+	// Name is the name the driver is registered with, in reverse domain name
+	// notation. Defaults to DefaultDriverName.
+	Name string
+
+	// Endpoint is the CSI endpoint the driver listens on.
+	Endpoint string
+
+	// Mode selects the CSI services run by the driver. Defaults to AllMode.
+	Mode Mode
+
+	// ExtraTags are added to every volume created by the driver.
+	ExtraTags map[string]string
+
+	// ClusterID is the ID of the cluster the created volumes are tagged with, if set.
+	ClusterID string
+
+	// DefaultVolumeType is the type of the volumes created without a type
+	// parameter. Defaults to cloud.DefaultVolumeType.
+	DefaultVolumeType string
+
+	// MultiNodeReaderOnly advertises the MULTI_NODE_READER_ONLY access mode.
+	// An EBS volume can only be attached to a single node, unless it was
+	// created with Multi-Attach, so it's disabled by default.
+	MultiNodeReaderOnly bool
+
+	// VolumeAttachLimit overrides the number of volumes that can be attached
+	// to the node, derived from the instance type by default.
+	VolumeAttachLimit int64
+
+	// ShutdownTimeout is how long Stop waits for the RPCs in progress to
+	// finish. Defaults to DefaultShutdownTimeout.
+	ShutdownTimeout time.Duration
+
+	// SnapshotReadyTimeout is how long CreateSnapshot waits for a new
+	// snapshot to be ready. Defaults to DefaultSnapshotReadyTimeout.
+	SnapshotReadyTimeout time.Duration
+
+	// SkipFsck mounts the formatted devices without checking their
+	// filesystem with fsck first, which NodeStageVolume does by default.
+	SkipFsck bool
+
+	// RPCTimeout is how long an RPC may run before it's cancelled with
+	// DeadlineExceeded. Zero means no timeout.
+	RPCTimeout time.Duration
+
+	// RPCTimeouts overrides RPCTimeout for the methods it holds, keyed by
+	// method name, e.g. ControllerPublishVolume.
+	RPCTimeouts map[string]time.Duration
+}
+
+func NewDriver(cloud cloud.Cloud, mounter Mounter, opts *DriverOptions) *Driver {
+	name := opts.Name
+	if len(name) == 0 {
+		name = DefaultDriverName
+	}
+	klog.Infof("Driver: %v %v", name, VersionString())
 	if mounter == nil {
-		mounter = newSafeMounter()
+		mounter = newNodeMounter()
+	}
+	if m, ok := mounter.(*NodeMounter); ok && opts.SkipFsck {
+		m.Exec = noFsckExec{m.Exec}
+	}
+	shutdownTimeout := opts.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	snapshotReadyTimeout := opts.SnapshotReadyTimeout
+	if snapshotReadyTimeout == 0 {
+		snapshotReadyTimeout = DefaultSnapshotReadyTimeout
+	}
+	mode := opts.Mode
+	if len(mode) == 0 {
+		mode = AllMode
+	}
+	// TODO: advertise MULTI_NODE_MULTI_WRITER for io1/io2 volumes created with
+	// Multi-Attach once the vendored aws-sdk-go supports MultiAttachEnabled
+	volumeCaps := []csi.VolumeCapability_AccessMode{
+		csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+	if opts.MultiNodeReaderOnly {
+		volumeCaps = append(volumeCaps, csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		})
 	}
 	m := cloud.GetMetadata()
 	return &Driver{
-		endpoint: endpoint,
-		nodeID:   m.GetInstanceID(),
-		cloud:    cloud,
-		mounter:  mounter,
-		volumeCaps: []csi.VolumeCapability_AccessMode{
-			csi.VolumeCapability_AccessMode{
-				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-			},
-			csi.VolumeCapability_AccessMode{
-				Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
-			},
-		},
+		name:                 name,
+		endpoint:             opts.Endpoint,
+		mode:                 mode,
+		shutdownTimeout:      shutdownTimeout,
+		snapshotReadyTimeout: snapshotReadyTimeout,
+		rpcTimeout:           opts.RPCTimeout,
+		rpcTimeouts:          opts.RPCTimeouts,
+
+		extraTags: opts.ExtraTags,
+		clusterID: opts.ClusterID,
+
+		defaultVolumeType: opts.DefaultVolumeType,
+
+		volumeAttachLimit: opts.VolumeAttachLimit,
+		nodeID:            m.GetInstanceID(),
+		cloud:             cloud,
+		mounter:           mounter,
+
+		volumesInFlight: newInFlight(),
+		namesInFlight:   newInFlight(),
+		volumeCaps:      volumeCaps,
+		// TODO: advertise EXPAND_VOLUME, backed by ResizeDisk, and CLONE_VOLUME
+		// once the driver moves to CSI v1.0, v0.3 has neither
 		controllerCaps: []csi.ControllerServiceCapability_RPC_Type{
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 		},
+		// TODO: implement NodeGetVolumeStats and advertise GET_VOLUME_STATS
+		// once the driver moves to CSI 1.1, v0.3 has neither. The same goes for
+		// VOLUME_MOUNT_GROUP, which needs CSI 1.5
 		nodeCaps: []csi.NodeServiceCapability_RPC_Type{
 			csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		},
@@ -77,44 +255,128 @@ func NewDriver(cloud cloud.Cloud, mounter *mount.SafeFormatAndMount, endpoint st
 }
 
 func (d *Driver) Run() error {
+	switch d.mode {
+	case AllMode, ControllerMode, NodeMode:
+	default:
+		return fmt.Errorf("unknown mode %q, must be %q, %q or %q", d.mode, AllMode, ControllerMode, NodeMode)
+	}
+
+	if err := validateDriverName(d.name); err != nil {
+		return err
+	}
+
+	if len(d.defaultVolumeType) != 0 && !cloud.IsValidVolumeType(d.defaultVolumeType) {
+		return fmt.Errorf("invalid default volume type %q", d.defaultVolumeType)
+	}
+
+	// The node service identifies the node by its instance ID, volumes
+	// would be attached to no instance without it
+	if d.mode != ControllerMode && len(d.nodeID) == 0 {
+		return fmt.Errorf("the node service requires the instance ID from the EC2 instance metadata")
+	}
+
 	scheme, addr, err := util.ParseEndpoint(d.endpoint)
 	if err != nil {
 		return err
 	}
 
+	// Remove the socket left behind if the driver didn't exit cleanly,
+	// otherwise listening fails with "address already in use"
+	if scheme == "unix" {
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove unix domain socket %q: %v", addr, err)
+		}
+	}
+
 	listener, err := net.Listen(scheme, addr)
 	if err != nil {
 		return err
 	}
 
-	logErr := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		resp, err := handler(ctx, req)
-		if err != nil {
-			glog.Errorf("GRPC error: %v", err)
-		}
-		return resp, err
-	}
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logErr),
+		grpc.UnaryInterceptor(chainUnaryInterceptors(logErr, recoverPanic, d.enforceTimeout)),
+	}
+	srv := grpc.NewServer(opts...)
+
+	csi.RegisterIdentityServer(srv, d)
+	if d.mode != NodeMode {
+		csi.RegisterControllerServer(srv, d)
+	}
+	if d.mode != ControllerMode {
+		csi.RegisterNodeServer(srv, d)
+	}
+
+	d.srvMu.Lock()
+	if d.stopped {
+		d.srvMu.Unlock()
+		klog.Infof("Driver stopped before serving")
+		return listener.Close()
 	}
-	d.srv = grpc.NewServer(opts...)
+	d.srv = srv
+	d.ready = true
+	d.srvMu.Unlock()
 
-	csi.RegisterIdentityServer(d.srv, d)
-	csi.RegisterControllerServer(d.srv, d)
-	csi.RegisterNodeServer(d.srv, d)
+	klog.Infof("Listening for connections on address: %#v", listener.Addr())
+	if err := srv.Serve(listener); err != grpc.ErrServerStopped {
+		return err
+	}
+	// Stop was called before the server started serving
+	return nil
+}
 
-	glog.Infof("Listening for connections on address: %#v", listener.Addr())
-	return d.srv.Serve(listener)
+// VersionString returns the version of the driver along with the commit it was built from.
+func VersionString() string {
+	return fmt.Sprintf("%s (commit %s)", version, gitCommit)
 }
 
-func (d *Driver) Stop() {
-	glog.Infof("Stopping server")
-	d.srv.Stop()
+// UserAgent returns the user agent identifying the driver registered as name
+// in the AWS API requests, followed by suffix if it isn't empty.
+func UserAgent(name, suffix string) string {
+	userAgent := fmt.Sprintf("%s/%s", name, version)
+	if len(suffix) != 0 {
+		userAgent += " " + suffix
+	}
+	return userAgent
+}
+
+// validateDriverName checks the name follows the format required by the CSI spec.
+func validateDriverName(name string) error {
+	if len(name) > maxDriverNameLength {
+		return fmt.Errorf("driver name %q is longer than %d characters", name, maxDriverNameLength)
+	}
+	if !driverNameRegexp.MatchString(name) {
+		return fmt.Errorf("driver name %q must consist of alphanumerics, '-' and '.', beginning and ending with an alphanumeric", name)
+	}
+	return nil
 }
 
-func newSafeMounter() *mount.SafeFormatAndMount {
-	return &mount.SafeFormatAndMount{
-		Interface: mount.New(""),
-		Exec:      mount.NewOsExec(),
+// Stop stops accepting new connections and waits for the RPCs in progress
+// to finish. RPCs still running after the shutdown timeout are cancelled.
+// If the driver isn't serving yet, Run returns without serving.
+func (d *Driver) Stop() {
+	d.srvMu.Lock()
+	srv := d.srv
+	d.ready = false
+	d.stopped = true
+	d.srvMu.Unlock()
+	if srv == nil {
+		return
+	}
+
+	klog.Infof("Stopping server")
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	timer := time.NewTimer(d.shutdownTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-stopped:
+	case <-timer.C:
+		klog.Warningf("RPCs still in progress after %v, forcing server to stop", d.shutdownTimeout)
+		srv.Stop()
 	}
 }
@@ -0,0 +1,280 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bertinatto/ebs-csi-driver/pkg/cloud"
+)
+
+func TestStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-driver")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	endpoint := "unix://" + filepath.Join(dir, "csi.sock")
+	awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{Endpoint: endpoint, ShutdownTimeout: time.Second})
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- awsDriver.Run()
+	}()
+
+	waitForServer(t, awsDriver)
+	awsDriver.Stop()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Expected Run to return no error after Stop, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+}
+
+func TestStopBeforeRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-driver")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	endpoint := "unix://" + filepath.Join(dir, "csi.sock")
+	awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{Endpoint: endpoint})
+
+	// A signal may arrive before Run starts serving, Run must not serve then
+	awsDriver.Stop()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- awsDriver.Run()
+	}()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("Expected Run to return no error after Stop, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		awsDriver.Stop()
+		t.Fatal("Run did not return after Stop")
+	}
+}
+
+func TestRunRemovesStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-driver")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Leave a file behind, as a driver that crashed would
+	socket := filepath.Join(dir, "csi.sock")
+	if err := ioutil.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatalf("Could not create stale socket: %v", err)
+	}
+
+	awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{Endpoint: "unix://" + socket})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- awsDriver.Run()
+	}()
+
+	select {
+	case err := <-errs:
+		t.Fatalf("Expected Run to listen on %s, got: %v", socket, err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	waitForServer(t, awsDriver)
+	awsDriver.Stop()
+}
+
+func TestRunMode(t *testing.T) {
+	testCases := []struct {
+		name       string
+		mode       Mode
+		instanceID string
+		volumeType string
+		expErr     bool
+	}{
+		{
+			name:       "success: all services",
+			mode:       AllMode,
+			instanceID: "instanceID",
+		},
+		{
+			name: "success: controller without instance ID",
+			mode: ControllerMode,
+		},
+		{
+			name:   "fail: all services without instance ID",
+			mode:   AllMode,
+			expErr: true,
+		},
+		{
+			name:   "fail: node without instance ID",
+			mode:   NodeMode,
+			expErr: true,
+		},
+		{
+			name:       "fail: unknown mode",
+			mode:       "unknown",
+			instanceID: "instanceID",
+			expErr:     true,
+		},
+		{
+			name:       "fail: invalid default volume type",
+			mode:       AllMode,
+			instanceID: "instanceID",
+			volumeType: "gp1",
+			expErr:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		dir, err := ioutil.TempDir("", "ebs-csi-driver")
+		if err != nil {
+			t.Fatalf("Could not create temporary directory: %v", err)
+		}
+
+		fakeCloud := cloud.NewFakeCloudProvider()
+		fakeCloud.Metadata.InstanceID = tc.instanceID
+		endpoint := "unix://" + filepath.Join(dir, "csi.sock")
+		awsDriver := NewDriver(fakeCloud, NewFakeMounter(), &DriverOptions{Endpoint: endpoint, Mode: tc.mode, DefaultVolumeType: tc.volumeType})
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- awsDriver.Run()
+		}()
+
+		if tc.expErr {
+			select {
+			case err := <-errs:
+				if err == nil {
+					t.Fatal("Expected Run to fail, got nothing")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected Run to fail, it kept running")
+			}
+		} else {
+			waitForServer(t, awsDriver)
+			awsDriver.Stop()
+			if err := <-errs; err != nil {
+				t.Fatalf("Expected Run to return no error after Stop, got: %v", err)
+			}
+		}
+
+		os.RemoveAll(dir)
+	}
+}
+
+func TestValidateDriverName(t *testing.T) {
+	testCases := []struct {
+		name       string
+		driverName string
+		expErr     bool
+	}{
+		{
+			name:       "success: default name",
+			driverName: DefaultDriverName,
+		},
+		{
+			name:       "success: dashes and dots",
+			driverName: "ebs-2.csi.example.com",
+		},
+		{
+			name:       "fail: empty",
+			driverName: "",
+			expErr:     true,
+		},
+		{
+			name:       "fail: invalid characters",
+			driverName: "ebs_csi/example",
+			expErr:     true,
+		},
+		{
+			name:       "fail: ends with a dot",
+			driverName: "ebs.csi.example.com.",
+			expErr:     true,
+		},
+		{
+			name:       "fail: too long",
+			driverName: strings.Repeat("a", maxDriverNameLength+1),
+			expErr:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		err := validateDriverName(tc.driverName)
+		if tc.expErr && err == nil {
+			t.Fatalf("Expected error validating %q, got nothing", tc.driverName)
+		}
+		if !tc.expErr && err != nil {
+			t.Fatalf("Expected no error validating %q, got: %v", tc.driverName, err)
+		}
+	}
+}
+
+// waitForServer waits for the server to be set up by Run.
+func waitForServer(t *testing.T, d *Driver) {
+	for i := 0; i < 100; i++ {
+		d.srvMu.Lock()
+		running := d.srv != nil
+		d.srvMu.Unlock()
+		if running {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Driver did not start")
+}
+
+func TestUserAgent(t *testing.T) {
+	testCases := []struct {
+		name   string
+		suffix string
+		exp    string
+	}{
+		{
+			name: "without suffix",
+			exp:  DefaultDriverName + "/" + version,
+		},
+		{
+			name:   "with suffix",
+			suffix: "cluster/test",
+			exp:    DefaultDriverName + "/" + version + " cluster/test",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		if userAgent := UserAgent(DefaultDriverName, tc.suffix); userAgent != tc.exp {
+			t.Fatalf("Expected user agent %q, got %q", tc.exp, userAgent)
+		}
+	}
+}
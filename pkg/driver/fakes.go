@@ -18,13 +18,14 @@ package driver
 
 import "k8s.io/kubernetes/pkg/util/mount"
 
-func NewFakeMounter() *mount.SafeFormatAndMount {
-	return &mount.SafeFormatAndMount{
-		Interface: &mount.FakeMounter{
-			MountPoints: []mount.MountPoint{},
-			Log:         []mount.FakeAction{},
+func NewFakeMounter() Mounter {
+	return &NodeMounter{
+		mount.SafeFormatAndMount{
+			Interface: &mount.FakeMounter{
+				MountPoints: []mount.MountPoint{},
+				Log:         []mount.FakeAction{},
+			},
+			Exec: mount.NewFakeExec(nil),
 		},
-		Exec: mount.NewFakeExec(nil),
 	}
-
 }
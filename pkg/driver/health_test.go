@@ -0,0 +1,60 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bertinatto/ebs-csi-driver/pkg/cloud"
+)
+
+func TestHealthHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-driver")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	endpoint := "unix://" + filepath.Join(dir, "csi.sock")
+	awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{Endpoint: endpoint, ShutdownTimeout: time.Second})
+	handler := awsDriver.HealthHandler()
+
+	expectStatus := func(path string, expCode int) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != expCode {
+			t.Fatalf("Expected status %d from %s, got %d", expCode, path, recorder.Code)
+		}
+	}
+
+	expectStatus("/healthz", http.StatusOK)
+	expectStatus("/readyz", http.StatusServiceUnavailable)
+
+	go awsDriver.Run()
+	waitForServer(t, awsDriver)
+	expectStatus("/readyz", http.StatusOK)
+
+	awsDriver.Stop()
+	expectStatus("/readyz", http.StatusServiceUnavailable)
+	expectStatus("/healthz", http.StatusOK)
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"sync"
+)
+
+// inFlight tracks the keys, e.g. volume IDs, of the operations in progress,
+// so that only one operation runs at a time for each key.
+type inFlight struct {
+	mux  sync.Mutex
+	keys map[string]struct{}
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{
+		keys: make(map[string]struct{}),
+	}
+}
+
+// Insert marks the key as in progress. It returns false if it already was,
+// in which case the caller must not proceed with the operation.
+func (i *inFlight) Insert(key string) bool {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	if _, found := i.keys[key]; found {
+		return false
+	}
+	i.keys[key] = struct{}{}
+	return true
+}
+
+// Delete marks the operation of the key as done.
+func (i *inFlight) Delete(key string) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	delete(i.keys, key)
+}
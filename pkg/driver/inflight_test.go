@@ -0,0 +1,75 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bertinatto/ebs-csi-driver/pkg/cloud"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"google.golang.org/grpc/codes"
+)
+
+func TestInFlight(t *testing.T) {
+	i := newInFlight()
+
+	if !i.Insert("vol-test") {
+		t.Fatal("Expected first insert to succeed")
+	}
+	if i.Insert("vol-test") {
+		t.Fatal("Expected insert of a key in progress to fail")
+	}
+	if !i.Insert("vol-other") {
+		t.Fatal("Expected insert of a different key to succeed")
+	}
+
+	i.Delete("vol-test")
+	if !i.Insert("vol-test") {
+		t.Fatal("Expected insert after delete to succeed")
+	}
+}
+
+func TestOperationsInFlight(t *testing.T) {
+	awsDriver := NewDriver(cloud.NewFakeCloudProvider(), NewFakeMounter(), &DriverOptions{})
+
+	awsDriver.namesInFlight.Insert("test-vol")
+	_, err := awsDriver.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:               "test-vol",
+		VolumeCapabilities: []*csi.VolumeCapability{stdNodeVolCap},
+	})
+	expectErrCode(t, err, codes.Aborted)
+
+	awsDriver.volumesInFlight.Insert("vol-test")
+	_, err = awsDriver.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "vol-test",
+		NodeId:           "node-test",
+		VolumeCapability: stdNodeVolCap,
+	})
+	expectErrCode(t, err, codes.Aborted)
+
+	_, err = awsDriver.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: "vol-test",
+		NodeId:   "node-test",
+	})
+	expectErrCode(t, err, codes.Aborted)
+
+	_, err = awsDriver.DeleteVolume(context.TODO(), &csi.DeleteVolumeRequest{
+		VolumeId: "vol-test",
+	})
+	expectErrCode(t, err, codes.Aborted)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/bertinatto/ebs-csi-driver/pkg/metrics"
+	"github.com/bertinatto/ebs-csi-driver/pkg/util"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// secretsStripped replaces the values of the secrets in the logged requests.
+const secretsStripped = "***stripped***"
+
+// logErr tags each RPC with a request ID, logs the request and the errors
+// returned, and records the RPC latency.
+func logErr(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id := util.NewRequestID()
+	ctx = util.WithRequestID(ctx, id)
+	if klog.V(4) {
+		klog.Infof("[%s] %s called with request: %s", id, info.FullMethod, sanitizeRequest(req))
+	}
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	if err != nil {
+		klog.Errorf("[%s] GRPC error: %v", id, err)
+	}
+	metrics.RPCDuration.WithLabelValues(info.FullMethod, status.Code(err).String()).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// sanitizeRequest formats the request with the values of its secrets
+// stripped, so that they don't end up in the logs.
+func sanitizeRequest(req interface{}) string {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return fmt.Sprintf("%+v", req)
+	}
+
+	msg = proto.Clone(msg)
+	v := reflect.ValueOf(msg)
+	if v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct {
+		v = v.Elem()
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if !strings.HasSuffix(v.Type().Field(i).Name, "Secrets") || field.Kind() != reflect.Map || field.Len() == 0 {
+				continue
+			}
+			stripped := reflect.MakeMap(field.Type())
+			for _, key := range field.MapKeys() {
+				stripped.SetMapIndex(key, reflect.ValueOf(secretsStripped))
+			}
+			field.Set(stripped)
+		}
+	}
+	return proto.CompactTextString(msg)
+}
+
+// recoverPanic turns a panic in an RPC into an Internal error, so that
+// a single faulty request doesn't crash the whole driver.
+func recoverPanic(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			klog.Errorf("[%s] Panic in %s: %v\n%s", util.RequestID(ctx), info.FullMethod, r, debug.Stack())
+			resp, err = nil, status.Errorf(codes.Internal, "Panic in %s: %v", info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// enforceTimeout cancels the context of the RPC once the timeout of its method
+// expires, which cancels the AWS requests in progress, and returns DeadlineExceeded
+// in that case. RPCs without a timeout run until the CO gives up on them.
+func (d *Driver) enforceTimeout(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	timeout, ok := d.rpcTimeouts[method]
+	if !ok {
+		timeout = d.rpcTimeout
+	}
+	if timeout <= 0 {
+		return handler(ctx, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := handler(ctx, req)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, status.Errorf(codes.DeadlineExceeded, "%s timed out after %v: %v", method, timeout, err)
+	}
+	return resp, err
+}
+
+// chainUnaryInterceptors returns an interceptor calling the given ones in
+// order, the first being the outermost, since a server accepts only one.
+func chainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
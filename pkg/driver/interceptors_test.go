@@ -0,0 +1,196 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bertinatto/ebs-csi-driver/pkg/util"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRecoverPanic(t *testing.T) {
+	testCases := []struct {
+		name       string
+		handler    grpc.UnaryHandler
+		expResp    interface{}
+		expErrCode codes.Code
+	}{
+		{
+			name: "success: handler returns",
+			handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return "resp", nil
+			},
+			expResp:    "resp",
+			expErrCode: codes.OK,
+		},
+		{
+			name: "fail: handler returns error",
+			handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, status.Error(codes.NotFound, "Not found")
+			},
+			expErrCode: codes.NotFound,
+		},
+		{
+			name: "fail: handler panics",
+			handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				var m map[string]string
+				m["key"] = "value"
+				return "resp", nil
+			},
+			expErrCode: codes.Internal,
+		},
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Node/NodeStageVolume"}
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		resp, err := chainUnaryInterceptors(logErr, recoverPanic)(context.TODO(), "req", info, tc.handler)
+		if code := status.Code(err); code != tc.expErrCode {
+			t.Fatalf("Expected error code %v, got %v (%v)", tc.expErrCode, code, err)
+		}
+		if resp != tc.expResp {
+			t.Fatalf("Expected response %v, got %v", tc.expResp, resp)
+		}
+	}
+}
+
+func TestChainUnaryInterceptors(t *testing.T) {
+	var calls []string
+	interceptor := func(name string) grpc.UnaryServerInterceptor {
+		return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			calls = append(calls, name)
+			return handler(ctx, req)
+		}
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls = append(calls, "handler")
+		return fmt.Sprintf("%v handled", req), nil
+	}
+
+	chained := chainUnaryInterceptors(interceptor("first"), interceptor("second"))
+	resp, err := chained(context.TODO(), "req", &grpc.UnaryServerInfo{}, handler)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if resp != "req handled" {
+		t.Fatalf("Expected response %q, got %v", "req handled", resp)
+	}
+	if expCalls := []string{"first", "second", "handler"}; !reflect.DeepEqual(calls, expCalls) {
+		t.Fatalf("Expected calls %v, got %v", expCalls, calls)
+	}
+}
+
+func TestEnforceTimeout(t *testing.T) {
+	// blockingHandler waits for the context to be cancelled, like an AWS request would
+	blockingHandler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	returningHandler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "resp", nil
+	}
+
+	testCases := []struct {
+		name        string
+		rpcTimeout  time.Duration
+		rpcTimeouts map[string]time.Duration
+		handler     grpc.UnaryHandler
+		expErrCode  codes.Code
+	}{
+		{
+			name:       "success: no timeout",
+			handler:    returningHandler,
+			expErrCode: codes.OK,
+		},
+		{
+			name:       "success: returns before the timeout",
+			rpcTimeout: time.Minute,
+			handler:    returningHandler,
+			expErrCode: codes.OK,
+		},
+		{
+			name:       "fail: default timeout exceeded",
+			rpcTimeout: 10 * time.Millisecond,
+			handler:    blockingHandler,
+			expErrCode: codes.DeadlineExceeded,
+		},
+		{
+			name:        "fail: method timeout exceeded",
+			rpcTimeout:  time.Hour,
+			rpcTimeouts: map[string]time.Duration{"ControllerPublishVolume": 10 * time.Millisecond},
+			handler:     blockingHandler,
+			expErrCode:  codes.DeadlineExceeded,
+		},
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Controller/ControllerPublishVolume"}
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		d := &Driver{rpcTimeout: tc.rpcTimeout, rpcTimeouts: tc.rpcTimeouts}
+		_, err := d.enforceTimeout(context.TODO(), "req", info, tc.handler)
+		if status.Code(err) != tc.expErrCode {
+			t.Fatalf("Expected error code %v, got: %v", tc.expErrCode, err)
+		}
+	}
+}
+
+func TestLogErrRequestID(t *testing.T) {
+	var ids []string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		ids = append(ids, util.RequestID(ctx))
+		return nil, nil
+	}
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Identity/Probe"}
+	for i := 0; i < 2; i++ {
+		if _, err := logErr(context.TODO(), &csi.ProbeRequest{}, info, handler); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+	if len(ids[0]) == 0 || ids[0] == ids[1] {
+		t.Fatalf("Expected distinct request IDs, got %q", ids)
+	}
+}
+
+func TestSanitizeRequest(t *testing.T) {
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:                 "vol-test",
+		NodeId:                   "i-test",
+		ControllerPublishSecrets: map[string]string{"password": "secret-value"},
+	}
+
+	got := sanitizeRequest(req)
+	if strings.Contains(got, "secret-value") {
+		t.Fatalf("Expected secrets to be stripped, got: %s", got)
+	}
+	if !strings.Contains(got, "vol-test") || !strings.Contains(got, secretsStripped) {
+		t.Fatalf("Expected request with stripped secrets, got: %s", got)
+	}
+	if req.ControllerPublishSecrets["password"] != "secret-value" {
+		t.Fatalf("Expected original request to be unchanged, got: %v", req.ControllerPublishSecrets)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// Mounter is an interface for the mount operations needed by the node plugin.
+type Mounter interface {
+	mount.Interface
+	FormatAndMount(source string, target string, fstype string, options []string) error
+	GetDeviceName(mountPath string) (string, int, error)
+	GetDiskFormat(disk string) (string, error)
+}
+
+// NodeMounter implements Mounter on top of mount.SafeFormatAndMount.
+type NodeMounter struct {
+	mount.SafeFormatAndMount
+}
+
+var _ Mounter = &NodeMounter{}
+
+func newNodeMounter() Mounter {
+	return &NodeMounter{
+		mount.SafeFormatAndMount{
+			Interface: mount.New(""),
+			Exec:      mount.NewOsExec(),
+		},
+	}
+}
+
+// noFsckExec runs the commands of Exec except fsck, which succeeds without
+// running so that SafeFormatAndMount mounts formatted devices unchecked.
+type noFsckExec struct {
+	mount.Exec
+}
+
+func (e noFsckExec) Run(cmd string, args ...string) ([]byte, error) {
+	if cmd == "fsck" {
+		return nil, nil
+	}
+	return e.Exec.Run(cmd, args...)
+}
+
+// GetDeviceName returns the device mounted at mountPath and its number of references.
+func (m *NodeMounter) GetDeviceName(mountPath string) (string, int, error) {
+	return mount.GetDeviceNameFromMount(m, mountPath)
+}
@@ -20,15 +20,32 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/bertinatto/ebs-csi-driver/pkg/cloud"
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
-	"github.com/golang/glog"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/mount"
 )
 
+// defaultFsType is the filesystem volumes are formatted with when none is specified.
+const defaultFsType = "ext4"
+
+// selinuxContextOption is the prefix of the mount flag carrying the SELinux label.
+const selinuxContextOption = "context="
+
+// supportedFsTypes are the filesystems volumes can be formatted with.
+var supportedFsTypes = map[string]bool{
+	"ext3": true,
+	"ext4": true,
+	"xfs":  true,
+}
+
 func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	glog.V(4).Infof("NodeStageVolume: called with args %#v", req)
+	klog.V(4).Infof("NodeStageVolume: called with args %#v", req)
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
@@ -48,16 +65,31 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		return nil, status.Error(codes.InvalidArgument, "Volume capability not supported")
 	}
 
-	source, ok := req.PublishInfo["devicePath"]
+	// Block volumes are used as they were attached, NodePublishVolume
+	// bind mounts the device directly
+	if volCap.GetBlock() != nil {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if fsType := volCap.GetMount().GetFsType(); len(fsType) != 0 && !supportedFsTypes[fsType] {
+		return nil, status.Errorf(codes.InvalidArgument, "Filesystem %q not supported", fsType)
+	}
+
+	devicePath, ok := req.PublishInfo["devicePath"]
 	if !ok {
 		return nil, status.Error(codes.InvalidArgument, "Device path not provided")
 	}
 
+	source, err := findDevicePath(devicePath, volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not find device path for volume %q: %v", volumeID, err)
+	}
+
 	// TODO: consider replacing IsLikelyNotMountPoint by IsNotMountPoint
-	notMnt, err := d.mounter.Interface.IsLikelyNotMountPoint(target)
+	notMnt, err := d.mounter.IsLikelyNotMountPoint(target)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if errMkDir := d.mounter.Interface.MakeDir(target); errMkDir != nil {
+			if errMkDir := d.mounter.MakeDir(target); errMkDir != nil {
 				msg := fmt.Sprintf("could not create target dir %q: %v", target, errMkDir)
 				return nil, status.Error(codes.Internal, msg)
 			}
@@ -68,24 +100,137 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		}
 	}
 
+	// The filesystem of the volume capability takes precedence over the one
+	// given as StorageClass parameter, handed over by ControllerPublishVolume
+	mountVolume := volCap.GetMount()
+	fsType := mountVolume.GetFsType()
+	if len(fsType) == 0 {
+		fsType = req.PublishInfo[fsTypeKey]
+	}
+	if len(fsType) == 0 {
+		fsType = defaultFsType
+	}
+	mountOptions := quoteSELinuxContext(mountVolume.GetMountFlags())
+
+	// A device that already holds a filesystem is mounted as it is, it's never
+	// reformatted to the requested type. This is resolved before a retry checks
+	// the existing mount too, which has the filesystem of the device
+	existingFsType, err := d.mounter.GetDiskFormat(source)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not determine the filesystem of %q: %v", source, err)
+	}
+	if len(existingFsType) != 0 && existingFsType != fsType {
+		if !supportedFsTypes[existingFsType] {
+			return nil, status.Errorf(codes.FailedPrecondition, "Device %q holds unsupported filesystem %q", source, existingFsType)
+		}
+		klog.Warningf("NodeStageVolume: device %s is already formatted as %s, ignoring requested filesystem %s", source, existingFsType, fsType)
+		fsType = existingFsType
+	}
+
 	if !notMnt {
-		msg := fmt.Sprintf("target %q is not a valid mount point", target)
-		return nil, status.Error(codes.InvalidArgument, msg)
+		if err := d.restageVolume(source, target, fsType, mountOptions); err != nil {
+			return nil, err
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	// FormatAndMount will format only if needed
-	glog.V(5).Infof("NodeStageVolume: formatting %s and mounting at %s", source, target)
-	err = d.mounter.FormatAndMount(source, target, "ext4", nil)
+	// FormatAndMount will format only if needed. An existing filesystem mounted
+	// read-write is checked with fsck first, unless SkipFsck is set: errors it
+	// corrects are ignored and the mount fails on the ones it can't. fsck.xfs
+	// does nothing, xfs repairs itself on mount
+	klog.V(5).Infof("NodeStageVolume: formatting %s as %s and mounting at %s with options %v", source, fsType, target, mountOptions)
+	err = d.mounter.FormatAndMount(source, target, fsType, mountOptions)
 	if err != nil {
-		msg := fmt.Sprintf("could not format %q and mount it at %q", source, target)
-		return nil, status.Error(codes.Internal, msg)
+		return nil, status.Errorf(codes.Internal, "could not format %q and mount it at %q: %v", source, target, err)
 	}
 
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// quoteSELinuxContext quotes the value of the SELinux context mount flag, if any.
+// The categories of a label are separated by commas, which mount would otherwise
+// take for separate options. The context is applied where the filesystem is staged
+// because the kernel ignores it on the bind mounts of NodePublishVolume. All the
+// supportedFsTypes accept the context option, so it's passed whatever the filesystem.
+func quoteSELinuxContext(flags []string) []string {
+	quoted := make([]string, 0, len(flags))
+	for _, flag := range flags {
+		if label := strings.TrimPrefix(flag, selinuxContextOption); label != flag && !strings.HasPrefix(label, `"`) {
+			flag = fmt.Sprintf("%s%q", selinuxContextOption, label)
+		}
+		quoted = append(quoted, flag)
+	}
+	return quoted
+}
+
+// restageVolume handles a NodeStageVolume retry on a target that's already mounted.
+// The mount is kept if it already has the requested flags, otherwise it's remounted
+// with them. A different filesystem can't be changed in place, so it's an error.
+func (d *Driver) restageVolume(source, target, fsType string, mountOptions []string) error {
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		return status.Errorf(codes.Internal, "Could not list mount points: %v", err)
+	}
+
+	var mountPoint *mount.MountPoint
+	for i := range mountPoints {
+		if d.mounter.IsMountPointMatch(mountPoints[i], target) {
+			mountPoint = &mountPoints[i]
+		}
+	}
+	if mountPoint == nil {
+		return status.Errorf(codes.InvalidArgument, "Target %q is not a valid mount point", target)
+	}
+
+	if mountPoint.Type != fsType {
+		return status.Errorf(codes.AlreadyExists, "Target %q is already mounted with filesystem %q, requested %q", target, mountPoint.Type, fsType)
+	}
+
+	currentOptions := map[string]bool{}
+	for _, option := range mountPoint.Opts {
+		currentOptions[option] = true
+	}
+	options := []string{"remount"}
+	var changed bool
+	for _, option := range remountOptions(mountOptions) {
+		options = append(options, option)
+		if !currentOptions[option] {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	klog.V(5).Infof("NodeStageVolume: remounting %s at %s with options %v", source, target, options)
+	if err := d.mounter.Mount(source, target, fsType, options); err != nil {
+		return status.Errorf(codes.Internal, "Could not remount %q with options %v: %v", target, mountOptions, err)
+	}
+	return nil
+}
+
+// remountOptions returns the mount options that can be compared with the ones of
+// an existing mount and changed by remounting it. Options are listed one by one,
+// split on commas, like the mount points list them. The SELinux context is left
+// out: it's split on the commas between its categories in the mount points, and
+// a mounted filesystem can't get a different context anyway.
+func remountOptions(mountOptions []string) []string {
+	var options []string
+	for _, flag := range mountOptions {
+		if strings.HasPrefix(flag, selinuxContextOption) {
+			continue
+		}
+		for _, option := range strings.Split(flag, ",") {
+			if option = strings.TrimSpace(option); len(option) != 0 {
+				options = append(options, option)
+			}
+		}
+	}
+	return options
+}
+
 func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	glog.V(4).Infof("NodeUnstageVolume: called with args %#v", req)
+	klog.V(4).Infof("NodeUnstageVolume: called with args %#v", req)
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
@@ -96,8 +241,8 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 		return nil, status.Error(codes.InvalidArgument, "Staging target not provided")
 	}
 
-	glog.V(5).Infof("NodeUnstageVolume: unmounting %s", target)
-	err := d.mounter.Interface.Unmount(target)
+	klog.V(5).Infof("NodeUnstageVolume: unmounting %s", target)
+	err := d.mounter.Unmount(target)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not unmount target %q: %v", target, err)
 	}
@@ -106,7 +251,7 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 }
 
 func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	glog.V(4).Infof("NodePublishVolume: called with args %#v", req)
+	klog.V(4).Infof("NodePublishVolume: called with args %#v", req)
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
@@ -136,13 +281,54 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		options = append(options, "ro")
 	}
 
-	glog.V(5).Infof("NodePublishVolume: creating dir %s", target)
-	if err := d.mounter.Interface.MakeDir(target); err != nil {
+	if volCap.GetBlock() != nil {
+		return d.nodePublishBlockVolume(req, options)
+	}
+
+	klog.V(5).Infof("NodePublishVolume: creating dir %s", target)
+	if err := d.mounter.MakeDir(target); err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not create dir %q: %v", target, err)
 	}
 
-	glog.V(5).Infof("NodePublishVolume: mounting %s at %s", source, target)
-	if err := d.mounter.Interface.Mount(source, target, "ext4", options); err != nil {
+	klog.V(5).Infof("NodePublishVolume: mounting %s at %s", source, target)
+	if err := d.mounter.Mount(source, target, "ext4", options); err != nil {
+		os.Remove(target)
+		return nil, status.Errorf(codes.Internal, "Could not mount %q at %q: %v", source, target, err)
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// nodePublishBlockVolume bind mounts the device the volume is attached as
+// to the target path, which is a file rather than a directory.
+func (d *Driver) nodePublishBlockVolume(req *csi.NodePublishVolumeRequest, options []string) (*csi.NodePublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	target := req.GetTargetPath()
+
+	devicePath, ok := req.GetPublishInfo()["devicePath"]
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "Device path not provided")
+	}
+
+	if fsType := req.GetPublishInfo()[fsTypeKey]; len(fsType) != 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume %q has filesystem %q and can't be used as a block device", volumeID, fsType)
+	}
+
+	source, err := findDevicePath(devicePath, volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not find device path for volume %q: %v", volumeID, err)
+	}
+
+	klog.V(5).Infof("NodePublishVolume: creating file %s", target)
+	if err := d.mounter.MakeDir(filepath.Dir(target)); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not create dir %q: %v", filepath.Dir(target), err)
+	}
+	if err := d.mounter.MakeFile(target); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not create file %q: %v", target, err)
+	}
+
+	klog.V(5).Infof("NodePublishVolume: mounting block device %s at %s", source, target)
+	if err := d.mounter.Mount(source, target, "", options); err != nil {
 		os.Remove(target)
 		return nil, status.Errorf(codes.Internal, "Could not mount %q at %q: %v", source, target, err)
 	}
@@ -151,7 +337,7 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 }
 
 func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	glog.V(4).Infof("NodeUnpublishVolume: called with args %#v", req)
+	klog.V(4).Infof("NodeUnpublishVolume: called with args %#v", req)
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
@@ -162,8 +348,8 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
 	}
 
-	glog.V(5).Infof("NodeUnpublishVolume: unmounting %s", target)
-	err := d.mounter.Interface.Unmount(target)
+	klog.V(5).Infof("NodeUnpublishVolume: unmounting %s", target)
+	err := d.mounter.Unmount(target)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not unmount %q: %v", target, err)
 	}
@@ -172,7 +358,7 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 }
 
 func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	glog.V(4).Infof("NodeGetCapabilities: called with args %#v", req)
+	klog.V(4).Infof("NodeGetCapabilities: called with args %#v", req)
 	var caps []*csi.NodeServiceCapability
 	for _, cap := range d.nodeCaps {
 		c := &csi.NodeServiceCapability{
@@ -188,17 +374,56 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 }
 
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	glog.V(4).Infof("NodeGetInfo: called with args %#v", req)
+	klog.V(4).Infof("NodeGetInfo: called with args %#v", req)
 	m := d.cloud.GetMetadata()
+
+	maxVolumes := d.volumeAttachLimit
+	if maxVolumes <= 0 {
+		maxVolumes = cloud.MaxVolumesPerInstance(m.GetInstanceType())
+	}
+
 	return &csi.NodeGetInfoResponse{
-		NodeId: m.GetInstanceID(),
+		NodeId:            m.GetInstanceID(),
+		MaxVolumesPerNode: maxVolumes,
+		AccessibleTopology: &csi.Topology{
+			Segments: map[string]string{topologyKey: m.GetAvailabilityZone()},
+		},
 	}, nil
 }
 
+// NodeGetId returns the ID of the instance, same as NodeGetInfo. It's deprecated
+// in CSI v0.3 and goes away with v1.0, but the sidecars that predate
+// NodeGetInfo still register the node with it.
 func (d *Driver) NodeGetId(ctx context.Context, req *csi.NodeGetIdRequest) (*csi.NodeGetIdResponse, error) {
-	glog.V(4).Infof("NodeGetId: called with args %#v", req)
-	m := d.cloud.GetMetadata()
+	klog.V(4).Infof("NodeGetId: called with args %#v", req)
 	return &csi.NodeGetIdResponse{
-		NodeId: m.GetInstanceID(),
+		NodeId: d.nodeID,
 	}, nil
 }
+
+// diskByIDPath is where udev creates the links to disks named after their serial numbers.
+var diskByIDPath = "/dev/disk/by-id"
+
+// findDevicePath returns the path of the device the volume is attached as.
+// On Nitro instances EBS volumes show up as NVMe devices regardless of the
+// requested device name, so they are found through the volume ID embedded
+// in their serial number. Otherwise the requested device path is returned.
+func findDevicePath(devicePath, volumeID string) (string, error) {
+	if _, err := os.Stat(devicePath); err == nil {
+		return devicePath, nil
+	}
+
+	// The serial number holds the volume ID without the dash, e.g. vol0123456789abcdef0
+	nvmePath := filepath.Join(diskByIDPath, "nvme-Amazon_Elastic_Block_Store_"+strings.Replace(volumeID, "-", "", -1))
+	if _, err := os.Lstat(nvmePath); err != nil {
+		return devicePath, nil
+	}
+
+	resolved, err := filepath.EvalSymlinks(nvmePath)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve NVMe device link %q: %v", nvmePath, err)
+	}
+	klog.V(4).Infof("Resolved device %s of volume %s to NVMe device %s", devicePath, volumeID, resolved)
+
+	return resolved, nil
+}
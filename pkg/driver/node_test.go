@@ -0,0 +1,869 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bertinatto/ebs-csi-driver/pkg/cloud"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+	utilexec "k8s.io/utils/exec"
+)
+
+var (
+	stdNodeVolCap = &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+	stdDevicePath = "/dev/xvdbc"
+)
+
+func TestNodeStageVolume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-node-stage")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	stagingPath := filepath.Join(dir, "staging")
+
+	testCases := []struct {
+		name        string
+		req         *csi.NodeStageVolumeRequest
+		expMountDev string
+		expFsType   string
+		// If set, blkid reports the device already holds this filesystem
+		diskFormat string
+		// The fake mounter only records the "ro" option
+		expMountOpts []string
+		expErrCode   codes.Code
+	}{
+		{
+			name: "success normal",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: stagingPath,
+				VolumeCapability:  stdNodeVolCap,
+				PublishInfo:       map[string]string{"devicePath": stdDevicePath},
+			},
+			expMountDev: stdDevicePath,
+			expFsType:   "ext4",
+		},
+		{
+			name: "success fsType",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: stagingPath,
+				VolumeCapability:  stdNodeVolCap,
+				PublishInfo:       map[string]string{"devicePath": stdDevicePath, "fsType": "xfs"},
+			},
+			expMountDev: stdDevicePath,
+			expFsType:   "xfs",
+		},
+		{
+			name: "success volume capability fsType and mount flags",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: stagingPath,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{FsType: "ext3", MountFlags: []string{"ro"}},
+					},
+					AccessMode: stdNodeVolCap.AccessMode,
+				},
+				PublishInfo: map[string]string{"devicePath": stdDevicePath, "fsType": "xfs"},
+			},
+			expMountDev:  stdDevicePath,
+			expFsType:    "ext3",
+			expMountOpts: []string{"ro"},
+		},
+		{
+			name: "success existing filesystem kept",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: stagingPath,
+				VolumeCapability:  stdNodeVolCap,
+				PublishInfo:       map[string]string{"devicePath": stdDevicePath, "fsType": "ext4"},
+			},
+			diskFormat:  "xfs",
+			expMountDev: stdDevicePath,
+			expFsType:   "xfs",
+		},
+		{
+			name: "fail existing unsupported filesystem",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: stagingPath,
+				VolumeCapability:  stdNodeVolCap,
+				PublishInfo:       map[string]string{"devicePath": stdDevicePath},
+			},
+			diskFormat: "btrfs",
+			expErrCode: codes.FailedPrecondition,
+		},
+		{
+			name: "fail unsupported fsType",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: stagingPath,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{FsType: "btrfs"},
+					},
+					AccessMode: stdNodeVolCap.AccessMode,
+				},
+				PublishInfo: map[string]string{"devicePath": stdDevicePath},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no volume id",
+			req: &csi.NodeStageVolumeRequest{
+				StagingTargetPath: stagingPath,
+				VolumeCapability:  stdNodeVolCap,
+				PublishInfo:       map[string]string{"devicePath": stdDevicePath},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no staging target",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:         "vol-test",
+				VolumeCapability: stdNodeVolCap,
+				PublishInfo:      map[string]string{"devicePath": stdDevicePath},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no volume capability",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: stagingPath,
+				PublishInfo:       map[string]string{"devicePath": stdDevicePath},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no device path",
+			req: &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: stagingPath,
+				VolumeCapability:  stdNodeVolCap,
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mounter := NewFakeMounter()
+		if len(tc.diskFormat) != 0 {
+			mounter.(*NodeMounter).Exec = mount.NewFakeExec(func(cmd string, args ...string) ([]byte, error) {
+				if cmd == "blkid" {
+					return []byte("TYPE=" + tc.diskFormat + "\n"), nil
+				}
+				return nil, nil
+			})
+		}
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), mounter, &DriverOptions{})
+
+		_, err := awsDriver.NodeStageVolume(context.TODO(), tc.req)
+		if err != nil {
+			expectErrCode(t, err, tc.expErrCode)
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+
+		mp := assertMountPoint(t, mounter, tc.expMountDev, tc.req.GetStagingTargetPath())
+		if mp.Type != tc.expFsType {
+			t.Fatalf("Expected filesystem type %q, got %q", tc.expFsType, mp.Type)
+		}
+		if len(mp.Opts) != len(tc.expMountOpts) {
+			t.Fatalf("Expected mount options %v, got %v", tc.expMountOpts, mp.Opts)
+		}
+	}
+}
+
+func TestNodeStageVolumeMounted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-node-stage")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		name string
+		// mountedOpts are the options of the existing mount
+		mountedOpts []string
+		fsType      string
+		mountFlags  []string
+		expRemount  bool
+		expErrCode  codes.Code
+	}{
+		{
+			name: "success same options",
+		},
+		{
+			name:        "success same options with SELinux context",
+			mountedOpts: []string{"ro"},
+			mountFlags:  []string{"ro", "context=system_u:object_r:container_file_t:s0:c1,c2"},
+		},
+		{
+			name:       "success remount with options in a single flag",
+			mountFlags: []string{"ro,noexec"},
+			expRemount: true,
+		},
+		{
+			name:       "success remount with new options",
+			mountFlags: []string{"ro"},
+			expRemount: true,
+		},
+		{
+			name:       "fail different fsType",
+			fsType:     "xfs",
+			expErrCode: codes.AlreadyExists,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mounter := NewFakeMounter()
+		if err := mounter.Mount(stdDevicePath, dir, "ext4", tc.mountedOpts); err != nil {
+			t.Fatalf("Could not mount fake device: %v", err)
+		}
+		fakeMounter := mounter.(*NodeMounter).Interface.(*mount.FakeMounter)
+		fakeMounter.ResetLog()
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), mounter, &DriverOptions{})
+
+		_, err := awsDriver.NodeStageVolume(context.TODO(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-test",
+			StagingTargetPath: dir,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{FsType: tc.fsType, MountFlags: tc.mountFlags},
+				},
+				AccessMode: stdNodeVolCap.AccessMode,
+			},
+			PublishInfo: map[string]string{"devicePath": stdDevicePath},
+		})
+		if err != nil {
+			expectErrCode(t, err, tc.expErrCode)
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+
+		remounted := len(fakeMounter.Log) != 0
+		if remounted != tc.expRemount {
+			t.Fatalf("Expected remount %v, got actions %v", tc.expRemount, fakeMounter.Log)
+		}
+	}
+}
+
+// TestNodeStageVolumeRestage checks a retry on a device staged with the
+// filesystem it already held, rather than the requested one, keeps the mount.
+func TestNodeStageVolumeRestage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-node-stage")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mounter := NewFakeMounter()
+	mounter.(*NodeMounter).Exec = mount.NewFakeExec(func(cmd string, args ...string) ([]byte, error) {
+		if cmd == "blkid" {
+			return []byte("TYPE=xfs\n"), nil
+		}
+		return nil, nil
+	})
+	awsDriver := NewDriver(cloud.NewFakeCloudProvider(), mounter, &DriverOptions{})
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-test",
+		StagingTargetPath: dir,
+		VolumeCapability:  stdNodeVolCap,
+		PublishInfo:       map[string]string{"devicePath": stdDevicePath},
+	}
+	if _, err := awsDriver.NodeStageVolume(context.TODO(), req); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if mp := assertMountPoint(t, mounter, stdDevicePath, dir); mp.Type != "xfs" {
+		t.Fatalf("Expected filesystem type %q, got %q", "xfs", mp.Type)
+	}
+
+	fakeMounter := mounter.(*NodeMounter).Interface.(*mount.FakeMounter)
+	fakeMounter.ResetLog()
+	if _, err := awsDriver.NodeStageVolume(context.TODO(), req); err != nil {
+		t.Fatalf("Expected no error on retry, got: %v", err)
+	}
+	if len(fakeMounter.Log) != 0 {
+		t.Fatalf("Expected the mount to be kept, got actions %v", fakeMounter.Log)
+	}
+}
+
+// TestNodeStageVolumeFsck checks the filesystem of a formatted device is
+// repaired by FormatAndMount before it's mounted read-write, unless SkipFsck
+// is set.
+func TestNodeStageVolumeFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-node-stage")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		name       string
+		mountFlags []string
+		skipFsck   bool
+		// fsckErr is the error fsck exits with
+		fsckErr    error
+		expFsck    bool
+		expErrCode codes.Code
+	}{
+		{
+			name:    "success clean filesystem",
+			expFsck: true,
+		},
+		{
+			name:    "success errors corrected",
+			fsckErr: utilexec.CodeExitError{Err: errors.New("exit status 1"), Code: 1},
+			expFsck: true,
+		},
+		{
+			name:       "success read-only",
+			mountFlags: []string{"ro"},
+			fsckErr:    utilexec.CodeExitError{Err: errors.New("exit status 4"), Code: 4},
+		},
+		{
+			name:     "success fsck skipped",
+			skipFsck: true,
+			fsckErr:  utilexec.CodeExitError{Err: errors.New("exit status 4"), Code: 4},
+		},
+		{
+			name:       "fail errors uncorrected",
+			fsckErr:    utilexec.CodeExitError{Err: errors.New("exit status 4"), Code: 4},
+			expFsck:    true,
+			expErrCode: codes.Internal,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mounter := NewFakeMounter()
+		fsck := false
+		mounter.(*NodeMounter).Exec = mount.NewFakeExec(func(cmd string, args ...string) ([]byte, error) {
+			switch cmd {
+			case "blkid":
+				return []byte("TYPE=ext4\n"), nil
+			case "fsck":
+				fsck = true
+				return nil, tc.fsckErr
+			}
+			return nil, nil
+		})
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), mounter, &DriverOptions{SkipFsck: tc.skipFsck})
+
+		_, err := awsDriver.NodeStageVolume(context.TODO(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-test",
+			StagingTargetPath: filepath.Join(dir, "staging"),
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: tc.mountFlags},
+				},
+				AccessMode: stdNodeVolCap.AccessMode,
+			},
+			PublishInfo: map[string]string{"devicePath": stdDevicePath},
+		})
+		if fsck != tc.expFsck {
+			t.Fatalf("Expected fsck %v, got %v", tc.expFsck, fsck)
+		}
+		if err != nil {
+			expectErrCode(t, err, tc.expErrCode)
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+	}
+}
+
+func TestQuoteSELinuxContext(t *testing.T) {
+	testCases := []struct {
+		name     string
+		flags    []string
+		expFlags []string
+	}{
+		{
+			name:     "success no context",
+			flags:    []string{"ro", "noatime"},
+			expFlags: []string{"ro", "noatime"},
+		},
+		{
+			name:     "success context quoted",
+			flags:    []string{"ro", "context=system_u:object_r:container_file_t:s0:c1,c2"},
+			expFlags: []string{"ro", `context="system_u:object_r:container_file_t:s0:c1,c2"`},
+		},
+		{
+			name:     "success context already quoted",
+			flags:    []string{`context="system_u:object_r:container_file_t:s0"`},
+			expFlags: []string{`context="system_u:object_r:container_file_t:s0"`},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		flags := quoteSELinuxContext(tc.flags)
+		if !reflect.DeepEqual(flags, tc.expFlags) {
+			t.Fatalf("Expected mount flags %v, got %v", tc.expFlags, flags)
+		}
+	}
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	testCases := []struct {
+		name       string
+		req        *csi.NodeUnstageVolumeRequest
+		expErrCode codes.Code
+	}{
+		{
+			name: "success normal",
+			req: &csi.NodeUnstageVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: "/test/staging/path",
+			},
+		},
+		{
+			name: "fail no volume id",
+			req: &csi.NodeUnstageVolumeRequest{
+				StagingTargetPath: "/test/staging/path",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no staging target",
+			req: &csi.NodeUnstageVolumeRequest{
+				VolumeId: "vol-test",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mounter := NewFakeMounter()
+		if err := mounter.Mount(stdDevicePath, "/test/staging/path", "ext4", nil); err != nil {
+			t.Fatalf("Could not mount fake device: %v", err)
+		}
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), mounter, &DriverOptions{})
+
+		_, err := awsDriver.NodeUnstageVolume(context.TODO(), tc.req)
+		if err != nil {
+			expectErrCode(t, err, tc.expErrCode)
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+
+		assertNoMountPoints(t, mounter)
+	}
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	testCases := []struct {
+		name string
+		req  *csi.NodePublishVolumeRequest
+		// The fake mounter only records the "ro" option
+		expOptions []string
+		expErrCode codes.Code
+	}{
+		{
+			name: "success normal",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: "/test/staging/path",
+				TargetPath:        "/test/target/path",
+				VolumeCapability:  stdNodeVolCap,
+			},
+			expOptions: []string{},
+		},
+		{
+			name: "success readonly",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: "/test/staging/path",
+				TargetPath:        "/test/target/path",
+				VolumeCapability:  stdNodeVolCap,
+				Readonly:          true,
+			},
+			expOptions: []string{"ro"},
+		},
+		{
+			name: "fail no staging target",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:         "vol-test",
+				TargetPath:       "/test/target/path",
+				VolumeCapability: stdNodeVolCap,
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no target path",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: "/test/staging/path",
+				VolumeCapability:  stdNodeVolCap,
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no volume capability",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId:          "vol-test",
+				StagingTargetPath: "/test/staging/path",
+				TargetPath:        "/test/target/path",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mounter := NewFakeMounter()
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), mounter, &DriverOptions{})
+
+		_, err := awsDriver.NodePublishVolume(context.TODO(), tc.req)
+		if err != nil {
+			expectErrCode(t, err, tc.expErrCode)
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+
+		mp := assertMountPoint(t, mounter, tc.req.GetStagingTargetPath(), tc.req.GetTargetPath())
+		if len(mp.Opts) != len(tc.expOptions) {
+			t.Fatalf("Expected mount options %v, got %v", tc.expOptions, mp.Opts)
+		}
+		for i := range mp.Opts {
+			if mp.Opts[i] != tc.expOptions[i] {
+				t.Fatalf("Expected mount options %v, got %v", tc.expOptions, mp.Opts)
+			}
+		}
+	}
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	testCases := []struct {
+		name       string
+		req        *csi.NodeUnpublishVolumeRequest
+		expErrCode codes.Code
+	}{
+		{
+			name: "success normal",
+			req: &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   "vol-test",
+				TargetPath: "/test/target/path",
+			},
+		},
+		{
+			name: "fail no volume id",
+			req: &csi.NodeUnpublishVolumeRequest{
+				TargetPath: "/test/target/path",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail no target path",
+			req: &csi.NodeUnpublishVolumeRequest{
+				VolumeId: "vol-test",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mounter := NewFakeMounter()
+		if err := mounter.Mount("/test/staging/path", "/test/target/path", "ext4", []string{"bind"}); err != nil {
+			t.Fatalf("Could not mount fake device: %v", err)
+		}
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), mounter, &DriverOptions{})
+
+		_, err := awsDriver.NodeUnpublishVolume(context.TODO(), tc.req)
+		if err != nil {
+			expectErrCode(t, err, tc.expErrCode)
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+
+		assertNoMountPoints(t, mounter)
+	}
+}
+
+func TestFindDevicePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ebs-csi-find-device")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	xvdDevice := filepath.Join(dir, "xvdbc")
+	nvmeDevice := filepath.Join(dir, "nvme1n1")
+	for _, dev := range []string{xvdDevice, nvmeDevice} {
+		if err := ioutil.WriteFile(dev, nil, 0644); err != nil {
+			t.Fatalf("Could not create fake device %q: %v", dev, err)
+		}
+	}
+
+	byIDDir := filepath.Join(dir, "by-id")
+	if err := os.Mkdir(byIDDir, 0755); err != nil {
+		t.Fatalf("Could not create dir %q: %v", byIDDir, err)
+	}
+	if err := os.Symlink(nvmeDevice, filepath.Join(byIDDir, "nvme-Amazon_Elastic_Block_Store_vol0123456789")); err != nil {
+		t.Fatalf("Could not create NVMe device link: %v", err)
+	}
+
+	defer func(path string) { diskByIDPath = path }(diskByIDPath)
+	diskByIDPath = byIDDir
+
+	testCases := []struct {
+		name       string
+		devicePath string
+		volumeID   string
+		expPath    string
+	}{
+		{
+			name:       "success: requested device exists",
+			devicePath: xvdDevice,
+			volumeID:   "vol-0123456789",
+			expPath:    xvdDevice,
+		},
+		{
+			name:       "success: NVMe device",
+			devicePath: filepath.Join(dir, "xvdbd"),
+			volumeID:   "vol-0123456789",
+			expPath:    nvmeDevice,
+		},
+		{
+			name:       "success: fall back to requested device",
+			devicePath: filepath.Join(dir, "xvdbd"),
+			volumeID:   "vol-9876543210",
+			expPath:    filepath.Join(dir, "xvdbd"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		path, err := findDevicePath(tc.devicePath, tc.volumeID)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if path != tc.expPath {
+			t.Fatalf("Expected device path %q, got %q", tc.expPath, path)
+		}
+	}
+}
+
+func expectErrCode(t *testing.T, err error, expErrCode codes.Code) {
+	srvErr, ok := status.FromError(err)
+	if !ok {
+		t.Fatalf("Could not get error status code from error: %v", srvErr)
+	}
+	if srvErr.Code() != expErrCode {
+		t.Fatalf("Expected error code %d, got %d", expErrCode, srvErr.Code())
+	}
+}
+
+func assertMountPoint(t *testing.T, mounter Mounter, device, path string) mount.MountPoint {
+	mps, err := mounter.List()
+	if err != nil {
+		t.Fatalf("Could not list mount points: %v", err)
+	}
+	if len(mps) != 1 {
+		t.Fatalf("Expected 1 mount point, got %d", len(mps))
+	}
+	if mps[0].Device != device {
+		t.Fatalf("Expected mounted device %q, got %q", device, mps[0].Device)
+	}
+	if mps[0].Path != path {
+		t.Fatalf("Expected mount path %q, got %q", path, mps[0].Path)
+	}
+	return mps[0]
+}
+
+func assertNoMountPoints(t *testing.T, mounter Mounter) {
+	mps, err := mounter.List()
+	if err != nil {
+		t.Fatalf("Could not list mount points: %v", err)
+	}
+	if len(mps) != 0 {
+		t.Fatalf("Expected no mount points, got %v", mps)
+	}
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	testCases := []struct {
+		name          string
+		instanceType  string
+		attachLimit   int64
+		expMaxVolumes int64
+	}{
+		{
+			name:          "success: limit derived from nitro instance type",
+			instanceType:  "m5.large",
+			expMaxVolumes: cloud.MaxVolumesPerInstance("m5.large"),
+		},
+		{
+			name:          "success: limit derived from xen instance type",
+			instanceType:  "m4.large",
+			expMaxVolumes: cloud.MaxVolumesPerInstance("m4.large"),
+		},
+		{
+			name:          "success: limit overridden",
+			instanceType:  "m5.large",
+			attachLimit:   10,
+			expMaxVolumes: 10,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		fakeCloud := cloud.NewFakeCloudProvider()
+		fakeCloud.Metadata = &cloud.FakeMetadata{
+			InstanceID:       "i-test",
+			AvailabilityZone: "us-east-1a",
+			InstanceType:     tc.instanceType,
+		}
+		awsDriver := NewDriver(fakeCloud, NewFakeMounter(), &DriverOptions{VolumeAttachLimit: tc.attachLimit})
+
+		resp, err := awsDriver.NodeGetInfo(context.TODO(), &csi.NodeGetInfoRequest{})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if resp.GetNodeId() != "i-test" {
+			t.Fatalf("Expected node ID %q, got %q", "i-test", resp.GetNodeId())
+		}
+		if zone := resp.GetAccessibleTopology().GetSegments()[topologyKey]; zone != "us-east-1a" {
+			t.Fatalf("Expected zone %q, got %q", "us-east-1a", zone)
+		}
+		if resp.GetMaxVolumesPerNode() != tc.expMaxVolumes {
+			t.Fatalf("Expected max volumes per node %d, got %d", tc.expMaxVolumes, resp.GetMaxVolumesPerNode())
+		}
+	}
+}
+
+func TestNodeGetId(t *testing.T) {
+	fakeCloud := cloud.NewFakeCloudProvider()
+	fakeCloud.Metadata = &cloud.FakeMetadata{
+		InstanceID:       "i-test",
+		AvailabilityZone: "us-east-1a",
+		InstanceType:     "m5.large",
+	}
+	awsDriver := NewDriver(fakeCloud, NewFakeMounter(), &DriverOptions{})
+
+	resp, err := awsDriver.NodeGetId(context.TODO(), &csi.NodeGetIdRequest{})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if resp.GetNodeId() != "i-test" {
+		t.Fatalf("Expected node ID %q, got %q", "i-test", resp.GetNodeId())
+	}
+}
+
+func TestBlockVolume(t *testing.T) {
+	blockVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+
+	testCases := []struct {
+		name        string
+		publishInfo map[string]string
+		expErrCode  codes.Code
+	}{
+		{
+			name:        "success normal",
+			publishInfo: map[string]string{"devicePath": stdDevicePath},
+		},
+		{
+			name:        "fail no device path",
+			publishInfo: map[string]string{},
+			expErrCode:  codes.InvalidArgument,
+		},
+		{
+			name:        "fail volume with filesystem",
+			publishInfo: map[string]string{"devicePath": stdDevicePath, "fsType": "ext4"},
+			expErrCode:  codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		mounter := NewFakeMounter()
+		awsDriver := NewDriver(cloud.NewFakeCloudProvider(), mounter, &DriverOptions{})
+
+		// Staging a block volume is a no-op
+		_, err := awsDriver.NodeStageVolume(context.TODO(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-test",
+			StagingTargetPath: "/test/staging/path",
+			VolumeCapability:  blockVolCap,
+			PublishInfo:       tc.publishInfo,
+		})
+		if err != nil {
+			t.Fatalf("Expected no error staging block volume, got: %v", err)
+		}
+		assertNoMountPoints(t, mounter)
+
+		_, err = awsDriver.NodePublishVolume(context.TODO(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol-test",
+			StagingTargetPath: "/test/staging/path",
+			TargetPath:        "/test/target/path",
+			VolumeCapability:  blockVolCap,
+			PublishInfo:       tc.publishInfo,
+		})
+		if err != nil {
+			expectErrCode(t, err, tc.expErrCode)
+			continue
+		}
+		if tc.expErrCode != codes.OK {
+			t.Fatalf("Expected error %v, got no error", tc.expErrCode)
+		}
+
+		assertMountPoint(t, mounter, stdDevicePath, "/test/target/path")
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics defines the Prometheus collectors exposed by the driver.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the latency histograms.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+var (
+	// APIRequestDuration is the latency of the requests sent to the AWS API.
+	APIRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ebs_csi_aws_api_request_duration_seconds",
+			Help:    "Latency of the requests sent to the AWS API.",
+			Buckets: DefaultBuckets,
+		},
+		[]string{"request"},
+	)
+
+	// APIRequestErrors counts the requests to the AWS API that failed, by error code.
+	APIRequestErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ebs_csi_aws_api_request_errors_total",
+			Help: "Number of requests to the AWS API that failed.",
+		},
+		[]string{"request", "code"},
+	)
+
+	// APIRequestThrottles counts the requests to the AWS API that were throttled
+	// and retried after a backoff.
+	APIRequestThrottles = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ebs_csi_aws_api_request_throttles_total",
+			Help: "Number of requests to the AWS API that were throttled and retried.",
+		},
+		[]string{"request"},
+	)
+
+	// RPCDuration is the latency of the CSI RPCs served by the driver.
+	RPCDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "ebs_csi_rpc_duration_seconds",
+			Help:    "Latency of the CSI RPCs served by the driver.",
+			Buckets: DefaultBuckets,
+		},
+		[]string{"method", "code"},
+	)
+
+	// DevicesInUse is the number of device names in use on a node, out of the
+	// ones the driver can assign, as of the last attach or detach on the node.
+	DevicesInUse = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ebs_csi_devices_in_use",
+			Help: "Number of device names in use on the node, out of the ones the driver can assign.",
+		},
+		[]string{"node"},
+	)
+
+	// DevicesAllocatable is the number of device names the driver can assign on a node.
+	DevicesAllocatable = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ebs_csi_devices_allocatable",
+			Help: "Number of device names the driver can assign on the node.",
+		},
+		[]string{"node"},
+	)
+
+	// DeviceAllocationFailures counts the attachments that failed because no
+	// device name was left on the node.
+	DeviceAllocationFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ebs_csi_device_allocation_failures_total",
+			Help: "Number of attachments that failed because no device name was left on the node.",
+		},
+		[]string{"node"},
+	)
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(APIRequestDuration, APIRequestErrors, APIRequestThrottles, RPCDuration, DevicesInUse, DevicesAllocatable, DeviceAllocationFailures)
+}
+
+// Handler returns an HTTP handler serving the driver metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
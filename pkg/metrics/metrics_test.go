@@ -0,0 +1,53 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	APIRequestErrors.WithLabelValues("AttachVolume", "RequestLimitExceeded").Inc()
+	APIRequestErrors.WithLabelValues("AttachVolume", "RequestLimitExceeded").Inc()
+	APIRequestDuration.WithLabelValues("AttachVolume").Observe(0.5)
+	APIRequestThrottles.WithLabelValues("DescribeVolumes").Inc()
+	RPCDuration.WithLabelValues("/csi.v0.Controller/ControllerPublishVolume", "OK").Observe(2)
+	DevicesInUse.WithLabelValues("i-test").Set(3)
+	DeviceAllocationFailures.WithLabelValues("i-test").Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := []string{
+		`ebs_csi_aws_api_request_errors_total{code="RequestLimitExceeded",request="AttachVolume"} 2`,
+		`ebs_csi_aws_api_request_duration_seconds_bucket{request="AttachVolume",le="0.25"} 0`,
+		`ebs_csi_aws_api_request_duration_seconds_bucket{request="AttachVolume",le="0.5"} 1`,
+		`ebs_csi_aws_api_request_duration_seconds_count{request="AttachVolume"} 1`,
+		`ebs_csi_aws_api_request_throttles_total{request="DescribeVolumes"} 1`,
+		`ebs_csi_rpc_duration_seconds_sum{code="OK",method="/csi.v0.Controller/ControllerPublishVolume"} 2`,
+		`ebs_csi_devices_in_use{node="i-test"} 3`,
+		`ebs_csi_device_allocation_failures_total{node="i-test"} 1`,
+	}
+	got := recorder.Body.String()
+	for _, line := range expected {
+		if !strings.Contains(got, line+"\n") {
+			t.Fatalf("Expected metrics to contain %q, got:\n%s", line, got)
+		}
+	}
+}
@@ -18,11 +18,14 @@ package util
 
 import (
 	"fmt"
+	"net"
 	"net/url"
-	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // TODO: check division by zero and int overflow
@@ -31,23 +34,84 @@ func roundUpSize(volumeSizeBytes int64, allocationUnitBytes int64) int64 {
 	return (volumeSizeBytes + allocationUnitBytes - 1) / allocationUnitBytes
 }
 
+// RoundUpBytes rounds up the size to a whole number of GiB, returned in bytes.
 func RoundUpBytes(volumeSizeBytes int64) int64 {
 	sizeGiB := roundUpSize(volumeSizeBytes, 1024*1024*1024)
 	return sizeGiB * 1024 * 1024 * 1024
 }
 
+// RoundUpGiB rounds up the size in bytes to a whole number of GiB.
 func RoundUpGiB(volumeSizeBytes int64) int64 {
 	return roundUpSize(volumeSizeBytes, 1024*1024*1024)
 }
 
+// BytesToGiB converts the size in bytes to GiB, truncating any fraction of GiB.
+// Use RoundUpGiB for requested sizes, which must never be shrunk.
 func BytesToGiB(volumeSizeBytes int64) int64 {
 	return ((volumeSizeBytes / 1024) / 1024) / 1024
 }
 
+// GiBToBytes converts the size in GiB to bytes.
 func GiBToBytes(volumeSizeBytes int64) int64 {
 	return volumeSizeBytes * 1024 * 1024 * 1024
 }
 
+// ParseTags parses tags given as comma-separated key=value pairs, e.g. "k1=v1,k2=v2".
+func ParseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	if len(s) == 0 {
+		return tags, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return nil, fmt.Errorf("invalid tag %q, expected key=value", pair)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, nil
+}
+
+// ParseDurations parses durations given as comma-separated key=duration pairs,
+// e.g. "k1=30s,k2=5m".
+func ParseDurations(s string) (map[string]time.Duration, error) {
+	pairs, err := ParseTags(s)
+	if err != nil {
+		return nil, err
+	}
+	durations := make(map[string]time.Duration, len(pairs))
+	for key, value := range pairs {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration of %q: %v", key, err)
+		}
+		durations[key] = d
+	}
+	return durations, nil
+}
+
+// NormalizeVolumeName trims the whitespace around a volume name and checks it
+// can be stored in a tag value of at most maxLength characters, which AWS
+// restricts to letters, digits, spaces and the characters _.:/=+-@.
+func NormalizeVolumeName(name string, maxLength int) (string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 {
+		return "", fmt.Errorf("volume name is empty")
+	}
+	if n := utf8.RuneCountInString(name); n > maxLength {
+		return "", fmt.Errorf("volume name is %d characters long, at most %d are allowed", n, maxLength)
+	}
+	for _, r := range name {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ' || strings.ContainsRune("_.:/=+-@", r) {
+			continue
+		}
+		return "", fmt.Errorf("volume name %q contains the invalid character %q", name, r)
+	}
+	return name, nil
+}
+
+// ParseEndpoint splits a CSI endpoint into the network and the address to listen on.
+// Only unix://<path> and tcp://<host>:<port> endpoints are supported.
 func ParseEndpoint(endpoint string) (string, string, error) {
 	u, err := url.Parse(endpoint)
 	if err != nil {
@@ -59,13 +123,17 @@ func ParseEndpoint(endpoint string) (string, string, error) {
 	scheme := strings.ToLower(u.Scheme)
 	switch scheme {
 	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil || (u.Path != "" && u.Path != "/") {
+			return "", "", fmt.Errorf("invalid tcp endpoint %q, expected tcp://<host>:<port>", endpoint)
+		}
+		addr = u.Host
 	case "unix":
 		addr = path.Join("/", addr)
-		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-			return "", "", fmt.Errorf("could not remove unix domain socket %q: %v", addr, err)
+		if addr == "/" {
+			return "", "", fmt.Errorf("invalid unix endpoint %q, expected unix://<path>", endpoint)
 		}
 	default:
-		return "", "", fmt.Errorf("unsupported protocol: %s", scheme)
+		return "", "", fmt.Errorf("unsupported protocol %q in endpoint %q, expected unix or tcp", scheme, endpoint)
 	}
 
 	return scheme, addr, nil
@@ -0,0 +1,317 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const GiB = 1024 * 1024 * 1024
+
+func TestRoundUpGiB(t *testing.T) {
+	testCases := []struct {
+		name     string
+		bytes    int64
+		expGiB   int64
+		expBytes int64
+	}{
+		{
+			name:     "zero",
+			bytes:    0,
+			expGiB:   0,
+			expBytes: 0,
+		},
+		{
+			name:     "one byte",
+			bytes:    1,
+			expGiB:   1,
+			expBytes: GiB,
+		},
+		{
+			name:     "exactly 1 GiB",
+			bytes:    GiB,
+			expGiB:   1,
+			expBytes: GiB,
+		},
+		{
+			name:     "1 byte over 1 GiB",
+			bytes:    GiB + 1,
+			expGiB:   2,
+			expBytes: 2 * GiB,
+		},
+		{
+			name:     "1.5 GiB",
+			bytes:    GiB + GiB/2,
+			expGiB:   2,
+			expBytes: 2 * GiB,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		if got := RoundUpGiB(tc.bytes); got != tc.expGiB {
+			t.Fatalf("RoundUpGiB(%d): expected %d, got %d", tc.bytes, tc.expGiB, got)
+		}
+		if got := RoundUpBytes(tc.bytes); got != tc.expBytes {
+			t.Fatalf("RoundUpBytes(%d): expected %d, got %d", tc.bytes, tc.expBytes, got)
+		}
+		if got := GiBToBytes(tc.expGiB); got != tc.expBytes {
+			t.Fatalf("GiBToBytes(%d): expected %d, got %d", tc.expGiB, tc.expBytes, got)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	testCases := []struct {
+		name    string
+		s       string
+		expTags map[string]string
+		expErr  bool
+	}{
+		{
+			name:    "empty",
+			s:       "",
+			expTags: map[string]string{},
+		},
+		{
+			name:    "multiple tags",
+			s:       "k1=v1,k2=,k3=a=b",
+			expTags: map[string]string{"k1": "v1", "k2": "", "k3": "a=b"},
+		},
+		{
+			name:   "missing value",
+			s:      "k1",
+			expErr: true,
+		},
+		{
+			name:   "missing key",
+			s:      "=v1",
+			expErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		tags, err := ParseTags(tc.s)
+		if err != nil {
+			if !tc.expErr {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			continue
+		}
+		if tc.expErr {
+			t.Fatal("Expected error, got nothing")
+		}
+		if len(tags) != len(tc.expTags) {
+			t.Fatalf("Expected tags %v, got %v", tc.expTags, tags)
+		}
+		for k, v := range tc.expTags {
+			if got, ok := tags[k]; !ok || got != v {
+				t.Fatalf("Expected tags %v, got %v", tc.expTags, tags)
+			}
+		}
+	}
+}
+
+func TestNormalizeVolumeName(t *testing.T) {
+	testCases := []struct {
+		name       string
+		volumeName string
+		expName    string
+		expErr     bool
+	}{
+		{
+			name:       "valid name",
+			volumeName: "pvc-0a1b2c3d_test.vol:1/2=3+4@x",
+			expName:    "pvc-0a1b2c3d_test.vol:1/2=3+4@x",
+		},
+		{
+			name:       "surrounding whitespace",
+			volumeName: "  pvc-1 \t",
+			expName:    "pvc-1",
+		},
+		{
+			name:       "longest name",
+			volumeName: strings.Repeat("a", 32),
+			expName:    strings.Repeat("a", 32),
+		},
+		{
+			name:       "too long",
+			volumeName: strings.Repeat("a", 33),
+			expErr:     true,
+		},
+		{
+			name:       "invalid character",
+			volumeName: "pvc-1;rm",
+			expErr:     true,
+		},
+		{
+			name:       "only whitespace",
+			volumeName: "  ",
+			expErr:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		name, err := NormalizeVolumeName(tc.volumeName, 32)
+		if err != nil {
+			if !tc.expErr {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			continue
+		}
+		if tc.expErr {
+			t.Fatal("Expected error, got nothing")
+		}
+		if name != tc.expName {
+			t.Fatalf("Expected name %q, got %q", tc.expName, name)
+		}
+	}
+}
+
+func TestParseDurations(t *testing.T) {
+	testCases := []struct {
+		name         string
+		s            string
+		expDurations map[string]time.Duration
+		expErr       bool
+	}{
+		{
+			name:         "empty",
+			s:            "",
+			expDurations: map[string]time.Duration{},
+		},
+		{
+			name:         "multiple durations",
+			s:            "k1=30s,k2=5m",
+			expDurations: map[string]time.Duration{"k1": 30 * time.Second, "k2": 5 * time.Minute},
+		},
+		{
+			name:   "invalid duration",
+			s:      "k1=30",
+			expErr: true,
+		},
+		{
+			name:   "missing value",
+			s:      "k1",
+			expErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		durations, err := ParseDurations(tc.s)
+		if err != nil {
+			if !tc.expErr {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			continue
+		}
+		if tc.expErr {
+			t.Fatal("Expected error, got nothing")
+		}
+		if !reflect.DeepEqual(durations, tc.expDurations) {
+			t.Fatalf("Expected durations %v, got %v", tc.expDurations, durations)
+		}
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+	testCases := []struct {
+		name      string
+		endpoint  string
+		expScheme string
+		expAddr   string
+		expErr    bool
+	}{
+		{
+			name:      "unix absolute path",
+			endpoint:  "unix:///csi-test/csi.sock",
+			expScheme: "unix",
+			expAddr:   "/csi-test/csi.sock",
+		},
+		{
+			name:      "unix relative path",
+			endpoint:  "unix://csi-test/csi.sock",
+			expScheme: "unix",
+			expAddr:   "/csi-test/csi.sock",
+		},
+		{
+			name:      "tcp",
+			endpoint:  "tcp://127.0.0.1:10000",
+			expScheme: "tcp",
+			expAddr:   "127.0.0.1:10000",
+		},
+		{
+			name:      "tcp with trailing slash",
+			endpoint:  "TCP://localhost:10000/",
+			expScheme: "tcp",
+			expAddr:   "localhost:10000",
+		},
+		{
+			name:     "tcp without port",
+			endpoint: "tcp://127.0.0.1",
+			expErr:   true,
+		},
+		{
+			name:     "tcp with path",
+			endpoint: "tcp://127.0.0.1:10000/csi",
+			expErr:   true,
+		},
+		{
+			name:     "unix without path",
+			endpoint: "unix://",
+			expErr:   true,
+		},
+		{
+			name:     "unsupported scheme",
+			endpoint: "http://127.0.0.1:10000",
+			expErr:   true,
+		},
+		{
+			name:     "missing scheme",
+			endpoint: "/csi-test/csi.sock",
+			expErr:   true,
+		},
+		{
+			name:     "malformed",
+			endpoint: "://csi.sock",
+			expErr:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		scheme, addr, err := ParseEndpoint(tc.endpoint)
+		if err != nil {
+			if !tc.expErr {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			continue
+		}
+		if tc.expErr {
+			t.Fatal("Expected error, got nothing")
+		}
+		if scheme != tc.expScheme || addr != tc.expAddr {
+			t.Fatalf("Expected %q and %q, got %q and %q", tc.expScheme, tc.expAddr, scheme, addr)
+		}
+	}
+}
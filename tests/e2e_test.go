@@ -173,12 +173,12 @@ func TestControllerE2E(t *testing.T) {
 }
 
 func runCSIDriver() {
-	cloud, err := cloud.NewCloud()
+	cloud, err := cloud.NewCloud(&cloud.CloudOptions{})
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	drv := driver.NewDriver(cloud, nil, endpoint)
+	drv := driver.NewDriver(cloud, nil, &driver.DriverOptions{Endpoint: endpoint})
 	if err := drv.Run(); err != nil {
 		log.Fatalln(err)
 	}
@@ -37,7 +37,7 @@ func TestSanity(t *testing.T) {
 		t.Fatalf("could not remove socket file %s: %v", socket, err)
 	}
 
-	ebsDriver := driver.NewDriver(cloud.NewFakeCloudProvider(), driver.NewFakeMounter(), endpoint)
+	ebsDriver := driver.NewDriver(cloud.NewFakeCloudProvider(), driver.NewFakeMounter(), &driver.DriverOptions{Endpoint: endpoint})
 	defer ebsDriver.Stop()
 
 	go func() {